@@ -13,8 +13,14 @@ import (
 	"github.com/yigitkonur/proxy-http-forward/pkg/config"
 	"github.com/yigitkonur/proxy-http-forward/pkg/log"
 	"github.com/yigitkonur/proxy-http-forward/pkg/proxy"
+	"github.com/yigitkonur/proxy-http-forward/pkg/quota"
+	"github.com/yigitkonur/proxy-http-forward/pkg/upgrade"
 )
 
+// upgradeTimeout bounds how long a new process may take to start serving
+// after SIGUSR2 before the upgrade is abandoned.
+const upgradeTimeout = 30 * time.Second
+
 var (
 	// Version information (set via ldflags)
 	version   = "dev"
@@ -26,6 +32,8 @@ func main() {
 	// Parse command line flags
 	configPath := flag.String("config", "", "Path to configuration file")
 	showVersion := flag.Bool("version", false, "Show version information")
+	watch := flag.Bool("watch", false, "Reload configuration when the file changes")
+	usageReport := flag.String("usage-report", "", "Print the quota usage report as json or csv and exit")
 	flag.Parse()
 
 	// Show version and exit
@@ -43,6 +51,15 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Print usage from the quota log and exit
+	if *usageReport != "" {
+		if err := printUsageReport(cfg, *usageReport); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to print usage report: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	// Initialize logger
 	logger, err := log.New(cfg.Logging)
 	if err != nil {
@@ -58,27 +75,97 @@ func main() {
 		"build_date", buildDate,
 	)
 
-	// Create and start the proxy server
-	server := proxy.New(cfg, sugar)
+	// Take over listeners from a previous process or systemd, if any
+	up, err := upgrade.New()
+	if err != nil {
+		sugar.Errorw("failed to inherit listeners", "error", err)
+		os.Exit(1)
+	}
+
+	// Create the proxy server and bind its listeners
+	server, err := proxy.New(cfg, sugar)
+	if err != nil {
+		sugar.Errorw("failed to create server", "error", err)
+		os.Exit(1)
+	}
+	if err := server.Listen(up.Listen); err != nil {
+		sugar.Errorw("failed to listen", "error", err)
+		os.Exit(1)
+	}
 
-	// Handle graceful shutdown
+	// Handle graceful shutdown, reloads, log reopening and upgrades
 	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	// Reload on file changes too, if asked; changes are handled in the
+	// signal loop so reloads never overlap
+	changed := make(chan struct{}, 1)
+	if *watch {
+		if cfg.File == "" {
+			sugar.Warn("no configuration file to watch")
+		} else {
+			w, err := config.Watch(cfg.File, func() {
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			})
+			if err != nil {
+				sugar.Errorw("failed to watch configuration file", "error", err)
+				os.Exit(1)
+			}
+			defer w.Close()
+			sugar.Infow("watching configuration file", "file", cfg.File)
+		}
+	}
 
 	// Start server in goroutine
 	errChan := make(chan error, 1)
 	go func() {
-		if err := server.Start(); err != nil {
+		if err := server.Serve(); err != nil {
 			errChan <- err
 		}
 	}()
 
-	// Wait for shutdown signal or error
-	select {
-	case sig := <-quit:
-		sugar.Infow("received shutdown signal", "signal", sig.String())
-	case err := <-errChan:
-		sugar.Errorw("server error", "error", err)
+	// Let a parent process know it can drain
+	if err := up.Ready(); err != nil {
+		sugar.Warnw("failed to notify previous process", "error", err)
+	}
+	if up.Inherited() {
+		sugar.Info("took over listeners from previous process")
+	}
+
+	// Wait for shutdown signal, successful upgrade or error
+wait:
+	for {
+		select {
+		case <-changed:
+			reload(*configPath, server, logger, "file")
+		case sig := <-quit:
+			if sig == syscall.SIGHUP {
+				reload(*configPath, server, logger, "signal")
+				continue
+			}
+			if sig == syscall.SIGUSR1 {
+				reopenLogs(server, logger)
+				continue
+			}
+			if sig != syscall.SIGUSR2 {
+				sugar.Infow("received shutdown signal", "signal", sig.String())
+				break wait
+			}
+			sugar.Info("received upgrade signal, starting new process")
+			pid, err := up.Upgrade(upgradeTimeout)
+			if err != nil {
+				sugar.Errorw("upgrade failed, still serving", "error", err)
+				continue
+			}
+			sugar.Infow("new process is serving, draining", "pid", pid)
+			break wait
+		case err := <-errChan:
+			sugar.Errorw("server error", "error", err)
+			break wait
+		}
 	}
 
 	// Graceful shutdown with timeout
@@ -92,3 +179,53 @@ func main() {
 
 	sugar.Info("server stopped gracefully")
 }
+
+// reload loads and validates the configuration again and applies what
+// can change at runtime. The running configuration is kept if the new
+// one is invalid.
+func reload(configPath string, server *proxy.Server, logger *log.Logger, trigger string) {
+	sugar := logger.Sugar()
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		sugar.Errorw("configuration reload failed, keeping current configuration",
+			"trigger", trigger,
+			"error", err,
+		)
+		return
+	}
+
+	if err := logger.SetLevel(cfg.Logging.Level); err != nil {
+		sugar.Warnw("failed to change log level", "error", err)
+	}
+	restart := server.Reload(cfg)
+	sugar.Infow("configuration reloaded", "trigger", trigger)
+	if len(restart) > 0 {
+		sugar.Warnw("some changed settings need a restart to take effect", "settings", restart)
+	}
+}
+
+// reopenLogs reopens the application and access log files after an
+// external tool rotated them.
+func reopenLogs(server *proxy.Server, logger *log.Logger) {
+	sugar := logger.Sugar()
+	if err := logger.Reopen(); err != nil {
+		sugar.Errorw("failed to reopen log file", "error", err)
+	}
+	if err := server.ReopenLogs(); err != nil {
+		sugar.Errorw("failed to reopen access log file", "error", err)
+	}
+	sugar.Info("reopened log files")
+}
+
+// printUsageReport writes the usage recorded in the quota log to stdout
+// in format.
+func printUsageReport(cfg *config.Config, format string) error {
+	if cfg.Quotas.File == "" {
+		return fmt.Errorf("quotas.file is not set")
+	}
+	recs, err := quota.ReadReport(cfg.Quotas.File)
+	if err != nil {
+		return err
+	}
+	return quota.WriteReport(os.Stdout, recs, format)
+}
@@ -0,0 +1,318 @@
+// Package accesslog writes one line per proxied request or tunnel, in
+// Squid native, Apache combined or JSON format, to an output of its own.
+package accesslog
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"go.uber.org/zap/zapcore"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/config"
+	"github.com/yigitkonur/proxy-http-forward/pkg/log"
+	"github.com/yigitkonur/proxy-http-forward/pkg/unixsock"
+)
+
+// Entry is one request or tunnel.
+type Entry struct {
+	Time      time.Time // when the request arrived
+	Client    string    // client IP, after any PROXY protocol header
+	Method    string
+	URL       string // absolute URL, or host:port for CONNECT
+	Proto     string
+	Status    int
+	Referer   string
+	UserAgent string
+	MIMEType  string // response content type
+
+	User        string
+	Session     string
+	EgressIP    string
+	Upstream    string // upstream address, empty if none was reached
+	Route       string
+	BytesSent   int64 // response or tunnel bytes to the client
+	BytesRecv   int64 // request or tunnel bytes from the client
+	Duration    time.Duration
+	UpstreamDur time.Duration // until the upstream response, or connected for tunnels
+	SNI         string
+	CloseReason string
+	Peer        *unixsock.Cred
+}
+
+// Logger writes access log entries. A nil Logger discards them.
+type Logger struct {
+	format string
+	fields map[string]bool
+
+	mu  sync.Mutex
+	out zapcore.WriteSyncer
+	buf []byte
+}
+
+// New opens the access log. It returns nil if it is disabled.
+func New(cfg config.AccessLogConfig) (*Logger, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	out, err := log.Output(cfg.Output, cfg.Rotation)
+	if err != nil {
+		return nil, err
+	}
+	fields := cfg.Fields
+	if len(fields) == 0 && cfg.Format == config.AccessLogJSON {
+		fields = config.AccessLogFields
+	}
+	l := &Logger{format: cfg.Format, out: out, fields: make(map[string]bool)}
+	for _, f := range fields {
+		l.fields[f] = true
+	}
+	return l, nil
+}
+
+// Wants reports whether entries include field, so that callers can skip
+// work for fields that are not logged.
+func (l *Logger) Wants(field string) bool {
+	return l != nil && l.fields[field]
+}
+
+// Log writes e.
+func (l *Logger) Log(e *Entry) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.buf[:0]
+	switch l.format {
+	case config.AccessLogJSON:
+		b = l.appendJSON(b, e)
+	case config.AccessLogCombined:
+		b = appendCombined(b, e)
+		b = l.appendExtra(b, e)
+	default:
+		b = appendSquid(b, e)
+		b = l.appendExtra(b, e)
+	}
+	b = append(b, '\n')
+	l.out.Write(b)
+	l.buf = b
+}
+
+// Reopen reopens the output if it is a file, for use after an external
+// tool moved it away.
+func (l *Logger) Reopen() error {
+	if l == nil {
+		return nil
+	}
+	return log.Reopen(l.out)
+}
+
+// Sync flushes buffered output.
+func (l *Logger) Sync() error {
+	if l == nil {
+		return nil
+	}
+	return l.out.Sync()
+}
+
+// appendSquid formats e like Squid's native log format:
+// time elapsed client code/status bytes method URL user hierarchy/peer type.
+func appendSquid(b []byte, e *Entry) []byte {
+	ms := e.Time.UnixMilli()
+	b = strconv.AppendInt(b, ms/1000, 10)
+	b = append(b, '.')
+	b = appendPadded(b, ms%1000, 3, '0')
+	b = append(b, ' ')
+	b = appendPadded(b, e.Duration.Milliseconds(), 6, ' ')
+	b = append(b, ' ')
+	b = append(b, dash(e.Client)...)
+	b = append(b, ' ')
+	b = append(b, squidCode(e)...)
+	b = append(b, '/')
+	b = appendPadded(b, int64(e.Status), 3, '0')
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, e.BytesSent, 10)
+	b = append(b, ' ')
+	b = append(b, e.Method...)
+	b = append(b, ' ')
+	b = append(b, dash(e.URL)...)
+	b = append(b, ' ')
+	b = appendToken(b, e.User)
+	if e.Upstream != "" {
+		b = append(b, " HIER_DIRECT/"...)
+		b = append(b, e.Upstream...)
+	} else {
+		b = append(b, " HIER_NONE/-"...)
+	}
+	b = append(b, ' ')
+	return append(b, dash(e.MIMEType)...)
+}
+
+// squidCode returns the Squid result code for e.
+func squidCode(e *Entry) string {
+	switch {
+	case e.Status == 407 || e.Status == 429:
+		return "TCP_DENIED"
+	case e.Method == "CONNECT" && e.Status == 200:
+		return "TCP_TUNNEL"
+	case e.Upstream == "":
+		return "NONE"
+	}
+	return "TCP_MISS"
+}
+
+// appendCombined formats e in the Apache combined log format.
+func appendCombined(b []byte, e *Entry) []byte {
+	b = append(b, dash(e.Client)...)
+	b = append(b, " - "...)
+	b = appendToken(b, e.User)
+	b = append(b, " ["...)
+	b = e.Time.AppendFormat(b, "02/Jan/2006:15:04:05 -0700")
+	b = append(b, "] \""...)
+	b = append(b, e.Method...)
+	b = append(b, ' ')
+	b = append(b, escape(e.URL)...)
+	b = append(b, ' ')
+	b = append(b, e.Proto...)
+	b = append(b, "\" "...)
+	b = strconv.AppendInt(b, int64(e.Status), 10)
+	b = append(b, ' ')
+	if e.BytesSent > 0 {
+		b = strconv.AppendInt(b, e.BytesSent, 10)
+	} else {
+		b = append(b, '-')
+	}
+	b = append(b, " \""...)
+	b = append(b, escape(dash(e.Referer))...)
+	b = append(b, "\" \""...)
+	b = append(b, escape(dash(e.UserAgent))...)
+	return append(b, '"')
+}
+
+// extra returns the configured fields of e as ordered key/value pairs.
+func (l *Logger) extra(e *Entry) []interface{} {
+	var kv []interface{}
+	for _, f := range config.AccessLogFields {
+		if !l.fields[f] {
+			continue
+		}
+		switch f {
+		case "user":
+			kv = append(kv, "user", e.User)
+		case "session":
+			kv = append(kv, "session", e.Session)
+		case "egress_ip":
+			kv = append(kv, "egress_ip", e.EgressIP)
+		case "upstream":
+			kv = append(kv, "upstream", e.Upstream)
+		case "route":
+			kv = append(kv, "route", e.Route)
+		case "bytes":
+			kv = append(kv, "bytes_sent", e.BytesSent, "bytes_received", e.BytesRecv)
+		case "durations":
+			kv = append(kv, "duration", e.Duration.Seconds(), "upstream_duration", e.UpstreamDur.Seconds())
+		case "sni":
+			kv = append(kv, "sni", e.SNI)
+		case "close_reason":
+			kv = append(kv, "close_reason", e.CloseReason)
+		case "peer":
+			if e.Peer != nil {
+				kv = append(kv, "peer_pid", e.Peer.PID, "peer_uid", e.Peer.UID, "peer_gid", e.Peer.GID)
+			}
+		}
+	}
+	return kv
+}
+
+// appendExtra appends the configured fields as key=value pairs.
+func (l *Logger) appendExtra(b []byte, e *Entry) []byte {
+	kv := l.extra(e)
+	for i := 0; i < len(kv); i += 2 {
+		b = append(b, ' ')
+		b = append(b, kv[i].(string)...)
+		b = append(b, '=')
+		switch v := kv[i+1].(type) {
+		case string:
+			b = appendToken(b, v)
+		case float64:
+			b = strconv.AppendFloat(b, v, 'f', 3, 64)
+		default:
+			b = appendJSONValue(b, v)
+		}
+	}
+	return b
+}
+
+// appendJSON formats e as a JSON object.
+func (l *Logger) appendJSON(b []byte, e *Entry) []byte {
+	kv := append([]interface{}{
+		"time", e.Time.Format("2006-01-02T15:04:05.000Z07:00"),
+		"client", e.Client,
+		"method", e.Method,
+		"url", e.URL,
+		"status", e.Status,
+	}, l.extra(e)...)
+	b = append(b, '{')
+	for i := 0; i < len(kv); i += 2 {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = strconv.AppendQuote(b, kv[i].(string))
+		b = append(b, ':')
+		b = appendJSONValue(b, kv[i+1])
+	}
+	return append(b, '}')
+}
+
+// appendJSONValue appends v encoded as JSON.
+func appendJSONValue(b []byte, v interface{}) []byte {
+	j, err := json.Marshal(v)
+	if err != nil {
+		return append(b, "null"...)
+	}
+	return append(b, j...)
+}
+
+// appendPadded appends n padded to width with pad.
+func appendPadded(b []byte, n int64, width int, pad byte) []byte {
+	s := strconv.FormatInt(n, 10)
+	for i := len(s); i < width; i++ {
+		b = append(b, pad)
+	}
+	return append(b, s...)
+}
+
+// appendToken appends s so that it reads as one space-separated token:
+// "-" if it is empty, and quoted if it holds spaces, quotes, backslashes
+// or characters that are not printable, such as line breaks.
+func appendToken(b []byte, s string) []byte {
+	switch {
+	case s == "":
+		return append(b, '-')
+	case strings.ContainsFunc(s, needsQuote):
+		return strconv.AppendQuote(b, s)
+	}
+	return append(b, s...)
+}
+
+// needsQuote reports whether r cannot appear in an unquoted token.
+func needsQuote(r rune) bool {
+	return r == ' ' || r == '"' || r == '\\' || !unicode.IsPrint(r)
+}
+
+// escape escapes the quotes in s, which combined lines put in quotes.
+func escape(s string) string {
+	return strings.ReplaceAll(s, `"`, `\"`)
+}
+
+// dash returns s, or "-" if it is empty.
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
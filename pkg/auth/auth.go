@@ -0,0 +1,146 @@
+// Package auth provides Basic proxy authentication and parsing of
+// client identities from Proxy-Authorization credentials.
+package auth
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"strings"
+	"sync/atomic"
+
+	"github.com/valyala/fasthttp"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/config"
+)
+
+// Identity describes who made a request.
+type Identity struct {
+	User    string // username with any session suffix removed
+	Session string // session ID from the username, if any
+
+	// Verified reports whether the password was checked against a
+	// configured user. Without it, User and Session are only what the
+	// client claims.
+	Verified bool
+}
+
+// VerifiedUser returns User if it was verified and "" otherwise, for
+// keying per-user state that clients must not be able to choose.
+func (id Identity) VerifiedUser() string {
+	if !id.Verified {
+		return ""
+	}
+	return id.User
+}
+
+// Authenticator checks Proxy-Authorization credentials against the
+// configured users. Its settings can be replaced with Update while it is
+// in use.
+type Authenticator struct {
+	settings atomic.Pointer[settings]
+}
+
+// settings is one version of the auth configuration.
+type settings struct {
+	enabled bool
+	realm   string
+	marker  string
+	users   map[string]string
+}
+
+// New creates an Authenticator from the auth configuration.
+func New(cfg config.AuthConfig) *Authenticator {
+	a := &Authenticator{}
+	a.Update(cfg)
+	return a
+}
+
+// Update replaces the users, realm and session marker. Requests already
+// being authenticated finish with the previous settings.
+func (a *Authenticator) Update(cfg config.AuthConfig) {
+	s := &settings{
+		enabled: cfg.Enabled,
+		realm:   cfg.Realm,
+		marker:  cfg.SessionMarker,
+		users:   make(map[string]string, len(cfg.Users)),
+	}
+	for _, u := range cfg.Users {
+		s.users[u.Username] = u.Password
+	}
+	a.settings.Store(s)
+}
+
+// Authenticate returns the identity presented in header. When
+// authentication is disabled the identity is taken as presented and ok
+// is always true; otherwise ok reports whether the password matched.
+func (a *Authenticator) Authenticate(header *fasthttp.RequestHeader) (id Identity, ok bool) {
+	username, password, present := parseBasic(header.Peek("Proxy-Authorization"))
+	return a.settings.Load().check(username, password, present)
+}
+
+// Check is Authenticate for credentials that arrive some other way, as
+// in the SOCKS5 username/password method. present reports whether the
+// client sent any.
+func (a *Authenticator) Check(username, password string, present bool) (id Identity, ok bool) {
+	return a.settings.Load().check(username, password, present)
+}
+
+// Enabled reports whether clients must authenticate.
+func (a *Authenticator) Enabled() bool {
+	return a.settings.Load().enabled
+}
+
+// check implements Check for one version of the settings.
+func (s *settings) check(username, password string, present bool) (id Identity, ok bool) {
+	if present {
+		id = s.parseUsername(username)
+	}
+	if !s.enabled {
+		return id, true
+	}
+	if !present {
+		return id, false
+	}
+
+	want, known := s.users[id.User]
+	if !known {
+		return id, false
+	}
+	id.Verified = subtle.ConstantTimeCompare([]byte(password), []byte(want)) == 1
+	return id, id.Verified
+}
+
+// ParseUsername splits a username into the user and session ID around
+// the session marker.
+func (a *Authenticator) ParseUsername(username string) Identity {
+	return a.settings.Load().parseUsername(username)
+}
+
+// Challenge returns the Proxy-Authenticate header value.
+func (a *Authenticator) Challenge() string {
+	return `Basic realm="` + a.settings.Load().realm + `"`
+}
+
+// parseUsername implements ParseUsername for one version of the settings.
+func (s *settings) parseUsername(username string) Identity {
+	if s.marker != "" {
+		if user, session, found := strings.Cut(username, s.marker); found {
+			return Identity{User: user, Session: session}
+		}
+	}
+	return Identity{User: username}
+}
+
+// parseBasic decodes Basic credentials.
+func parseBasic(auth []byte) (username, password string, ok bool) {
+	const prefix = "Basic "
+	if len(auth) <= len(prefix) || !strings.EqualFold(string(auth[:len(prefix)]), prefix) {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(string(auth[len(prefix):]))
+	if err != nil {
+		return "", "", false
+	}
+	username, password, ok = strings.Cut(string(decoded), ":")
+	return username, password, ok
+}
@@ -0,0 +1,271 @@
+// Package bandwidth shapes upload and download rates with hierarchical
+// token buckets: a transfer draws from its connection's bucket, its
+// user's bucket and the global bucket, and waits for the slowest.
+package bandwidth
+
+import (
+	"io"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/config"
+	"github.com/yigitkonur/proxy-http-forward/pkg/metrics"
+)
+
+// Direction is which way bytes flow.
+type Direction int
+
+// Directions, as seen from the client.
+const (
+	Upload   Direction = iota // client to upstream
+	Download                  // upstream to client
+)
+
+// String returns the direction as used in metric labels.
+func (d Direction) String() string {
+	if d == Download {
+		return "download"
+	}
+	return "upload"
+}
+
+// Bucket levels, reported as the level label of throttled time.
+const (
+	levelConnection = "connection"
+	levelUser       = "user"
+	levelGlobal     = "global"
+)
+
+// maxChunk caps how much a Reader passes on per read, so that waits stay
+// short and transfers sharing a bucket take turns.
+const maxChunk = 32 * 1024
+
+// Shaper hands out the buckets of new connections. Its limits can be
+// replaced while it is in use; open connections keep the buckets they
+// started with.
+type Shaper struct {
+	state atomic.Pointer[state]
+
+	throughput [2]prometheus.Counter
+	throttled  [2]map[string]prometheus.Counter
+}
+
+// state is the configuration in effect and its shared buckets.
+type state struct {
+	cfg    config.BandwidthConfig
+	global [2]*bucket
+
+	mu    sync.Mutex
+	users map[string]*userBuckets
+}
+
+// userBuckets are the buckets of one user, shared by the user's open
+// connections.
+type userBuckets struct {
+	buckets [2]*bucket
+	refs    int
+}
+
+// New creates a Shaper from configuration. m may be nil.
+func New(cfg config.BandwidthConfig, m *metrics.Metrics) *Shaper {
+	s := &Shaper{}
+	if m != nil {
+		for _, d := range []Direction{Upload, Download} {
+			s.throughput[d] = m.Throughput.WithLabelValues(d.String())
+			s.throttled[d] = make(map[string]prometheus.Counter)
+			for _, level := range []string{levelConnection, levelUser, levelGlobal} {
+				s.throttled[d][level] = m.ThrottledSeconds.WithLabelValues(d.String(), level)
+			}
+		}
+	}
+	s.Update(cfg)
+	return s
+}
+
+// Update replaces the limits unless cfg is unchanged.
+func (s *Shaper) Update(cfg config.BandwidthConfig) {
+	if cur := s.state.Load(); cur != nil && reflect.DeepEqual(cur.cfg, cfg) {
+		return
+	}
+	s.state.Store(&state{
+		cfg:    cfg,
+		global: newBuckets(levelGlobal, cfg.Global),
+		users:  make(map[string]*userBuckets),
+	})
+}
+
+// Conn returns the buckets for a new connection of user, who may be
+// empty. The caller must Close it once the connection's transfers are
+// done.
+func (s *Shaper) Conn(user string) *Conn {
+	st := s.state.Load()
+	c := &Conn{s: s, st: st, user: user}
+	own := newBuckets(levelConnection, st.cfg.PerConnection)
+
+	var shared [2]*bucket
+	if user != "" && (st.cfg.PerUser.Upload > 0 || st.cfg.PerUser.Download > 0) {
+		st.mu.Lock()
+		u, ok := st.users[user]
+		if !ok {
+			u = &userBuckets{buckets: newBuckets(levelUser, st.cfg.PerUser)}
+			st.users[user] = u
+		}
+		u.refs++
+		st.mu.Unlock()
+		shared = u.buckets
+		c.shared = true
+	}
+
+	for d := range c.chains {
+		for _, b := range []*bucket{own[d], shared[d], st.global[d]} {
+			if b != nil {
+				c.chains[d] = append(c.chains[d], b)
+			}
+		}
+	}
+	return c
+}
+
+// Conn draws the transfers of one connection from its buckets.
+type Conn struct {
+	s      *Shaper
+	st     *state
+	user   string
+	shared bool // holds a reference to the user's buckets
+	chains [2][]*bucket
+
+	throttled [2]atomic.Int64 // nanoseconds waited per direction
+
+	closeOnce sync.Once
+}
+
+// Limited reports whether transfers in direction d are shaped.
+func (c *Conn) Limited(d Direction) bool {
+	return len(c.chains[d]) > 0
+}
+
+// Wait accounts for n bytes in direction d and blocks until the buckets
+// allow them.
+func (c *Conn) Wait(d Direction, n int) {
+	if n <= 0 {
+		return
+	}
+	if t := c.s.throughput[d]; t != nil {
+		t.Add(float64(n))
+	}
+	if len(c.chains[d]) == 0 {
+		return
+	}
+
+	now := time.Now()
+	var wait time.Duration
+	var level string
+	for _, b := range c.chains[d] {
+		if w := b.reserve(n, now); w > wait {
+			wait, level = w, b.level
+		}
+	}
+	if wait > 0 {
+		if t := c.s.throttled[d][level]; t != nil {
+			t.Add(wait.Seconds())
+		}
+		c.throttled[d].Add(int64(wait))
+		time.Sleep(wait)
+	}
+}
+
+// Throttled returns how long transfers in direction d have waited so far.
+func (c *Conn) Throttled(d Direction) time.Duration {
+	return time.Duration(c.throttled[d].Load())
+}
+
+// Reader returns r shaped in direction d.
+func (c *Conn) Reader(d Direction, r io.Reader) io.Reader {
+	chunk := maxChunk
+	for _, b := range c.chains[d] {
+		if int(b.size) < chunk {
+			chunk = int(b.size)
+		}
+	}
+	return &reader{r: r, c: c, d: d, chunk: chunk}
+}
+
+// Close releases the connection's share of its user's buckets.
+func (c *Conn) Close() {
+	if !c.shared {
+		return
+	}
+	c.closeOnce.Do(func() {
+		c.st.mu.Lock()
+		defer c.st.mu.Unlock()
+		if u := c.st.users[c.user]; u != nil {
+			if u.refs--; u.refs == 0 {
+				delete(c.st.users, c.user)
+			}
+		}
+	})
+}
+
+// reader shapes reads from r.
+type reader struct {
+	r     io.Reader
+	c     *Conn
+	d     Direction
+	chunk int
+}
+
+func (r *reader) Read(b []byte) (int, error) {
+	if len(b) > r.chunk {
+		b = b[:r.chunk]
+	}
+	n, err := r.r.Read(b)
+	r.c.Wait(r.d, n)
+	return n, err
+}
+
+// bucket is a token bucket of bytes. Reservations may overdraw it; the
+// debt is repaid by waiting.
+type bucket struct {
+	level string
+	rate  float64 // bytes per second
+	size  float64 // one second's worth
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newBuckets returns the upload and download buckets for limit, nil for
+// directions without a rate.
+func newBuckets(level string, limit config.BandwidthLimit) [2]*bucket {
+	var b [2]*bucket
+	for d, rate := range [2]int64{limit.Upload, limit.Download} {
+		if rate > 0 {
+			b[d] = &bucket{level: level, rate: float64(rate), size: float64(rate), tokens: float64(rate), last: time.Now()}
+		}
+	}
+	return b
+}
+
+// reserve takes n tokens and returns how long until the bucket is out
+// of debt.
+func (b *bucket) reserve(n int, now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * b.rate
+		if b.tokens > b.size {
+			b.tokens = b.size
+		}
+		b.last = now
+	}
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
@@ -0,0 +1,228 @@
+// Package breaker stops sending traffic to upstream destinations that keep
+// failing, so requests to them fail fast instead of waiting out dial and
+// response timeouts.
+package breaker
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/config"
+	"github.com/yigitkonur/proxy-http-forward/pkg/metrics"
+)
+
+// ErrOpen is returned by Allow while a destination's breaker is open.
+var ErrOpen = errors.New("circuit breaker open")
+
+// sweepInterval bounds how often unused breakers are purged.
+const sweepInterval = time.Minute
+
+// State is the state of a single breaker.
+type State int
+
+// Breaker states. The values are exported as the state gauge.
+const (
+	Closed   State = iota // requests flow, outcomes are counted
+	Open                  // requests are rejected
+	HalfOpen              // a limited number of probes are let through
+)
+
+// String returns the state name.
+func (s State) String() string {
+	switch s {
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half_open"
+	default:
+		return "closed"
+	}
+}
+
+// breaker tracks one destination.
+type breaker struct {
+	state       State
+	consecutive int // failures in a row
+	requests    int // outcomes in the current window
+	failures    int
+	windowStart time.Time
+	openedAt    time.Time
+	probes      int // half-open requests in flight
+	lastUsed    time.Time
+}
+
+// Set holds a breaker per destination. A nil Set allows everything.
+type Set struct {
+	cfg     config.BreakerConfig
+	metrics *metrics.Metrics
+
+	mu        sync.Mutex
+	breakers  map[string]*breaker
+	lastSweep time.Time
+}
+
+// New creates a Set from configuration. It returns nil if circuit
+// breaking is disabled.
+func New(cfg config.BreakerConfig, m *metrics.Metrics) *Set {
+	if !cfg.Enabled {
+		return nil
+	}
+	if cfg.HalfOpenRequests < 1 {
+		cfg.HalfOpenRequests = 1
+	}
+	return &Set{
+		cfg:       cfg,
+		metrics:   m,
+		breakers:  make(map[string]*breaker),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow reports whether a request to host may proceed. It returns ErrOpen
+// while the breaker is open, and once it is half-open, while all probe
+// slots are taken. Every successful Allow must be followed by Record.
+func (s *Set) Allow(host string) error {
+	if s == nil {
+		return nil
+	}
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.lastSweep) >= sweepInterval {
+		s.sweep(now)
+	}
+
+	b, ok := s.breakers[host]
+	if !ok {
+		b = &breaker{windowStart: now}
+		s.breakers[host] = b
+	}
+	b.lastUsed = now
+
+	switch b.state {
+	case Open:
+		if now.Sub(b.openedAt) < s.cfg.OpenDuration {
+			return ErrOpen
+		}
+		s.setState(host, b, HalfOpen)
+		fallthrough
+	case HalfOpen:
+		if b.probes >= s.cfg.HalfOpenRequests {
+			return ErrOpen
+		}
+		b.probes++
+	}
+	return nil
+}
+
+// Record reports the outcome of a request to host that Allow let through.
+// failed should only be true for failures attributable to the
+// destination, such as refused or reset connections and timeouts.
+func (s *Set) Record(host string, failed bool) {
+	if s == nil {
+		return
+	}
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.breakers[host]
+	if !ok {
+		return
+	}
+
+	switch b.state {
+	case HalfOpen:
+		if b.probes > 0 {
+			b.probes--
+		}
+		if failed {
+			s.trip(host, b, now)
+		} else {
+			s.reset(host, b, now)
+		}
+	case Closed:
+		if s.cfg.Window > 0 && now.Sub(b.windowStart) >= s.cfg.Window {
+			b.requests, b.failures = 0, 0
+			b.windowStart = now
+		}
+		b.requests++
+		if !failed {
+			b.consecutive = 0
+			return
+		}
+		b.failures++
+		b.consecutive++
+		if s.shouldTrip(b) {
+			s.trip(host, b, now)
+		}
+	}
+	// Outcomes arriving while open belong to requests admitted before the
+	// breaker tripped and are ignored.
+}
+
+// State returns the current state of host's breaker.
+func (s *Set) State(host string) State {
+	if s == nil {
+		return Closed
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if b, ok := s.breakers[host]; ok {
+		return b.state
+	}
+	return Closed
+}
+
+// shouldTrip reports whether a closed breaker has crossed a threshold.
+func (s *Set) shouldTrip(b *breaker) bool {
+	if s.cfg.ConsecutiveFailures > 0 && b.consecutive >= s.cfg.ConsecutiveFailures {
+		return true
+	}
+	if s.cfg.FailureRate <= 0 || b.requests < s.cfg.MinRequests || b.requests == 0 {
+		return false
+	}
+	return float64(b.failures)/float64(b.requests) >= s.cfg.FailureRate
+}
+
+// trip opens b. The caller must hold s.mu.
+func (s *Set) trip(host string, b *breaker, now time.Time) {
+	b.openedAt = now
+	b.probes = 0
+	s.setState(host, b, Open)
+}
+
+// reset closes b and clears its counters. The caller must hold s.mu.
+func (s *Set) reset(host string, b *breaker, now time.Time) {
+	b.consecutive, b.requests, b.failures, b.probes = 0, 0, 0, 0
+	b.windowStart = now
+	s.setState(host, b, Closed)
+}
+
+// setState changes b's state and updates the gauge. The caller must hold
+// s.mu.
+func (s *Set) setState(host string, b *breaker, state State) {
+	b.state = state
+	if s.metrics != nil {
+		s.metrics.SetBreakerState(host, int(state))
+	}
+}
+
+// sweep removes closed breakers that have not been used for a while. The
+// caller must hold s.mu.
+func (s *Set) sweep(now time.Time) {
+	idle := sweepInterval
+	if s.cfg.Window > idle {
+		idle = s.cfg.Window
+	}
+	for host, b := range s.breakers {
+		if b.state == Closed && now.Sub(b.lastUsed) >= idle {
+			delete(s.breakers, host)
+		}
+	}
+	s.lastSweep = now
+}
@@ -0,0 +1,58 @@
+package config
+
+import "fmt"
+
+// Access log formats.
+const (
+	AccessLogSquid    = "squid"    // Squid native
+	AccessLogCombined = "combined" // Apache combined
+	AccessLogJSON     = "json"     // one JSON object per line
+)
+
+// AccessLogFields lists the fields an access log can add to its format.
+var AccessLogFields = []string{
+	"user",         // authenticated user
+	"session",      // sticky session ID
+	"egress_ip",    // local address of the upstream connection
+	"upstream",     // upstream address the request went to
+	"route",        // name of the matching route
+	"bytes",        // bytes sent to and received from the client
+	"durations",    // total and upstream time
+	"sni",          // TLS server name from the client
+	"close_reason", // why a tunnel closed
+	"peer",         // peer credentials of unix socket clients
+}
+
+// AccessLogConfig controls the access log: one line per request or
+// tunnel, written apart from the application log.
+type AccessLogConfig struct {
+	Enabled bool     `mapstructure:"enabled"`
+	Format  string   `mapstructure:"format"` // squid, combined or json
+	Output  string   `mapstructure:"output"` // stdout, stderr or file path
+	Fields  []string `mapstructure:"fields"` // added fields; empty = all for json, none otherwise
+
+	// Rotation of the output, if it is a file
+	Rotation RotationConfig `mapstructure:"rotation"`
+}
+
+// validate checks the format and field names.
+func (a *AccessLogConfig) validate() error {
+	if !a.Enabled {
+		return nil
+	}
+	switch a.Format {
+	case AccessLogSquid, AccessLogCombined, AccessLogJSON:
+	default:
+		return fmt.Errorf("logging.access.format must be squid, combined or json")
+	}
+	for _, f := range a.Fields {
+		known := false
+		for _, k := range AccessLogFields {
+			known = known || f == k
+		}
+		if !known {
+			return fmt.Errorf("logging.access.fields: unknown field %q", f)
+		}
+	}
+	return a.Rotation.validate("logging.access.rotation")
+}
@@ -0,0 +1,35 @@
+package config
+
+import "fmt"
+
+// BandwidthConfig shapes transfer rates. Traffic is limited by every
+// level that sets a rate, and waits for the slowest of them.
+type BandwidthConfig struct {
+	Global        BandwidthLimit `mapstructure:"global"`         // all traffic together
+	PerUser       BandwidthLimit `mapstructure:"per_user"`       // each authenticated user's traffic together
+	PerConnection BandwidthLimit `mapstructure:"per_connection"` // each tunnel or HTTP request
+}
+
+// BandwidthLimit holds rates in bytes per second; 0 = unlimited.
+type BandwidthLimit struct {
+	Upload   int64 `mapstructure:"upload"`   // client to upstream
+	Download int64 `mapstructure:"download"` // upstream to client
+}
+
+// validate checks that rates are not negative.
+func (b *BandwidthConfig) validate() error {
+	levels := []struct {
+		name  string
+		limit BandwidthLimit
+	}{
+		{"global", b.Global},
+		{"per_user", b.PerUser},
+		{"per_connection", b.PerConnection},
+	}
+	for _, l := range levels {
+		if l.limit.Upload < 0 || l.limit.Download < 0 {
+			return fmt.Errorf("proxy.bandwidth.%s rates must be >= 0", l.name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// ConcurrencyConfig caps how many plain HTTP requests and CONNECT
+// tunnels are handled at once. Requests and tunnels over a cap wait in a
+// bounded queue for a slot, and are rejected with 503 once the queue is
+// full or they have waited queue_timeout.
+type ConcurrencyConfig struct {
+	MaxRequests  int           `mapstructure:"max_requests"`  // concurrent plain HTTP requests, 0 = unlimited
+	MaxTunnels   int           `mapstructure:"max_tunnels"`   // open CONNECT tunnels, 0 = unlimited
+	QueueSize    int           `mapstructure:"queue_size"`    // waiting requests, and waiting tunnels; 0 = reject at once
+	QueueTimeout time.Duration `mapstructure:"queue_timeout"` // longest wait for a slot
+	RetryAfter   time.Duration `mapstructure:"retry_after"`   // sent with 503 responses
+
+	// Lowers the request cap while upstream latency is high
+	Adaptive AdaptiveConfig `mapstructure:"adaptive"`
+}
+
+// AdaptiveConfig shrinks the cap on concurrent HTTP requests while their
+// upstream latency stays above TargetLatency, and grows it back towards
+// max_requests once latency recovers. While latency is high, requests
+// over the cap are shed instead of queued.
+type AdaptiveConfig struct {
+	Enabled       bool          `mapstructure:"enabled"`
+	TargetLatency time.Duration `mapstructure:"target_latency"` // average upstream latency to stay under
+	MinRequests   int           `mapstructure:"min_requests"`   // the cap never drops below this
+}
+
+// validate checks the caps and the adaptive limit.
+func (c *ConcurrencyConfig) validate() error {
+	if c.MaxRequests < 0 || c.MaxTunnels < 0 {
+		return fmt.Errorf("proxy.concurrency caps must be >= 0")
+	}
+	if c.QueueSize < 0 {
+		return fmt.Errorf("proxy.concurrency.queue_size must be >= 0")
+	}
+	if c.QueueTimeout < 0 || c.RetryAfter < 0 {
+		return fmt.Errorf("proxy.concurrency durations must be >= 0")
+	}
+	if a := c.Adaptive; a.Enabled {
+		if c.MaxRequests == 0 {
+			return fmt.Errorf("proxy.concurrency.adaptive needs max_requests")
+		}
+		if a.TargetLatency <= 0 {
+			return fmt.Errorf("proxy.concurrency.adaptive.target_latency must be > 0")
+		}
+		if a.MinRequests < 1 || a.MinRequests > c.MaxRequests {
+			return fmt.Errorf("proxy.concurrency.adaptive.min_requests must be between 1 and max_requests")
+		}
+	}
+	return nil
+}
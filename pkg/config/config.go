@@ -4,6 +4,8 @@ package config
 
 import (
 	"fmt"
+	"net"
+	"runtime"
 	"strings"
 	"time"
 
@@ -16,6 +18,13 @@ type Config struct {
 	Proxy   ProxyConfig   `mapstructure:"proxy"`
 	Logging LoggingConfig `mapstructure:"logging"`
 	Metrics MetricsConfig `mapstructure:"metrics"`
+	DNS     DNSConfig     `mapstructure:"dns"`
+	Egress  EgressConfig  `mapstructure:"egress"`
+	Auth    AuthConfig    `mapstructure:"auth"`
+	Quotas  QuotaConfig   `mapstructure:"quotas"`
+	Routes  []RouteConfig `mapstructure:"routes"`
+
+	File string `mapstructure:"-"` // configuration file read by Load, if any
 }
 
 // ServerConfig holds HTTP server configuration.
@@ -26,13 +35,117 @@ type ServerConfig struct {
 	IdleTimeout        time.Duration `mapstructure:"idle_timeout"`
 	MaxConnsPerIP      int           `mapstructure:"max_conns_per_ip"`
 	MaxRequestsPerConn int           `mapstructure:"max_requests_per_conn"`
+	TunnelDrainTimeout time.Duration `mapstructure:"tunnel_drain_timeout"` // on shutdown, wait this long for tunnels to finish
+
+	// Listeners replace Address when set, each with its own settings
+	Listeners []ListenerConfig `mapstructure:"listeners"`
 }
 
 // ProxyConfig holds proxy-specific configuration.
 type ProxyConfig struct {
 	DialTimeout     time.Duration `mapstructure:"dial_timeout"`
 	ResponseTimeout time.Duration `mapstructure:"response_timeout"`
-	MaxIdleConns    int           `mapstructure:"max_idle_conns"`
+	MaxIdleConns    int           `mapstructure:"max_idle_conns"` // deprecated: used as max_conns_per_host when that is 0
+
+	// Upstream connection pool
+	MaxConns        int           `mapstructure:"max_conns"`          // across all hosts, 0 = unlimited
+	MaxConnsPerHost int           `mapstructure:"max_conns_per_host"` // per upstream host
+	IdleConnTimeout time.Duration `mapstructure:"idle_conn_timeout"`  // close keep-alive connections idle this long
+
+	// Dual-stack dialing (RFC 8305 Happy Eyeballs)
+	AddressFamily      string        `mapstructure:"address_family"`       // prefer_ipv4, prefer_ipv6, ipv4_only, ipv6_only
+	HappyEyeballsDelay time.Duration `mapstructure:"happy_eyeballs_delay"` // delay between connection attempts
+
+	// Socket options for outbound connections, unless a route overrides them
+	Socket SocketConfig `mapstructure:"socket"`
+
+	// Finer-grained timeouts, unless a route overrides them
+	Timeouts TimeoutConfig `mapstructure:"timeouts"`
+
+	// TLS to upstream servers for https:// requests, unless a route
+	// overrides it
+	TLS TLSConfig `mapstructure:"tls"`
+
+	// Retries of failed upstream HTTP requests
+	Retry RetryConfig `mapstructure:"retry"`
+
+	// Per-destination circuit breaking
+	CircuitBreaker BreakerConfig `mapstructure:"circuit_breaker"`
+
+	// Request and tunnel rate limits per client, user or destination
+	RateLimits RateLimitConfig `mapstructure:"rate_limits"`
+
+	// Upload and download rate limits for tunnels and HTTP bodies
+	Bandwidth BandwidthConfig `mapstructure:"bandwidth"`
+
+	// Caps on concurrent requests and tunnels, and overload shedding
+	Concurrency ConcurrencyConfig `mapstructure:"concurrency"`
+}
+
+// BreakerConfig controls the per-destination circuit breaker. A breaker
+// opens after ConsecutiveFailures failures in a row, or when at least
+// MinRequests requests in Window failed at FailureRate or more.
+type BreakerConfig struct {
+	Enabled             bool          `mapstructure:"enabled"`
+	ConsecutiveFailures int           `mapstructure:"consecutive_failures"` // 0 disables this trigger
+	FailureRate         float64       `mapstructure:"failure_rate"`         // 0-1, 0 disables this trigger
+	MinRequests         int           `mapstructure:"min_requests"`         // requests in window before failure_rate applies
+	Window              time.Duration `mapstructure:"window"`               // failure-rate measurement window
+	OpenDuration        time.Duration `mapstructure:"open_duration"`        // time open before probing again
+	HalfOpenRequests    int           `mapstructure:"half_open_requests"`   // concurrent probes while half-open
+}
+
+// RetryConfig controls retrying of upstream HTTP requests.
+type RetryConfig struct {
+	MaxAttempts        int           `mapstructure:"max_attempts"`         // including the first, 1 = no retries
+	Backoff            time.Duration `mapstructure:"backoff"`              // base delay, doubled each retry
+	MaxBackoff         time.Duration `mapstructure:"max_backoff"`          // cap on the delay before jitter
+	RetryOn            []string      `mapstructure:"retry_on"`             // connect, reset, timeout
+	RetryStatuses      []int         `mapstructure:"retry_statuses"`       // upstream status codes to retry
+	RetryNonIdempotent bool          `mapstructure:"retry_non_idempotent"` // also retry e.g. POST when the body is replayable
+}
+
+// SocketConfig holds options applied to outbound sockets. They are
+// supported on Linux only; zero values leave the system defaults.
+type SocketConfig struct {
+	Mark              uint32        `mapstructure:"mark"`               // SO_MARK (fwmark) for policy routing
+	BindToDevice      string        `mapstructure:"bind_to_device"`     // SO_BINDTODEVICE interface name
+	DSCP              int           `mapstructure:"dscp"`               // DiffServ code point, 0-63
+	NoDelay           *bool         `mapstructure:"tcp_nodelay"`        // TCP_NODELAY (Go enables it by default)
+	KeepAliveIdle     time.Duration `mapstructure:"keepalive_idle"`     // TCP_KEEPIDLE
+	KeepAliveInterval time.Duration `mapstructure:"keepalive_interval"` // TCP_KEEPINTVL
+	KeepAliveCount    int           `mapstructure:"keepalive_count"`    // TCP_KEEPCNT
+	FastOpen          bool          `mapstructure:"tcp_fastopen"`       // TCP_FASTOPEN_CONNECT
+}
+
+// IsZero reports whether no socket option is set.
+func (s SocketConfig) IsZero() bool {
+	return s == SocketConfig{}
+}
+
+// RouteConfig overrides outbound settings for destinations matching any
+// of its patterns. Patterns are exact hostnames, "*.example.com" for
+// subdomains, CIDR blocks for IP destinations, or "*" for everything.
+// The first matching route applies.
+type RouteConfig struct {
+	Name     string         `mapstructure:"name"`
+	Match    []string       `mapstructure:"match"`
+	Socket   *SocketConfig  `mapstructure:"socket"`
+	TLS      *TLSConfig     `mapstructure:"tls"`      // set fields override proxy.tls
+	Timeouts *TimeoutConfig `mapstructure:"timeouts"` // set fields override proxy.timeouts
+
+	EgressPool string `mapstructure:"egress_pool"` // egress pool for the destinations, instead of egress.default
+
+	// PROXY protocol v2 header sent to CONNECT destinations
+	SendProxyProtocol *SendProxyProtocolConfig `mapstructure:"send_proxy_protocol"`
+}
+
+// SendProxyProtocolConfig makes CONNECT tunnels start with a PROXY
+// protocol v2 header carrying the client address, the authenticated user
+// and the server name the client asked for.
+type SendProxyProtocolConfig struct {
+	Enabled bool          `mapstructure:"enabled"`
+	SNIWait time.Duration `mapstructure:"sni_wait"` // wait this long for a TLS ClientHello to read SNI; 0 = use the CONNECT host
 }
 
 // LoggingConfig holds logging configuration.
@@ -40,6 +153,35 @@ type LoggingConfig struct {
 	Level  string `mapstructure:"level"`
 	Format string `mapstructure:"format"`
 	Output string `mapstructure:"output"`
+
+	// Rotation of the output, if it is a file
+	Rotation RotationConfig `mapstructure:"rotation"`
+
+	// Access log, separate from the application log above
+	Access AccessLogConfig `mapstructure:"access"`
+}
+
+// RotationConfig rotates a log file by size and time. Rotated files get
+// a timestamp suffix and are optionally gzipped. Zero values disable
+// each limit.
+type RotationConfig struct {
+	MaxSize    int64         `mapstructure:"max_size"`    // bytes before starting a new file
+	Interval   time.Duration `mapstructure:"interval"`    // start a new file this often, e.g. 24h
+	MaxBackups int           `mapstructure:"max_backups"` // rotated files kept
+	MaxAge     time.Duration `mapstructure:"max_age"`     // rotated files older than this are deleted
+	Compress   bool          `mapstructure:"compress"`    // gzip rotated files
+}
+
+// validate checks that limits are not negative. prefix is the key of the
+// rotation block in errors.
+func (r *RotationConfig) validate(prefix string) error {
+	if r.MaxSize < 0 || r.MaxBackups < 0 {
+		return fmt.Errorf("%s limits must be >= 0", prefix)
+	}
+	if r.Interval < 0 || r.MaxAge < 0 {
+		return fmt.Errorf("%s durations must be >= 0", prefix)
+	}
+	return nil
 }
 
 // MetricsConfig holds Prometheus metrics configuration.
@@ -47,6 +189,84 @@ type MetricsConfig struct {
 	Enabled bool   `mapstructure:"enabled"`
 	Address string `mapstructure:"address"`
 	Path    string `mapstructure:"path"`
+
+	// Per-upstream-host statistics
+	UpstreamsPath string `mapstructure:"upstreams_path"` // JSON endpoint, empty to disable
+	HostsTopN     int    `mapstructure:"hosts_top_n"`    // hosts exported by name; the rest become "other"
+}
+
+// DNSConfig holds upstream name resolution configuration.
+// With no upstreams configured the system resolver is used.
+type DNSConfig struct {
+	Upstreams     []DNSUpstreamConfig `mapstructure:"upstreams"`
+	Timeout       time.Duration       `mapstructure:"timeout"`
+	CacheDuration time.Duration       `mapstructure:"cache_duration"`
+}
+
+// DNSUpstreamConfig describes a single resolver, tried in list order.
+type DNSUpstreamConfig struct {
+	Type       string `mapstructure:"type"`        // doh, dot or system
+	Address    string `mapstructure:"address"`     // URL for doh, host:port for dot
+	Method     string `mapstructure:"method"`      // GET or POST (doh only)
+	ServerName string `mapstructure:"server_name"` // TLS server name override
+	Bootstrap  string `mapstructure:"bootstrap"`   // IP to dial instead of resolving the upstream host
+}
+
+// EgressConfig holds outbound source address configuration.
+// With no pools configured the operating system picks the source address.
+type EgressConfig struct {
+	Pools   []EgressPoolConfig `mapstructure:"pools"`
+	Default string             `mapstructure:"default"` // pool used when no other applies
+
+	// SessionTTL keeps requests carrying the same session ID (see
+	// AuthConfig.SessionMarker) on the same egress addresses for this
+	// long after their last use. Zero disables sticky sessions.
+	SessionTTL time.Duration `mapstructure:"session_ttl"`
+
+	// MaxSessions caps the sticky session table. Requests starting a new
+	// session while it is full are not pinned. Zero means no cap.
+	MaxSessions int `mapstructure:"max_sessions"`
+}
+
+// EgressPoolConfig describes a named set of local addresses to bind
+// outbound connections to.
+type EgressPoolConfig struct {
+	Name      string   `mapstructure:"name"`
+	Addresses []string `mapstructure:"addresses"`
+	Strategy  string   `mapstructure:"strategy"` // fixed, round_robin, random, hash_client, hash_user
+}
+
+// AuthConfig holds proxy authentication configuration.
+type AuthConfig struct {
+	Enabled bool         `mapstructure:"enabled"`
+	Realm   string       `mapstructure:"realm"`
+	Users   []UserConfig `mapstructure:"users"`
+
+	// SessionMarker separates the username from a session ID, so that
+	// "alice-session-abc123" authenticates as "alice" with session "abc123".
+	SessionMarker string `mapstructure:"session_marker"`
+}
+
+// validate checks that users are usable.
+func (a *AuthConfig) validate(prefix string) error {
+	if a.Enabled && len(a.Users) == 0 {
+		return fmt.Errorf("%s.users cannot be empty when auth is enabled", prefix)
+	}
+	for i, u := range a.Users {
+		if u.Username == "" {
+			return fmt.Errorf("%s.users[%d].username cannot be empty", prefix, i)
+		}
+		if a.SessionMarker != "" && strings.Contains(u.Username, a.SessionMarker) {
+			return fmt.Errorf("%s.users[%d].username cannot contain the session marker", prefix, i)
+		}
+	}
+	return nil
+}
+
+// UserConfig holds the credentials of a single proxy user.
+type UserConfig struct {
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
 }
 
 // Load reads configuration from file and environment variables.
@@ -87,6 +307,7 @@ func Load(configPath string) (*Config, error) {
 	if err := v.Unmarshal(&cfg); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
 	}
+	cfg.File = v.ConfigFileUsed()
 
 	if err := cfg.Validate(); err != nil {
 		return nil, fmt.Errorf("invalid configuration: %w", err)
@@ -104,26 +325,80 @@ func setDefaults(v *viper.Viper) {
 	v.SetDefault("server.idle_timeout", "120s")
 	v.SetDefault("server.max_conns_per_ip", 10000)
 	v.SetDefault("server.max_requests_per_conn", 0)
+	v.SetDefault("server.tunnel_drain_timeout", "10s")
 
 	// Proxy defaults
 	v.SetDefault("proxy.dial_timeout", "10s")
 	v.SetDefault("proxy.response_timeout", "60s")
 	v.SetDefault("proxy.max_idle_conns", 1000)
+	v.SetDefault("proxy.max_conns", 0)
+	v.SetDefault("proxy.max_conns_per_host", 0)
+	v.SetDefault("proxy.idle_conn_timeout", "5m")
+	v.SetDefault("proxy.timeouts.tls_handshake", "10s")
+	v.SetDefault("proxy.timeouts.tunnel_idle", "5m")
+	v.SetDefault("proxy.tls.min_version", "1.2")
+	v.SetDefault("proxy.retry.max_attempts", 3)
+	v.SetDefault("proxy.retry.backoff", "50ms")
+	v.SetDefault("proxy.retry.max_backoff", "1s")
+	v.SetDefault("proxy.retry.retry_on", []string{"connect", "reset"})
+	v.SetDefault("proxy.circuit_breaker.enabled", false)
+	v.SetDefault("proxy.circuit_breaker.consecutive_failures", 5)
+	v.SetDefault("proxy.circuit_breaker.failure_rate", 0.5)
+	v.SetDefault("proxy.circuit_breaker.min_requests", 20)
+	v.SetDefault("proxy.circuit_breaker.window", "10s")
+	v.SetDefault("proxy.circuit_breaker.open_duration", "30s")
+	v.SetDefault("proxy.circuit_breaker.half_open_requests", 1)
+	v.SetDefault("proxy.concurrency.queue_timeout", "1s")
+	v.SetDefault("proxy.concurrency.retry_after", "1s")
+	v.SetDefault("proxy.concurrency.adaptive.target_latency", "1s")
+	v.SetDefault("proxy.concurrency.adaptive.min_requests", 1)
+	v.SetDefault("proxy.address_family", "prefer_ipv6")
+	v.SetDefault("proxy.happy_eyeballs_delay", "250ms")
 
 	// Logging defaults
 	v.SetDefault("logging.level", "info")
 	v.SetDefault("logging.format", "console")
 	v.SetDefault("logging.output", "stdout")
+	v.SetDefault("logging.access.enabled", false)
+	v.SetDefault("logging.access.format", "squid")
+	v.SetDefault("logging.access.output", "stdout")
+	for _, prefix := range []string{"logging.rotation", "logging.access.rotation"} {
+		v.SetDefault(prefix+".max_size", 0)
+		v.SetDefault(prefix+".interval", "0s")
+		v.SetDefault(prefix+".max_backups", 0)
+		v.SetDefault(prefix+".max_age", "0s")
+		v.SetDefault(prefix+".compress", false)
+	}
 
 	// Metrics defaults
 	v.SetDefault("metrics.enabled", true)
 	v.SetDefault("metrics.address", ":9090")
 	v.SetDefault("metrics.path", "/metrics")
+	v.SetDefault("metrics.upstreams_path", "/upstreams")
+	v.SetDefault("metrics.hosts_top_n", 20)
+
+	// Auth defaults
+	v.SetDefault("auth.enabled", false)
+	v.SetDefault("auth.realm", "proxy")
+	v.SetDefault("auth.session_marker", "-session-")
+
+	// Quota defaults
+	v.SetDefault("quotas.enabled", false)
+	v.SetDefault("quotas.flush_interval", "10s")
+	v.SetDefault("quotas.report_path", "/usage")
+
+	// Egress defaults
+	v.SetDefault("egress.session_ttl", "10m")
+	v.SetDefault("egress.max_sessions", 100000)
+
+	// DNS defaults
+	v.SetDefault("dns.timeout", "5s")
+	v.SetDefault("dns.cache_duration", "1h")
 }
 
 // Validate checks the configuration for errors.
 func (c *Config) Validate() error {
-	if c.Server.Address == "" {
+	if c.Server.Address == "" && len(c.Server.Listeners) == 0 {
 		return fmt.Errorf("server.address cannot be empty")
 	}
 	if c.Server.MaxConnsPerIP < 0 {
@@ -135,11 +410,259 @@ func (c *Config) Validate() error {
 	if c.Server.WriteTimeout < 0 {
 		return fmt.Errorf("server.write_timeout must be >= 0")
 	}
+	if c.Server.TunnelDrainTimeout < 0 {
+		return fmt.Errorf("server.tunnel_drain_timeout must be >= 0")
+	}
+	switch c.Logging.Level {
+	case "", "debug", "info", "warn", "warning", "error", "fatal":
+	default:
+		return fmt.Errorf("logging.level: unknown level %q", c.Logging.Level)
+	}
+	if err := c.Logging.Rotation.validate("logging.rotation"); err != nil {
+		return err
+	}
+	if err := c.Logging.Access.validate(); err != nil {
+		return err
+	}
 	if c.Proxy.DialTimeout <= 0 {
 		return fmt.Errorf("proxy.dial_timeout must be > 0")
 	}
+	if c.Proxy.MaxConns < 0 {
+		return fmt.Errorf("proxy.max_conns must be >= 0")
+	}
+	if c.Proxy.MaxConnsPerHost < 0 {
+		return fmt.Errorf("proxy.max_conns_per_host must be >= 0")
+	}
+	if c.Proxy.MaxConns > 0 && c.Proxy.MaxConnsPerHost > c.Proxy.MaxConns {
+		return fmt.Errorf("proxy.max_conns_per_host cannot exceed proxy.max_conns")
+	}
+	if c.Proxy.IdleConnTimeout < 0 {
+		return fmt.Errorf("proxy.idle_conn_timeout must be >= 0")
+	}
+	if c.Proxy.Retry.MaxAttempts < 0 {
+		return fmt.Errorf("proxy.retry.max_attempts must be >= 0")
+	}
+	if c.Proxy.Retry.Backoff < 0 || c.Proxy.Retry.MaxBackoff < 0 {
+		return fmt.Errorf("proxy.retry backoff durations must be >= 0")
+	}
+	for _, on := range c.Proxy.Retry.RetryOn {
+		switch on {
+		case "connect", "reset", "timeout":
+		default:
+			return fmt.Errorf("proxy.retry.retry_on: unknown condition %q (want connect, reset or timeout)", on)
+		}
+	}
+	for _, code := range c.Proxy.Retry.RetryStatuses {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("proxy.retry.retry_statuses: invalid status code %d", code)
+		}
+	}
+	if err := c.Proxy.CircuitBreaker.validate(); err != nil {
+		return err
+	}
+	if err := c.Proxy.RateLimits.validate(); err != nil {
+		return err
+	}
+	if err := c.Proxy.Bandwidth.validate(); err != nil {
+		return err
+	}
+	if err := c.Proxy.Concurrency.validate(); err != nil {
+		return err
+	}
+	if err := c.Quotas.validate(); err != nil {
+		return err
+	}
+	switch c.Proxy.AddressFamily {
+	case "", "prefer_ipv4", "prefer_ipv6", "ipv4_only", "ipv6_only":
+	default:
+		return fmt.Errorf("proxy.address_family must be prefer_ipv4, prefer_ipv6, ipv4_only or ipv6_only")
+	}
+	if c.Proxy.HappyEyeballsDelay < 0 {
+		return fmt.Errorf("proxy.happy_eyeballs_delay must be >= 0")
+	}
+	if err := c.Egress.validate(); err != nil {
+		return err
+	}
+	if err := c.Auth.validate("auth"); err != nil {
+		return err
+	}
+	if err := c.Server.validateListeners(&c.Auth); err != nil {
+		return err
+	}
+	if err := c.Proxy.Socket.validate("proxy.socket"); err != nil {
+		return err
+	}
+	if err := c.Proxy.TLS.validate("proxy.tls"); err != nil {
+		return err
+	}
+	if err := c.Proxy.Timeouts.validate("proxy.timeouts"); err != nil {
+		return err
+	}
+	for i, r := range c.Routes {
+		if len(r.Match) == 0 {
+			return fmt.Errorf("routes[%d].match cannot be empty", i)
+		}
+		for _, m := range r.Match {
+			if strings.Contains(m, "/") {
+				if _, _, err := net.ParseCIDR(m); err != nil {
+					return fmt.Errorf("routes[%d].match: invalid CIDR %q", i, m)
+				}
+			}
+		}
+		if r.Socket != nil {
+			if err := r.Socket.validate(fmt.Sprintf("routes[%d].socket", i)); err != nil {
+				return err
+			}
+		}
+		if r.Timeouts != nil {
+			if err := r.Timeouts.validate(fmt.Sprintf("routes[%d].timeouts", i)); err != nil {
+				return err
+			}
+		}
+		if r.EgressPool != "" && !c.Egress.hasPool(r.EgressPool) {
+			return fmt.Errorf("routes[%d].egress_pool %q is not a defined pool", i, r.EgressPool)
+		}
+		if r.SendProxyProtocol != nil && r.SendProxyProtocol.SNIWait < 0 {
+			return fmt.Errorf("routes[%d].send_proxy_protocol.sni_wait must be >= 0", i)
+		}
+		if r.TLS != nil {
+			merged := c.Proxy.TLS.Merge(r.TLS)
+			if err := merged.validate(fmt.Sprintf("routes[%d].tls", i)); err != nil {
+				return err
+			}
+		}
+	}
 	if c.Metrics.Enabled && c.Metrics.Address == "" {
 		return fmt.Errorf("metrics.address cannot be empty when metrics are enabled")
 	}
+	if c.Metrics.HostsTopN < 0 {
+		return fmt.Errorf("metrics.hosts_top_n must be >= 0")
+	}
+	if c.Metrics.UpstreamsPath != "" && c.Metrics.UpstreamsPath == c.Metrics.Path {
+		return fmt.Errorf("metrics.upstreams_path must differ from metrics.path")
+	}
+	for i, u := range c.DNS.Upstreams {
+		switch u.Type {
+		case "doh":
+			if !strings.HasPrefix(u.Address, "https://") && !strings.HasPrefix(u.Address, "http://") {
+				return fmt.Errorf("dns.upstreams[%d].address must be a URL for doh", i)
+			}
+			if u.Method != "" && u.Method != "GET" && u.Method != "POST" {
+				return fmt.Errorf("dns.upstreams[%d].method must be GET or POST", i)
+			}
+		case "dot":
+			if _, _, err := net.SplitHostPort(u.Address); err != nil {
+				return fmt.Errorf("dns.upstreams[%d].address must be host:port for dot", i)
+			}
+		case "system":
+		default:
+			return fmt.Errorf("dns.upstreams[%d].type must be doh, dot or system", i)
+		}
+		if u.Bootstrap != "" && net.ParseIP(u.Bootstrap) == nil {
+			return fmt.Errorf("dns.upstreams[%d].bootstrap must be an IP address", i)
+		}
+	}
+	return nil
+}
+
+// hasPool reports whether a pool is named name.
+func (e *EgressConfig) hasPool(name string) bool {
+	for _, p := range e.Pools {
+		if p.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks egress pool definitions.
+func (e *EgressConfig) validate() error {
+	names := make(map[string]bool, len(e.Pools))
+	for i, p := range e.Pools {
+		if p.Name == "" {
+			return fmt.Errorf("egress.pools[%d].name cannot be empty", i)
+		}
+		if names[p.Name] {
+			return fmt.Errorf("egress.pools[%d].name %q is duplicated", i, p.Name)
+		}
+		names[p.Name] = true
+		if len(p.Addresses) == 0 {
+			return fmt.Errorf("egress.pools[%d].addresses cannot be empty", i)
+		}
+		for _, addr := range p.Addresses {
+			if net.ParseIP(addr) == nil {
+				return fmt.Errorf("egress.pools[%d].addresses: %q is not an IP address", i, addr)
+			}
+		}
+		switch p.Strategy {
+		case "", "fixed", "round_robin", "random", "hash_client", "hash_user":
+		default:
+			return fmt.Errorf("egress.pools[%d].strategy must be fixed, round_robin, random, hash_client or hash_user", i)
+		}
+	}
+	if e.Default != "" && !names[e.Default] {
+		return fmt.Errorf("egress.default %q is not a defined pool", e.Default)
+	}
+	if e.SessionTTL < 0 {
+		return fmt.Errorf("egress.session_ttl must be >= 0")
+	}
+	if e.MaxSessions < 0 {
+		return fmt.Errorf("egress.max_sessions must be >= 0")
+	}
+	return nil
+}
+
+// validate checks circuit breaker thresholds.
+func (b *BreakerConfig) validate() error {
+	if !b.Enabled {
+		return nil
+	}
+	if b.ConsecutiveFailures < 0 {
+		return fmt.Errorf("proxy.circuit_breaker.consecutive_failures must be >= 0")
+	}
+	if b.FailureRate < 0 || b.FailureRate > 1 {
+		return fmt.Errorf("proxy.circuit_breaker.failure_rate must be between 0 and 1")
+	}
+	if b.ConsecutiveFailures == 0 && b.FailureRate == 0 {
+		return fmt.Errorf("proxy.circuit_breaker needs consecutive_failures or failure_rate")
+	}
+	if b.FailureRate > 0 && b.Window <= 0 {
+		return fmt.Errorf("proxy.circuit_breaker.window must be > 0")
+	}
+	if b.MinRequests < 0 {
+		return fmt.Errorf("proxy.circuit_breaker.min_requests must be >= 0")
+	}
+	if b.OpenDuration <= 0 {
+		return fmt.Errorf("proxy.circuit_breaker.open_duration must be > 0")
+	}
+	if b.HalfOpenRequests < 1 {
+		return fmt.Errorf("proxy.circuit_breaker.half_open_requests must be >= 1")
+	}
+	return nil
+}
+
+// validate checks socket option ranges and platform support.
+func (s *SocketConfig) validate(prefix string) error {
+	if s.IsZero() {
+		return nil
+	}
+	if runtime.GOOS != "linux" {
+		return fmt.Errorf("%s: socket options are only supported on Linux", prefix)
+	}
+	if s.DSCP < 0 || s.DSCP > 63 {
+		return fmt.Errorf("%s.dscp must be between 0 and 63", prefix)
+	}
+	if len(s.BindToDevice) >= 16 {
+		return fmt.Errorf("%s.bind_to_device %q is not a valid interface name", prefix, s.BindToDevice)
+	}
+	if s.KeepAliveIdle < 0 || (s.KeepAliveIdle > 0 && s.KeepAliveIdle < time.Second) {
+		return fmt.Errorf("%s.keepalive_idle must be 0 or at least 1s", prefix)
+	}
+	if s.KeepAliveInterval < 0 || (s.KeepAliveInterval > 0 && s.KeepAliveInterval < time.Second) {
+		return fmt.Errorf("%s.keepalive_interval must be 0 or at least 1s", prefix)
+	}
+	if s.KeepAliveCount < 0 || s.KeepAliveCount > 127 {
+		return fmt.Errorf("%s.keepalive_count must be between 0 and 127", prefix)
+	}
 	return nil
 }
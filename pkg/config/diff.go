@@ -0,0 +1,38 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+)
+
+// Diff returns the dotted keys of the settings that differ between a and
+// b, such as "proxy.timeouts" or "routes". Sections are compared one
+// level deep; a change anywhere inside a nested block or list reports
+// the block's key.
+func Diff(a, b *Config) []string {
+	var changed []string
+	diffStruct("", reflect.ValueOf(*a), reflect.ValueOf(*b), 2, &changed)
+	return changed
+}
+
+// diffStruct appends to changed the keys of the fields of a and b that
+// differ, descending into struct fields until depth runs out.
+func diffStruct(prefix string, a, b reflect.Value, depth int, changed *[]string) {
+	t := a.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key, _, _ := strings.Cut(t.Field(i).Tag.Get("mapstructure"), ",")
+		if key == "" || key == "-" {
+			continue
+		}
+		key = prefix + key
+
+		fa, fb := a.Field(i), b.Field(i)
+		if fa.Kind() == reflect.Struct && depth > 1 {
+			diffStruct(key+".", fa, fb, depth-1, changed)
+			continue
+		}
+		if !reflect.DeepEqual(fa.Interface(), fb.Interface()) {
+			*changed = append(*changed, key)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Listener protocols.
+const (
+	ProtocolHTTP        = "http"        // plain HTTP proxy requests and CONNECT
+	ProtocolHTTPS       = "https"       // the same, inside TLS terminated by the proxy
+	ProtocolSOCKS5      = "socks5"      // SOCKS5 CONNECT
+	ProtocolTransparent = "transparent" // connections redirected by the firewall (Linux)
+)
+
+// ListenerConfig describes one address the proxy accepts clients on.
+// Zero fields fall back to the server-wide settings.
+type ListenerConfig struct {
+	Name     string             `mapstructure:"name"`     // used in logs, defaults to the address
+	Address  string             `mapstructure:"address"`  // host:port, unix:/path or unix:@abstract
+	Protocol string             `mapstructure:"protocol"` // http (default), https, socks5 or transparent
+	TLS      *ListenerTLSConfig `mapstructure:"tls"`      // required for https
+
+	// Client connection timeouts, overriding server.*
+	ReadTimeout  time.Duration `mapstructure:"read_timeout"`
+	WriteTimeout time.Duration `mapstructure:"write_timeout"`
+	IdleTimeout  time.Duration `mapstructure:"idle_timeout"`
+
+	ACL      ACLConfig      `mapstructure:"acl"`      // client addresses allowed to connect
+	Auth     *AuthConfig    `mapstructure:"auth"`     // replaces the top-level auth block
+	Timeouts *TimeoutConfig `mapstructure:"timeouts"` // set fields override proxy.timeouts
+
+	// HAProxy PROXY protocol from load balancers in front of the listener
+	ProxyProtocol ProxyProtocolConfig `mapstructure:"proxy_protocol"`
+
+	// Socket file settings for unix:/path listeners
+	SocketMode  string `mapstructure:"socket_mode"`  // octal permissions, e.g. "0660"
+	SocketOwner string `mapstructure:"socket_owner"` // user name or uid
+	SocketGroup string `mapstructure:"socket_group"` // group name or gid
+}
+
+// ACLConfig restricts which client addresses a listener accepts. A
+// client is refused if it matches Deny, or if Allow is set and it
+// matches none of it.
+type ACLConfig struct {
+	Allow []string `mapstructure:"allow"` // CIDRs or IPs; empty allows all
+	Deny  []string `mapstructure:"deny"`  // CIDRs or IPs
+}
+
+// Enabled reports whether the ACL restricts anything.
+func (a *ACLConfig) Enabled() bool {
+	return len(a.Allow) > 0 || len(a.Deny) > 0
+}
+
+// Nets parses Allow and Deny. Single IPs become host-sized networks.
+func (a *ACLConfig) Nets() (allow, deny []*net.IPNet, err error) {
+	if allow, err = parseNets(a.Allow); err != nil {
+		return nil, nil, fmt.Errorf("allow: %w", err)
+	}
+	if deny, err = parseNets(a.Deny); err != nil {
+		return nil, nil, fmt.Errorf("deny: %w", err)
+	}
+	return allow, deny, nil
+}
+
+// defaultProxyHeaderTimeout applies when proxy_protocol.header_timeout
+// is not set.
+const defaultProxyHeaderTimeout = 5 * time.Second
+
+// ProxyProtocolConfig accepts PROXY protocol v1 and v2 headers, so that
+// the client address relayed by a load balancer is used instead of the
+// balancer's own.
+type ProxyProtocolConfig struct {
+	Enabled        bool          `mapstructure:"enabled"`
+	TrustedSources []string      `mapstructure:"trusted_sources"` // CIDRs or IPs that must send a header; required
+	HeaderTimeout  time.Duration `mapstructure:"header_timeout"`  // time allowed to send the header
+}
+
+// Trusted parses TrustedSources. Single IPs become host-sized networks.
+func (p *ProxyProtocolConfig) Trusted() ([]*net.IPNet, error) {
+	return parseNets(p.TrustedSources)
+}
+
+// parseNets parses CIDRs and IPs. Single IPs become host-sized networks.
+func parseNets(srcs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, src := range srcs {
+		if !strings.Contains(src, "/") {
+			ip := net.ParseIP(src)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", src)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(src)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", src)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// unixPrefix marks a unix domain socket listener address.
+const unixPrefix = "unix:"
+
+// Network returns the network and address to listen on: "unix" and the
+// socket path for unix: addresses, "tcp" and host:port otherwise.
+func (l ListenerConfig) Network() (network, address string) {
+	if path, ok := strings.CutPrefix(l.Address, unixPrefix); ok {
+		return "unix", path
+	}
+	return "tcp", l.Address
+}
+
+// ListenerTLSConfig holds the certificate an https listener presents to
+// clients.
+type ListenerTLSConfig struct {
+	CertFile     string `mapstructure:"cert_file"`      // server certificate (PEM)
+	KeyFile      string `mapstructure:"key_file"`       // server private key (PEM)
+	ClientCAFile string `mapstructure:"client_ca_file"` // require client certificates signed by these CAs
+	MinVersion   string `mapstructure:"min_version"`    // 1.0, 1.1, 1.2 or 1.3
+}
+
+// Build loads the referenced files and returns the resulting tls.Config.
+func (t *ListenerTLSConfig) Build() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load certificate: %w", err)
+	}
+	c := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tlsVersions[t.MinVersion],
+	}
+	if t.ClientCAFile != "" {
+		pem, err := os.ReadFile(t.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read client_ca_file: %w", err)
+		}
+		c.ClientCAs = x509.NewCertPool()
+		if !c.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("client_ca_file %s contains no PEM certificates", t.ClientCAFile)
+		}
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return c, nil
+}
+
+// Listeners returns the listeners to open: server.listeners, or a single
+// plain HTTP listener on server.address. Names and protocols are filled
+// in, and a listener auth block without a realm takes auth.realm.
+func (c *Config) Listeners() []ListenerConfig {
+	if len(c.Server.Listeners) == 0 {
+		return []ListenerConfig{{Name: c.Server.Address, Address: c.Server.Address, Protocol: ProtocolHTTP}}
+	}
+
+	listeners := make([]ListenerConfig, len(c.Server.Listeners))
+	for i, l := range c.Server.Listeners {
+		if l.Name == "" {
+			l.Name = l.Address
+		}
+		if l.Protocol == "" {
+			l.Protocol = ProtocolHTTP
+		}
+		if l.ProxyProtocol.Enabled && l.ProxyProtocol.HeaderTimeout == 0 {
+			l.ProxyProtocol.HeaderTimeout = defaultProxyHeaderTimeout
+		}
+		if l.Auth != nil && l.Auth.Realm == "" {
+			a := *l.Auth
+			a.Realm = c.Auth.Realm
+			l.Auth = &a
+		}
+		listeners[i] = l
+	}
+	return listeners
+}
+
+// validateListeners checks server.listeners. auth is the top-level auth
+// block, which listeners without their own use.
+func (s *ServerConfig) validateListeners(auth *AuthConfig) error {
+	addrs := make(map[string]bool, len(s.Listeners))
+	for i, l := range s.Listeners {
+		prefix := fmt.Sprintf("server.listeners[%d]", i)
+		if l.Address == "" {
+			return fmt.Errorf("%s.address cannot be empty", prefix)
+		}
+		if addrs[l.Address] {
+			return fmt.Errorf("%s.address %s is used by another listener", prefix, l.Address)
+		}
+		addrs[l.Address] = true
+
+		switch l.Protocol {
+		case "", ProtocolHTTP:
+		case ProtocolHTTPS:
+			if l.TLS == nil || l.TLS.CertFile == "" || l.TLS.KeyFile == "" {
+				return fmt.Errorf("%s: https requires tls.cert_file and tls.key_file", prefix)
+			}
+		case ProtocolSOCKS5:
+		case ProtocolTransparent:
+			if runtime.GOOS != "linux" {
+				return fmt.Errorf("%s: transparent listeners are only supported on Linux", prefix)
+			}
+			if network, _ := l.Network(); network != "tcp" {
+				return fmt.Errorf("%s: transparent listeners need a TCP address", prefix)
+			}
+			if l.ProxyProtocol.Enabled {
+				return fmt.Errorf("%s: transparent listeners cannot accept PROXY protocol", prefix)
+			}
+			if (l.Auth == nil && auth.Enabled) || (l.Auth != nil && l.Auth.Enabled) {
+				return fmt.Errorf("%s: transparent clients cannot authenticate; give the listener an auth block with enabled: false", prefix)
+			}
+		default:
+			return fmt.Errorf("%s.protocol: unknown protocol %q (want http, https, socks5 or transparent)", prefix, l.Protocol)
+		}
+		if l.TLS != nil {
+			if _, ok := tlsVersions[l.TLS.MinVersion]; l.TLS.MinVersion != "" && !ok {
+				return fmt.Errorf("%s.tls: unknown TLS version %q (want 1.0, 1.1, 1.2 or 1.3)", prefix, l.TLS.MinVersion)
+			}
+			if _, err := l.TLS.Build(); err != nil {
+				return fmt.Errorf("%s.tls: %w", prefix, err)
+			}
+		}
+
+		if err := l.validateSocket(prefix); err != nil {
+			return err
+		}
+		if _, err := l.ProxyProtocol.Trusted(); err != nil {
+			return fmt.Errorf("%s.proxy_protocol.trusted_sources: %w", prefix, err)
+		}
+		if l.ProxyProtocol.Enabled && len(l.ProxyProtocol.TrustedSources) == 0 {
+			// Anyone could claim any client address otherwise.
+			return fmt.Errorf("%s.proxy_protocol.trusted_sources must list the load balancers when enabled", prefix)
+		}
+		if l.ProxyProtocol.HeaderTimeout < 0 {
+			return fmt.Errorf("%s.proxy_protocol.header_timeout must be >= 0", prefix)
+		}
+		if _, _, err := l.ACL.Nets(); err != nil {
+			return fmt.Errorf("%s.acl.%w", prefix, err)
+		}
+		if network, _ := l.Network(); network == "unix" && l.ACL.Enabled() && !l.ProxyProtocol.Enabled {
+			// Unix socket clients have no address to check.
+			return fmt.Errorf("%s.acl needs client addresses, which unix sockets only get from proxy_protocol; use socket_mode instead", prefix)
+		}
+		if l.ReadTimeout < 0 || l.WriteTimeout < 0 || l.IdleTimeout < 0 {
+			return fmt.Errorf("%s timeouts must be >= 0", prefix)
+		}
+		if l.Auth != nil {
+			if err := l.Auth.validate(prefix + ".auth"); err != nil {
+				return err
+			}
+		}
+		if l.Timeouts != nil {
+			if err := l.Timeouts.validate(prefix + ".timeouts"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validateSocket checks unix socket addresses and file settings.
+func (l *ListenerConfig) validateSocket(prefix string) error {
+	network, path := l.Network()
+	fileSettings := l.SocketMode != "" || l.SocketOwner != "" || l.SocketGroup != ""
+	if network != "unix" {
+		if fileSettings {
+			return fmt.Errorf("%s: socket_mode, socket_owner and socket_group apply to unix: addresses only", prefix)
+		}
+		return nil
+	}
+
+	switch {
+	case path == "" || path == "@":
+		return fmt.Errorf("%s.address: unix socket path cannot be empty", prefix)
+	case strings.HasPrefix(path, "@"):
+		if runtime.GOOS != "linux" {
+			return fmt.Errorf("%s.address: abstract unix sockets are only supported on Linux", prefix)
+		}
+		if fileSettings {
+			return fmt.Errorf("%s: abstract unix sockets have no file for socket_mode, socket_owner or socket_group", prefix)
+		}
+	}
+	if l.SocketMode != "" {
+		if m, err := strconv.ParseUint(l.SocketMode, 8, 32); err != nil || m > 0o777 {
+			return fmt.Errorf("%s.socket_mode: invalid mode %q (want octal permissions such as 0660)", prefix, l.SocketMode)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// QuotaConfig holds per-user traffic quotas. Usage is kept in an
+// append-only log so that it survives restarts. Days and months are
+// counted in UTC.
+type QuotaConfig struct {
+	Enabled       bool          `mapstructure:"enabled"`
+	File          string        `mapstructure:"file"`           // usage log
+	FlushInterval time.Duration `mapstructure:"flush_interval"` // how often usage is written to file
+	ReportPath    string        `mapstructure:"report_path"`    // usage report on the metrics server, empty to disable
+
+	// Limits for every authenticated user, unless a group lists them
+	Daily   QuotaLimit `mapstructure:"daily"`
+	Monthly QuotaLimit `mapstructure:"monthly"`
+
+	Groups []QuotaGroupConfig `mapstructure:"groups"`
+}
+
+// QuotaGroupConfig replaces the default limits for its users. A user in
+// several groups gets the first.
+type QuotaGroupConfig struct {
+	Name    string     `mapstructure:"name"`
+	Users   []string   `mapstructure:"users"`
+	Daily   QuotaLimit `mapstructure:"daily"`
+	Monthly QuotaLimit `mapstructure:"monthly"`
+}
+
+// QuotaLimit caps usage in a period; 0 = unlimited.
+type QuotaLimit struct {
+	Bytes    int64 `mapstructure:"bytes"`    // upload and download together
+	Requests int64 `mapstructure:"requests"` // HTTP requests and CONNECT tunnels
+}
+
+// Limits returns the daily and monthly limits of user.
+func (q *QuotaConfig) Limits(user string) (daily, monthly QuotaLimit) {
+	for _, g := range q.Groups {
+		for _, u := range g.Users {
+			if u == user {
+				return g.Daily, g.Monthly
+			}
+		}
+	}
+	return q.Daily, q.Monthly
+}
+
+// validate checks the store settings and limits.
+func (q *QuotaConfig) validate() error {
+	if !q.Enabled {
+		return nil
+	}
+	if q.File == "" {
+		return fmt.Errorf("quotas.file cannot be empty when quotas are enabled")
+	}
+	if q.FlushInterval <= 0 {
+		return fmt.Errorf("quotas.flush_interval must be > 0")
+	}
+	limits := map[string]QuotaLimit{"quotas.daily": q.Daily, "quotas.monthly": q.Monthly}
+	for i, g := range q.Groups {
+		if len(g.Users) == 0 {
+			return fmt.Errorf("quotas.groups[%d].users cannot be empty", i)
+		}
+		limits[fmt.Sprintf("quotas.groups[%d].daily", i)] = g.Daily
+		limits[fmt.Sprintf("quotas.groups[%d].monthly", i)] = g.Monthly
+	}
+	for prefix, l := range limits {
+		if l.Bytes < 0 || l.Requests < 0 {
+			return fmt.Errorf("%s limits must be >= 0", prefix)
+		}
+	}
+	return nil
+}
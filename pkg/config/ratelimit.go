@@ -0,0 +1,66 @@
+package config
+
+import (
+	"fmt"
+	"net"
+)
+
+// Rate limit keys: what a rule keeps a separate token bucket for.
+const (
+	RateLimitKeyClientIP    = "client_ip"
+	RateLimitKeyUser        = "user"
+	RateLimitKeyDestination = "destination"
+)
+
+// RateLimitConfig holds token-bucket limits on how fast requests and
+// CONNECT tunnels may start.
+type RateLimitConfig struct {
+	Rules []RateLimitRule `mapstructure:"rules"`
+}
+
+// RateLimitRule limits requests of one identity group. Each distinct
+// value of Key gets its own bucket. For each key, only the first rule
+// whose group matches a request applies, so specific groups go before
+// catch-all rules.
+type RateLimitRule struct {
+	Name string `mapstructure:"name"` // label in metrics and logs, defaults to the key
+	Key  string `mapstructure:"key"`  // client_ip, user or destination
+
+	// Identity group; empty lists match everyone
+	Users   []string `mapstructure:"users"`   // authenticated usernames
+	Clients []string `mapstructure:"clients"` // client CIDRs or IPs
+
+	RequestsPerSecond float64 `mapstructure:"requests_per_second"` // plain HTTP requests, 0 = unlimited
+	TunnelsPerSecond  float64 `mapstructure:"tunnels_per_second"`  // new CONNECT tunnels, 0 = unlimited
+	Burst             int     `mapstructure:"burst"`               // bucket size, 0 = one second's worth
+}
+
+// ClientNets parses Clients. Single IPs become host-sized networks.
+func (r *RateLimitRule) ClientNets() ([]*net.IPNet, error) {
+	return parseNets(r.Clients)
+}
+
+// validate checks the rules.
+func (c *RateLimitConfig) validate() error {
+	for i, r := range c.Rules {
+		prefix := fmt.Sprintf("proxy.rate_limits.rules[%d]", i)
+		switch r.Key {
+		case RateLimitKeyClientIP, RateLimitKeyUser, RateLimitKeyDestination:
+		default:
+			return fmt.Errorf("%s.key: unknown key %q (want client_ip, user or destination)", prefix, r.Key)
+		}
+		if r.RequestsPerSecond < 0 || r.TunnelsPerSecond < 0 {
+			return fmt.Errorf("%s rates must be >= 0", prefix)
+		}
+		if r.RequestsPerSecond == 0 && r.TunnelsPerSecond == 0 {
+			return fmt.Errorf("%s needs requests_per_second or tunnels_per_second", prefix)
+		}
+		if r.Burst < 0 {
+			return fmt.Errorf("%s.burst must be >= 0", prefix)
+		}
+		if _, err := r.ClientNets(); err != nil {
+			return fmt.Errorf("%s.clients: %w", prefix, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// TimeoutConfig holds upstream and tunnel timeouts beyond
+// proxy.dial_timeout and proxy.response_timeout. Zero disables a timeout.
+type TimeoutConfig struct {
+	TLSHandshake   time.Duration `mapstructure:"tls_handshake"`   // upstream TLS handshake for https:// requests
+	FirstByte      time.Duration `mapstructure:"first_byte"`      // from request sent to first response byte
+	ReadIdle       time.Duration `mapstructure:"read_idle"`       // longest pause while reading a response
+	Request        time.Duration `mapstructure:"request"`         // whole request including retries and backoff
+	TunnelIdle     time.Duration `mapstructure:"tunnel_idle"`     // CONNECT tunnel with no traffic either way
+	TunnelLifetime time.Duration `mapstructure:"tunnel_lifetime"` // CONNECT tunnel age
+}
+
+// Merge returns t with the non-zero fields of o applied on top. A nil o
+// returns t unchanged.
+func (t TimeoutConfig) Merge(o *TimeoutConfig) TimeoutConfig {
+	if o == nil {
+		return t
+	}
+	for _, f := range []struct{ dst, src *time.Duration }{
+		{&t.TLSHandshake, &o.TLSHandshake},
+		{&t.FirstByte, &o.FirstByte},
+		{&t.ReadIdle, &o.ReadIdle},
+		{&t.Request, &o.Request},
+		{&t.TunnelIdle, &o.TunnelIdle},
+		{&t.TunnelLifetime, &o.TunnelLifetime},
+	} {
+		if *f.src != 0 {
+			*f.dst = *f.src
+		}
+	}
+	return t
+}
+
+// validate checks that no timeout is negative.
+func (t *TimeoutConfig) validate(prefix string) error {
+	for _, f := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"tls_handshake", t.TLSHandshake},
+		{"first_byte", t.FirstByte},
+		{"read_idle", t.ReadIdle},
+		{"request", t.Request},
+		{"tunnel_idle", t.TunnelIdle},
+		{"tunnel_lifetime", t.TunnelLifetime},
+	} {
+		if f.d < 0 {
+			return fmt.Errorf("%s.%s must be >= 0", prefix, f.name)
+		}
+	}
+	return nil
+}
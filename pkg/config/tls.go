@@ -0,0 +1,105 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// TLSConfig holds settings for TLS connections the proxy makes to
+// upstream servers for https:// requests. CONNECT tunnels are opaque and
+// unaffected.
+type TLSConfig struct {
+	CAFile             string `mapstructure:"ca_file"`              // PEM bundle replacing the system roots
+	CertFile           string `mapstructure:"cert_file"`            // client certificate (PEM)
+	KeyFile            string `mapstructure:"key_file"`             // client private key (PEM)
+	MinVersion         string `mapstructure:"min_version"`          // 1.0, 1.1, 1.2 or 1.3
+	MaxVersion         string `mapstructure:"max_version"`          // empty = highest supported
+	InsecureSkipVerify bool   `mapstructure:"insecure_skip_verify"` // do not verify the server certificate
+	ServerName         string `mapstructure:"server_name"`          // SNI and verification name override
+}
+
+// tlsVersions maps configured version strings to crypto/tls constants.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Merge returns t with the non-empty fields of o applied on top. A nil o
+// returns t unchanged.
+func (t TLSConfig) Merge(o *TLSConfig) TLSConfig {
+	if o == nil {
+		return t
+	}
+	if o.CAFile != "" {
+		t.CAFile = o.CAFile
+	}
+	if o.CertFile != "" {
+		t.CertFile, t.KeyFile = o.CertFile, o.KeyFile
+	}
+	if o.MinVersion != "" {
+		t.MinVersion = o.MinVersion
+	}
+	if o.MaxVersion != "" {
+		t.MaxVersion = o.MaxVersion
+	}
+	if o.InsecureSkipVerify {
+		t.InsecureSkipVerify = true
+	}
+	if o.ServerName != "" {
+		t.ServerName = o.ServerName
+	}
+	return t
+}
+
+// Build loads the referenced files and returns the resulting tls.Config.
+// ServerName is left empty unless overridden, so the client can fill in
+// the destination host.
+func (t TLSConfig) Build() (*tls.Config, error) {
+	c := &tls.Config{
+		InsecureSkipVerify: t.InsecureSkipVerify,
+		ServerName:         t.ServerName,
+		MinVersion:         tlsVersions[t.MinVersion],
+		MaxVersion:         tlsVersions[t.MaxVersion],
+	}
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read ca_file: %w", err)
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ca_file %s contains no PEM certificates", t.CAFile)
+		}
+	}
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
+
+// validate checks versions and that the referenced files load.
+func (t *TLSConfig) validate(prefix string) error {
+	for _, v := range []string{t.MinVersion, t.MaxVersion} {
+		if _, ok := tlsVersions[v]; v != "" && !ok {
+			return fmt.Errorf("%s: unknown TLS version %q (want 1.0, 1.1, 1.2 or 1.3)", prefix, v)
+		}
+	}
+	if t.MinVersion != "" && t.MaxVersion != "" && tlsVersions[t.MinVersion] > tlsVersions[t.MaxVersion] {
+		return fmt.Errorf("%s.min_version cannot exceed max_version", prefix)
+	}
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return fmt.Errorf("%s: cert_file and key_file must be set together", prefix)
+	}
+	if _, err := t.Build(); err != nil {
+		return fmt.Errorf("%s: %w", prefix, err)
+	}
+	return nil
+}
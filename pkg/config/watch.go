@@ -0,0 +1,82 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDebounce groups the several events an editor or deployment tool
+// produces for a single save into one notification.
+const watchDebounce = 250 * time.Millisecond
+
+// Watcher reports changes to a configuration file.
+type Watcher struct {
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+}
+
+// Watch calls onChange, from its own goroutine, after path has been
+// written, replaced or re-linked. The directory is watched rather than
+// the file so that editors that save by renaming, and symlink swaps such
+// as Kubernetes ConfigMap updates, are noticed. Close stops watching.
+func Watch(path string, onChange func()) (*Watcher, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("watch %s: %w", path, err)
+	}
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("watch %s: %w", path, err)
+	}
+	if err := fw.Add(filepath.Dir(path)); err != nil {
+		fw.Close()
+		return nil, fmt.Errorf("watch %s: %w", path, err)
+	}
+
+	w := &Watcher{watcher: fw, done: make(chan struct{})}
+	go w.run(path, onChange)
+	return w, nil
+}
+
+// Close stops watching and waits for the watch goroutine to exit.
+func (w *Watcher) Close() error {
+	err := w.watcher.Close()
+	<-w.done
+	return err
+}
+
+// run filters directory events down to those affecting path and calls
+// onChange once they settle.
+func (w *Watcher) run(path string, onChange func()) {
+	defer close(w.done)
+
+	target, _ := filepath.EvalSymlinks(path)
+	var pending <-chan time.Time
+	for {
+		select {
+		case ev, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			// Any event in the directory may have re-pointed a symlink.
+			current, _ := filepath.EvalSymlinks(path)
+			if filepath.Clean(ev.Name) != path && current == target {
+				continue
+			}
+			target = current
+			if ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Remove) != 0 {
+				pending = time.After(watchDebounce)
+			}
+		case _, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+		case <-pending:
+			pending = nil
+			onChange()
+		}
+	}
+}
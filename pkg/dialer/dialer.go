@@ -0,0 +1,104 @@
+// Package dialer provides the shared outbound dial path used for both
+// pooled HTTP requests and CONNECT tunnels.
+package dialer
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/config"
+	"github.com/yigitkonur/proxy-http-forward/pkg/metrics"
+	"github.com/yigitkonur/proxy-http-forward/pkg/resolver"
+	"github.com/yigitkonur/proxy-http-forward/pkg/route"
+)
+
+// Address family preferences.
+const (
+	PreferIPv4 = "prefer_ipv4"
+	PreferIPv6 = "prefer_ipv6"
+	IPv4Only   = "ipv4_only"
+	IPv6Only   = "ipv6_only"
+)
+
+// Dialer establishes upstream TCP connections, resolving hostnames
+// through the configured resolver rather than the system one and racing
+// address families as described in RFC 8305.
+type Dialer struct {
+	resolver *resolver.Resolver
+	routes   *route.Table
+	metrics  *metrics.Metrics
+	timeout  time.Duration
+	socket   config.SocketConfig
+
+	families     []string // resolver networks, preferred first
+	attemptDelay time.Duration
+}
+
+// New creates a Dialer with the given proxy configuration and resolver.
+// Routes in rt override the global socket options per destination.
+func New(cfg config.ProxyConfig, rt *route.Table, r *resolver.Resolver, m *metrics.Metrics) *Dialer {
+	d := &Dialer{
+		resolver:     r,
+		routes:       rt,
+		metrics:      m,
+		timeout:      cfg.DialTimeout,
+		socket:       cfg.Socket,
+		attemptDelay: cfg.HappyEyeballsDelay,
+	}
+
+	switch cfg.AddressFamily {
+	case PreferIPv4:
+		d.families = []string{"ip4", "ip6"}
+	case IPv4Only:
+		d.families = []string{"ip4"}
+	case IPv6Only:
+		d.families = []string{"ip6"}
+	default:
+		d.families = []string{"ip6", "ip4"}
+	}
+	if d.attemptDelay <= 0 {
+		d.attemptDelay = defaultAttemptDelay
+	}
+
+	return d
+}
+
+// Dial connects to addr using the configured dial timeout.
+// It matches fasthttp.DialFunc.
+func (d *Dialer) Dial(addr string) (net.Conn, error) {
+	return d.DialTimeout(addr, d.timeout)
+}
+
+// DialTimeout connects to addr, giving up after timeout.
+// It matches fasthttp.DialFuncWithTimeout.
+func (d *Dialer) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+// DialContext resolves the host in addr and races connection attempts
+// across its addresses until one connects or ctx expires.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d.DialFrom(ctx, network, addr, Source{})
+}
+
+// DialFrom is like DialContext but binds the connection to the local
+// address in src matching the destination's family. Destinations of a
+// family src has no address for are skipped.
+func (d *Dialer) DialFrom(ctx context.Context, network, addr string, src Source) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.dialParallel(ctx, network, host, port, src)
+}
+
+// DialTimeoutFrom is like DialTimeout but binds to src.
+func (d *Dialer) DialTimeoutFrom(addr string, timeout time.Duration, src Source) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return d.DialFrom(ctx, "tcp", addr, src)
+}
@@ -0,0 +1,180 @@
+package dialer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// RFC 8305 recommended delays.
+const (
+	// resolutionDelay is how long to wait for the preferred family's
+	// answer once the other family has resolved.
+	resolutionDelay = 50 * time.Millisecond
+
+	// defaultAttemptDelay is the pause between staggered connection attempts.
+	defaultAttemptDelay = 250 * time.Millisecond
+)
+
+// lookupResult carries the answer for one address family.
+type lookupResult struct {
+	preferred bool
+	ips       []net.IP
+	err       error
+}
+
+// dialResult carries the outcome of one connection attempt.
+type dialResult struct {
+	conn net.Conn
+	ip   net.IP
+	err  error
+}
+
+// dialParallel implements Happy Eyeballs v2: both families are resolved
+// concurrently, addresses are interleaved starting with the preferred
+// family, and connection attempts are started attemptDelay apart (or
+// immediately when the previous attempt fails). The first connection to
+// succeed wins and all others are abandoned. Addresses src cannot be
+// bound for are dropped.
+func (d *Dialer) dialParallel(ctx context.Context, network, host, port string, src Source) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	lookups := make(chan lookupResult, len(d.families))
+	for i, family := range d.families {
+		go func(family string, preferred bool) {
+			ips, err := d.resolver.LookupIP(ctx, family, host)
+			var usable []net.IP
+			for _, ip := range ips {
+				if _, ok := src.localFor(ip); ok {
+					usable = append(usable, ip)
+				}
+			}
+			if err == nil && len(usable) == 0 {
+				err = fmt.Errorf("no %s egress address for %s", family, host)
+			}
+			lookups <- lookupResult{preferred: preferred, ips: usable, err: err}
+		}(family, i == 0)
+	}
+	pendingLookups := len(d.families)
+
+	var primary, secondary []net.IP
+	primaryTurn := true
+	next := func() net.IP {
+		var ip net.IP
+		switch {
+		case primaryTurn && len(primary) > 0, len(secondary) == 0 && len(primary) > 0:
+			ip, primary = primary[0], primary[1:]
+			primaryTurn = false
+		case len(secondary) > 0:
+			ip, secondary = secondary[0], secondary[1:]
+			primaryTurn = true
+		}
+		return ip
+	}
+
+	opts := d.socketOptions(host)
+	results := make(chan dialResult)
+	inFlight := 0
+	started := false
+	var resolutionTimer, attemptTimer <-chan time.Time
+	var lookupErr, dialErr error
+
+	startAttempt := func() {
+		ip := next()
+		if ip == nil {
+			return
+		}
+		started = true
+		inFlight++
+		attemptTimer = time.After(d.attemptDelay)
+		go func() {
+			local, _ := src.localFor(ip)
+			conn, err := netDialer(opts, local).DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+			select {
+			case results <- dialResult{conn: conn, ip: ip, err: err}:
+			case <-ctx.Done():
+				if conn != nil {
+					conn.Close()
+				}
+			}
+		}()
+	}
+
+	for {
+		select {
+		case res := <-lookups:
+			pendingLookups--
+			if res.err != nil && lookupErr == nil {
+				lookupErr = res.err
+			}
+			if res.preferred {
+				primary = append(primary, res.ips...)
+			} else {
+				secondary = append(secondary, res.ips...)
+			}
+
+			switch {
+			case started:
+				// Late answers join the queue; dial now if nothing is in
+				// flight or the attempt delay already ran out with no
+				// address to try.
+				if inFlight == 0 || attemptTimer == nil {
+					startAttempt()
+				}
+			case res.preferred || pendingLookups == 0:
+				startAttempt()
+			case len(res.ips) > 0 && resolutionTimer == nil:
+				resolutionTimer = time.After(resolutionDelay)
+			}
+
+		case <-resolutionTimer:
+			resolutionTimer = nil
+			if !started {
+				startAttempt()
+			}
+
+		case <-attemptTimer:
+			attemptTimer = nil
+			startAttempt()
+
+		case res := <-results:
+			inFlight--
+			if res.err == nil {
+				applyNoDelay(res.conn, opts)
+				d.recordFamily(res.ip)
+				return res.conn, nil
+			}
+			if dialErr == nil {
+				dialErr = res.err
+			}
+			startAttempt()
+
+		case <-ctx.Done():
+			return nil, &net.OpError{Op: "dial", Net: network, Err: ctx.Err()}
+		}
+
+		if pendingLookups == 0 && inFlight == 0 && len(primary) == 0 && len(secondary) == 0 {
+			// Prefer reporting why a connection failed over why one
+			// family had no addresses.
+			if dialErr != nil {
+				return nil, dialErr
+			}
+			if lookupErr == nil {
+				lookupErr = errors.New("no addresses to dial")
+			}
+			return nil, &net.OpError{Op: "dial", Net: network, Err: lookupErr}
+		}
+	}
+}
+
+// recordFamily records which address family won the race.
+func (d *Dialer) recordFamily(ip net.IP) {
+	if ip.To4() != nil {
+		d.metrics.RecordDialFamily("ipv4")
+	} else {
+		d.metrics.RecordDialFamily("ipv6")
+	}
+}
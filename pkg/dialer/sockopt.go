@@ -0,0 +1,42 @@
+package dialer
+
+import (
+	"net"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/config"
+)
+
+// socketOptions returns the socket options for connections to host: the
+// matching route's, if it sets any, otherwise the global ones.
+func (d *Dialer) socketOptions(host string) config.SocketConfig {
+	if r := d.routes.Match(host); r != nil && r.Socket != nil {
+		return *r.Socket
+	}
+	return d.socket
+}
+
+// netDialer builds a net.Dialer bound to local that applies opts to
+// each new socket before it connects.
+func netDialer(opts config.SocketConfig, local net.Addr) *net.Dialer {
+	nd := &net.Dialer{LocalAddr: local}
+	if opts.IsZero() {
+		return nd
+	}
+	nd.Control = control(opts)
+	if opts.KeepAliveIdle > 0 || opts.KeepAliveInterval > 0 || opts.KeepAliveCount > 0 {
+		// Keep-alive is configured by control; stop Go overriding it.
+		nd.KeepAlive = -1
+	}
+	return nd
+}
+
+// applyNoDelay sets TCP_NODELAY after connecting, since Go enables it on
+// every new connection regardless of what control set.
+func applyNoDelay(conn net.Conn, opts config.SocketConfig) {
+	if opts.NoDelay == nil {
+		return
+	}
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetNoDelay(*opts.NoDelay)
+	}
+}
@@ -0,0 +1,82 @@
+//go:build linux
+
+package dialer
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/config"
+)
+
+// control returns a Control hook that sets opts on the raw socket.
+func control(opts config.SocketConfig) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = setSocketOptions(int(fd), network, opts)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
+
+// setSocketOptions applies each configured option to fd.
+func setSocketOptions(fd int, network string, opts config.SocketConfig) error {
+	if opts.Mark != 0 {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_MARK, int(opts.Mark)); err != nil {
+			return wrapSockopt("SO_MARK", err)
+		}
+	}
+	if opts.BindToDevice != "" {
+		if err := unix.BindToDevice(fd, opts.BindToDevice); err != nil {
+			return wrapSockopt("SO_BINDTODEVICE", err)
+		}
+	}
+	if opts.DSCP != 0 {
+		tos := opts.DSCP << 2
+		if strings.HasSuffix(network, "6") {
+			if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_TCLASS, tos); err != nil {
+				return wrapSockopt("IPV6_TCLASS", err)
+			}
+		} else if err := unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_TOS, tos); err != nil {
+			return wrapSockopt("IP_TOS", err)
+		}
+	}
+	if opts.KeepAliveIdle > 0 || opts.KeepAliveInterval > 0 || opts.KeepAliveCount > 0 {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_KEEPALIVE, 1); err != nil {
+			return wrapSockopt("SO_KEEPALIVE", err)
+		}
+	}
+	if opts.KeepAliveIdle > 0 {
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPIDLE, int(opts.KeepAliveIdle.Seconds())); err != nil {
+			return wrapSockopt("TCP_KEEPIDLE", err)
+		}
+	}
+	if opts.KeepAliveInterval > 0 {
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, int(opts.KeepAliveInterval.Seconds())); err != nil {
+			return wrapSockopt("TCP_KEEPINTVL", err)
+		}
+	}
+	if opts.KeepAliveCount > 0 {
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPCNT, opts.KeepAliveCount); err != nil {
+			return wrapSockopt("TCP_KEEPCNT", err)
+		}
+	}
+	if opts.FastOpen {
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT, 1); err != nil {
+			return wrapSockopt("TCP_FASTOPEN_CONNECT", err)
+		}
+	}
+	return nil
+}
+
+// wrapSockopt names the option that failed.
+func wrapSockopt(name string, err error) error {
+	return fmt.Errorf("setsockopt %s: %w", name, err)
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package dialer
+
+import (
+	"errors"
+	"syscall"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/config"
+)
+
+// control rejects every dial: socket options are Linux-only, and
+// config.Validate refuses them elsewhere.
+func control(opts config.SocketConfig) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return errors.New("socket options are only supported on Linux")
+	}
+}
@@ -0,0 +1,46 @@
+package dialer
+
+import (
+	"net"
+	"strings"
+)
+
+// Source selects the local addresses outbound connections are bound to.
+// A zero Source leaves the choice to the operating system.
+type Source struct {
+	IPv4 net.IP
+	IPv6 net.IP
+}
+
+// IsZero reports whether src binds to no specific address.
+func (src Source) IsZero() bool {
+	return src.IPv4 == nil && src.IPv6 == nil
+}
+
+// localFor returns the local address to bind when dialing ip, and
+// whether ip may be dialed at all from this source.
+func (src Source) localFor(ip net.IP) (net.Addr, bool) {
+	if src.IsZero() {
+		return nil, true
+	}
+	local := src.IPv6
+	if ip.To4() != nil {
+		local = src.IPv4
+	}
+	if local == nil {
+		return nil, false
+	}
+	return &net.TCPAddr{IP: local}, true
+}
+
+// String returns the bound addresses, comma separated.
+func (src Source) String() string {
+	var parts []string
+	if src.IPv4 != nil {
+		parts = append(parts, src.IPv4.String())
+	}
+	if src.IPv6 != nil {
+		parts = append(parts, src.IPv6.String())
+	}
+	return strings.Join(parts, ",")
+}
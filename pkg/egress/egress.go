@@ -0,0 +1,152 @@
+// Package egress selects the local source addresses outbound
+// connections are bound to.
+package egress
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"sync/atomic"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/auth"
+	"github.com/yigitkonur/proxy-http-forward/pkg/config"
+	"github.com/yigitkonur/proxy-http-forward/pkg/dialer"
+	"github.com/yigitkonur/proxy-http-forward/pkg/metrics"
+)
+
+// Selection strategies.
+const (
+	Fixed      = "fixed"
+	RoundRobin = "round_robin"
+	Random     = "random"
+	HashClient = "hash_client"
+	HashUser   = "hash_user"
+)
+
+// Pool is a named set of egress addresses with a selection strategy.
+// IPv4 and IPv6 addresses are kept apart so that a selection can bind
+// whichever family the destination resolves to.
+type Pool struct {
+	name     string
+	strategy string
+	ipv4     []net.IP
+	ipv6     []net.IP
+	next     uint64
+}
+
+// NewPool creates a Pool from its configuration.
+func NewPool(cfg config.EgressPoolConfig) *Pool {
+	p := &Pool{name: cfg.Name, strategy: cfg.Strategy}
+	if p.strategy == "" {
+		p.strategy = RoundRobin
+	}
+	for _, addr := range cfg.Addresses {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			continue
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			p.ipv4 = append(p.ipv4, ip4)
+		} else {
+			p.ipv6 = append(p.ipv6, ip)
+		}
+	}
+	return p
+}
+
+// Name returns the pool name.
+func (p *Pool) Name() string {
+	return p.name
+}
+
+// Select picks source addresses for a request from clientIP made by
+// user. hash_user falls back to the client address when user is empty.
+func (p *Pool) Select(clientIP, user string) dialer.Source {
+	var n uint64
+	switch p.strategy {
+	case Fixed:
+		n = 0
+	case Random:
+		n = rand.Uint64()
+	case HashClient:
+		n = hash(clientIP)
+	case HashUser:
+		if user == "" {
+			user = clientIP
+		}
+		n = hash(user)
+	default:
+		n = atomic.AddUint64(&p.next, 1) - 1
+	}
+	return p.pick(n)
+}
+
+// pick returns the n-th address of each family, wrapping around.
+func (p *Pool) pick(n uint64) dialer.Source {
+	var src dialer.Source
+	if len(p.ipv4) > 0 {
+		src.IPv4 = p.ipv4[n%uint64(len(p.ipv4))]
+	}
+	if len(p.ipv6) > 0 {
+		src.IPv6 = p.ipv6[n%uint64(len(p.ipv6))]
+	}
+	return src
+}
+
+// Selector chooses the egress pool for a request and keeps sticky
+// sessions on the addresses first chosen for them.
+type Selector struct {
+	pools    map[string]*Pool
+	def      *Pool
+	sessions *Sessions
+}
+
+// New creates a Selector from the egress configuration.
+func New(cfg config.EgressConfig, m *metrics.Metrics) *Selector {
+	s := &Selector{pools: make(map[string]*Pool, len(cfg.Pools))}
+	if cfg.SessionTTL > 0 {
+		s.sessions = NewSessions(cfg.SessionTTL, cfg.MaxSessions, m)
+	}
+	for _, pc := range cfg.Pools {
+		s.pools[pc.Name] = NewPool(pc)
+	}
+	switch {
+	case cfg.Default != "":
+		s.def = s.pools[cfg.Default]
+	case len(cfg.Pools) > 0:
+		s.def = s.pools[cfg.Pools[0].Name]
+	}
+	return s
+}
+
+// Select picks source addresses from the named pool, or from the
+// default pool if name is empty or not defined. Requests with a session
+// ID from an authenticated user reuse the addresses chosen for that
+// session in the pool while it lives; unverified session IDs are
+// ignored, as anyone could claim them. It returns a zero Source when no
+// pool applies.
+func (s *Selector) Select(name, clientIP string, id auth.Identity) dialer.Source {
+	p := s.def
+	if named, ok := s.pools[name]; ok {
+		p = named
+	}
+	if p == nil {
+		return dialer.Source{}
+	}
+	if id.Session != "" && id.Verified && s.sessions != nil {
+		key := p.name + "\x00" + id.User + "\x00" + id.Session
+		return s.sessions.Get(key, func() dialer.Source {
+			// Hash strategies spread sessions rather than pinning every
+			// session of a user to the same address.
+			return p.Select(clientIP, key)
+		})
+	}
+	return p.Select(clientIP, id.User)
+}
+
+// hash returns a stable 64-bit hash of key.
+func hash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
@@ -0,0 +1,90 @@
+package egress
+
+import (
+	"sync"
+	"time"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/dialer"
+	"github.com/yigitkonur/proxy-http-forward/pkg/metrics"
+)
+
+// sweepInterval bounds how often expired sessions are purged.
+const sweepInterval = time.Minute
+
+// session is a sticky egress assignment.
+type session struct {
+	src     dialer.Source
+	expires time.Time
+}
+
+// Sessions maps session keys to the egress addresses chosen on their
+// first request. Entries expire ttl after their last use.
+type Sessions struct {
+	ttl     time.Duration
+	max     int // 0 = no cap
+	metrics *metrics.Metrics
+
+	mu        sync.Mutex
+	sessions  map[string]*session
+	lastSweep time.Time
+}
+
+// NewSessions creates an empty session table holding at most maxSessions
+// sessions, or any number if it is 0.
+func NewSessions(ttl time.Duration, maxSessions int, m *metrics.Metrics) *Sessions {
+	return &Sessions{
+		ttl:       ttl,
+		max:       maxSessions,
+		metrics:   m,
+		sessions:  make(map[string]*session),
+		lastSweep: time.Now(),
+	}
+}
+
+// Get returns the source bound to key, calling choose to pick one if the
+// session is new or has expired. Each call extends the session's life.
+// A new session is not remembered while the table is full of live ones.
+func (s *Sessions) Get(key string, choose func() dialer.Source) dialer.Source {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.lastSweep) >= sweepInterval {
+		s.sweep(now)
+	}
+
+	sess, ok := s.sessions[key]
+	if !ok && s.max > 0 && len(s.sessions) >= s.max {
+		s.sweep(now)
+		if len(s.sessions) >= s.max {
+			return choose()
+		}
+	}
+	if !ok || now.After(sess.expires) {
+		sess = &session{src: choose()}
+		s.sessions[key] = sess
+		s.metrics.SetActiveSessions(len(s.sessions))
+	}
+	sess.expires = now.Add(s.ttl)
+	return sess.src
+}
+
+// Len returns the number of sessions in the table, including any that
+// have expired but not yet been purged.
+func (s *Sessions) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sessions)
+}
+
+// sweep removes expired sessions. The caller must hold s.mu.
+func (s *Sessions) sweep(now time.Time) {
+	for key, sess := range s.sessions {
+		if now.After(sess.expires) {
+			delete(s.sessions, key)
+		}
+	}
+	s.lastSweep = now
+	s.metrics.SetActiveSessions(len(s.sessions))
+}
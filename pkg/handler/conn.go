@@ -0,0 +1,129 @@
+package handler
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/valyala/fasthttp"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/accesslog"
+	"github.com/yigitkonur/proxy-http-forward/pkg/auth"
+	"github.com/yigitkonur/proxy-http-forward/pkg/overload"
+	"github.com/yigitkonur/proxy-http-forward/pkg/ratelimit"
+	"github.com/yigitkonur/proxy-http-forward/pkg/unixsock"
+)
+
+// connRequest is a tunnel asked for by a client of a listener that does
+// not speak HTTP: a SOCKS5 CONNECT or a transparently redirected
+// connection.
+type connRequest struct {
+	conn  net.Conn
+	proto string // for the access log
+	host  string // host:port to connect to
+	id    auth.Identity
+	start time.Time
+
+	// reply tells the client the outcome, as the HTTP status a CONNECT
+	// would get, and on success the address the tunnel is bound to.
+	reply func(status int, bound net.Addr) error
+}
+
+// serveConn opens the tunnel of r with the same checks as a CONNECT
+// request after authentication: rate limits, a concurrency slot, quotas
+// and the destination's circuit breaker. It returns when the tunnel
+// closes or is refused, closing r.conn.
+func (l *Listener) serveConn(r *connRequest) {
+	h := l.h
+	h.metrics.IncrementConnections()
+	defer h.metrics.DecrementConnections()
+
+	e := h.connEntry(r)
+	fail := func(status int, reason string) {
+		r.reply(status, nil)
+		r.conn.Close()
+		h.metrics.RecordRequest("CONNECT", strconv.Itoa(status), "tunnel", time.Since(r.start).Seconds())
+		if reason != "" {
+			h.metrics.RecordError("tunnel", reason)
+		}
+		h.logger.Debugw("tunnel refused", append([]interface{}{
+			"protocol", r.proto,
+			"host", r.host,
+			"user", r.id.User,
+			"status", status,
+			"reason", reason,
+		}, peerFields(r.conn)...)...)
+		if h.access != nil {
+			e.Status, e.Duration = status, time.Since(r.start)
+			h.access.Log(e)
+		}
+	}
+
+	client := ratelimit.Client{IP: remoteIP(r.conn), User: r.id.VerifiedUser(), Destination: r.host}
+	if rule, _, ok := h.limiter.Allow(ratelimit.Tunnel, client); !ok {
+		h.metrics.RecordRateLimited(rule, ratelimit.Tunnel.String())
+		fail(fasthttp.StatusTooManyRequests, "")
+		return
+	}
+	slot, err := h.slots.Acquire(overload.Tunnel)
+	if err != nil {
+		h.metrics.RecordShed(ratelimit.Tunnel.String(), err.(*overload.Error).Reason)
+		fail(fasthttp.StatusServiceUnavailable, "")
+		return
+	}
+	defer slot.Release()
+	if _, err := h.quotas.Check(r.id.VerifiedUser()); err != nil {
+		fail(fasthttp.StatusTooManyRequests, "quota_exceeded")
+		return
+	}
+	if !h.tunnels.accepting() {
+		fail(fasthttp.StatusServiceUnavailable, "shutting_down")
+		return
+	}
+
+	destConn, err := h.dialTunnel(r.host, client.IP.String(), r.id, e)
+	if err != nil {
+		status, reason := errorStatus(err, "dial_failed")
+		h.logger.Warnw("proxy error",
+			"method", "CONNECT",
+			"type", "tunnel",
+			"error", err.Error(),
+			"reason", reason,
+		)
+		fail(status, reason)
+		return
+	}
+	if err := r.reply(fasthttp.StatusOK, destConn.LocalAddr()); err != nil {
+		r.conn.Close()
+		destConn.Close()
+		e.Status, e.CloseReason, e.Duration = fasthttp.StatusOK, closeError, time.Since(r.start)
+		h.access.Log(e)
+		return
+	}
+	h.startTunnel(r.conn, destConn, r.host, r.id, r.start, l.timeouts(), e)
+}
+
+// connEntry starts the access log entry of r. Only the time is filled in
+// if there is no access log.
+func (h *Handler) connEntry(r *connRequest) *accesslog.Entry {
+	e := &accesslog.Entry{Time: r.start}
+	if h.access == nil {
+		return e
+	}
+	e.Client = remoteIP(r.conn).String()
+	e.Method = fasthttp.MethodConnect
+	e.URL = r.host
+	e.Proto = r.proto
+	e.User, e.Session = r.id.User, r.id.Session
+	e.Peer = unixsock.CredOf(r.conn)
+	return e
+}
+
+// remoteIP returns the IP address of the client on c, or the unspecified
+// address for clients without one, such as those on unix sockets.
+func remoteIP(c net.Conn) net.IP {
+	if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return net.IPv4zero
+}
@@ -2,19 +2,33 @@
 package handler
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"strconv"
-	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/valyala/fasthttp"
 	"go.uber.org/zap"
 
+	"github.com/yigitkonur/proxy-http-forward/pkg/accesslog"
+	"github.com/yigitkonur/proxy-http-forward/pkg/auth"
+	"github.com/yigitkonur/proxy-http-forward/pkg/bandwidth"
+	"github.com/yigitkonur/proxy-http-forward/pkg/breaker"
 	"github.com/yigitkonur/proxy-http-forward/pkg/config"
+	"github.com/yigitkonur/proxy-http-forward/pkg/dialer"
+	"github.com/yigitkonur/proxy-http-forward/pkg/egress"
 	"github.com/yigitkonur/proxy-http-forward/pkg/metrics"
+	"github.com/yigitkonur/proxy-http-forward/pkg/overload"
 	"github.com/yigitkonur/proxy-http-forward/pkg/pool"
+	"github.com/yigitkonur/proxy-http-forward/pkg/quota"
+	"github.com/yigitkonur/proxy-http-forward/pkg/ratelimit"
+	"github.com/yigitkonur/proxy-http-forward/pkg/route"
+	"github.com/yigitkonur/proxy-http-forward/pkg/unixsock"
 )
 
 // hopByHopHeaders lists headers that should not be forwarded.
@@ -32,95 +46,374 @@ var hopByHopHeaders = []string{
 // Handler handles HTTP proxy requests.
 type Handler struct {
 	pool    *pool.Pool
+	dialer  *dialer.Dialer
+	routes  *route.Table
+	auth    *auth.Authenticator
+	egress  *egress.Selector
 	metrics *metrics.Metrics
 	logger  *zap.SugaredLogger
-	config  config.ProxyConfig
+	access  *accesslog.Logger
+	breaker *breaker.Set
+	limiter *ratelimit.Limiter
+	shaper  *bandwidth.Shaper
+	quotas  *quota.Tracker
+	slots   *overload.Limiter
+	tunnels *tunnelRegistry
+
+	// Replaced on reload; requests use the values current when they start.
+	config   atomic.Pointer[config.ProxyConfig]
+	timeouts atomic.Pointer[config.TimeoutConfig]
+	retry    atomic.Pointer[retryPolicy]
+
+	self atomic.Pointer[selfAddrs] // set by SetListenAddrs
 }
 
-// New creates a new Handler.
-func New(p *pool.Pool, m *metrics.Metrics, logger *zap.SugaredLogger, cfg config.ProxyConfig) *Handler {
-	return &Handler{
+// New creates a new Handler. Routes in rt override timeouts per
+// destination. q and al may be nil if quotas or the access log are
+// disabled.
+func New(p *pool.Pool, d *dialer.Dialer, rt *route.Table, a *auth.Authenticator, e *egress.Selector, q *quota.Tracker, m *metrics.Metrics, logger *zap.SugaredLogger, al *accesslog.Logger, cfg config.ProxyConfig) *Handler {
+	h := &Handler{
 		pool:    p,
+		dialer:  d,
+		routes:  rt,
+		auth:    a,
+		egress:  e,
 		metrics: m,
 		logger:  logger,
-		config:  cfg,
+		access:  al,
+		breaker: breaker.New(cfg.CircuitBreaker, m),
+		limiter: ratelimit.New(cfg.RateLimits),
+		shaper:  bandwidth.New(cfg.Bandwidth, m),
+		quotas:  q,
+		slots:   overload.New(cfg.Concurrency, m),
+		tunnels: newTunnelRegistry(),
 	}
+	h.Reload(cfg)
+	return h
 }
 
-// HandleRequest is the main request handler for the proxy.
+// Reload applies the timeouts, including the dial and response timeouts,
+// retry policy, rate limits, bandwidth limits and concurrency caps from
+// cfg to requests and tunnels that start afterwards. Other settings in
+// cfg are ignored.
+func (h *Handler) Reload(cfg config.ProxyConfig) {
+	h.config.Store(&cfg)
+	timeouts := cfg.Timeouts
+	h.timeouts.Store(&timeouts)
+	h.retry.Store(newRetryPolicy(cfg.Retry))
+	h.limiter.Update(cfg.RateLimits)
+	h.shaper.Update(cfg.Bandwidth)
+	h.slots.Update(cfg.Concurrency)
+}
+
+// HandleRequest is the main request handler for the proxy. It uses the
+// Handler's own authenticator and timeouts; see Listener for per-listener
+// settings.
 func (h *Handler) HandleRequest(ctx *fasthttp.RequestCtx) {
+	h.serve(ctx, &Listener{h: h, auth: h.auth})
+}
+
+// serve handles a request accepted on l.
+func (h *Handler) serve(ctx *fasthttp.RequestCtx, l *Listener) {
 	start := time.Now()
 	h.metrics.IncrementConnections()
 	defer h.metrics.DecrementConnections()
 
 	method := string(ctx.Method())
+	e := h.accessEntry(ctx, start)
+	defer h.logAccess(ctx, e)
+
+	// Authenticate before doing any upstream work
+	id, ok := l.auth.Authenticate(&ctx.Request.Header)
+	if !ok {
+		h.handleAuthRequired(ctx, start, method, id, l.auth)
+		return
+	}
+	e.User, e.Session = id.User, id.Session
+
+	kind, slotKind := ratelimit.Request, overload.Request
+	if method == fasthttp.MethodConnect {
+		kind, slotKind = ratelimit.Tunnel, overload.Tunnel
+	}
+	client := ratelimit.Client{IP: ctx.RemoteIP(), User: id.VerifiedUser(), Destination: string(ctx.Host())}
+	if rule, wait, ok := h.limiter.Allow(kind, client); !ok {
+		h.handleRateLimited(ctx, start, method, kind, id, rule, wait)
+		return
+	}
+
+	// Wait for a slot; tunnels hold theirs until they close
+	slot, err := h.slots.Acquire(slotKind)
+	if err != nil {
+		h.handleOverloaded(ctx, start, method, kind, err.(*overload.Error))
+		return
+	}
+
+	// Quotas are kept for authenticated users only; requests are charged
+	// once they reach the upstream
+	if reset, err := h.quotas.Check(id.VerifiedUser()); err != nil {
+		slot.Release()
+		h.handleQuotaExceeded(ctx, start, method, kind, id, reset)
+		return
+	}
 
 	// Handle HTTP CONNECT method for HTTPS tunneling
 	if method == fasthttp.MethodConnect {
-		h.handleConnect(ctx, start)
+		h.handleConnect(ctx, start, id, l.timeouts(), slot, e)
 		return
 	}
 
 	// Handle regular HTTP proxy requests
-	h.handleHTTP(ctx, start)
+	defer slot.Release()
+	h.handleHTTP(ctx, start, id, l.timeouts(), slot, e)
+}
+
+// accessEntry starts the access log entry of the request in ctx. Only
+// the time is filled in if there is no access log.
+func (h *Handler) accessEntry(ctx *fasthttp.RequestCtx, start time.Time) *accesslog.Entry {
+	e := &accesslog.Entry{Time: start}
+	if h.access == nil {
+		return e
+	}
+	e.Client = ctx.RemoteIP().String()
+	e.Method = string(ctx.Method())
+	e.URL = string(ctx.RequestURI())
+	e.Proto = string(ctx.Request.Header.Protocol())
+	e.Referer = string(ctx.Referer())
+	e.UserAgent = string(ctx.UserAgent())
+	if ctx.IsTLS() {
+		e.SNI = ctx.TLSConnectionState().ServerName
+	}
+	e.Peer = unixsock.CredOf(ctx.Conn())
+	return e
+}
+
+// logAccess completes e from the response in ctx and writes it, unless
+// the request became a tunnel, which is logged when it closes.
+func (h *Handler) logAccess(ctx *fasthttp.RequestCtx, e *accesslog.Entry) {
+	if h.access == nil || ctx.Hijacked() {
+		return
+	}
+	e.Status = ctx.Response.StatusCode()
+	e.MIMEType = string(ctx.Response.Header.ContentType())
+	if !ctx.Response.IsBodyStream() {
+		e.BytesSent = int64(len(ctx.Response.Body()))
+	}
+	e.Duration = time.Since(e.Time)
+	h.access.Log(e)
 }
 
-// handleHTTP proxies regular HTTP requests.
-func (h *Handler) handleHTTP(ctx *fasthttp.RequestCtx, start time.Time) {
+// handleHTTP proxies regular HTTP requests. timeouts are the defaults
+// for the listener, before route overrides. slot is the request's
+// concurrency slot, and e collects what the access log reports.
+func (h *Handler) handleHTTP(ctx *fasthttp.RequestCtx, start time.Time, id auth.Identity, timeouts config.TimeoutConfig, slot *overload.Slot, e *accesslog.Entry) {
 	method := string(ctx.Method())
 
-	// Prepare the outgoing request
+	// Prepare the outgoing request. resp is released here unless its
+	// body is streamed to the client.
 	req := fasthttp.AcquireRequest()
 	resp := fasthttp.AcquireResponse()
 	defer fasthttp.ReleaseRequest(req)
-	defer fasthttp.ReleaseResponse(resp)
+	streamed := false
+	defer func() {
+		if !streamed {
+			fasthttp.ReleaseResponse(resp)
+		}
+	}()
 
 	// Copy request from context
 	ctx.Request.CopyTo(req)
 
+	// Requests received on an https listener are marked https by fasthttp;
+	// the upstream scheme is the one in the absolute-form request line.
+	if ctx.IsTLS() {
+		if scheme, _, ok := bytes.Cut(ctx.Request.Header.RequestURI(), []byte("://")); ok {
+			req.URI().SetSchemeBytes(scheme)
+		}
+	}
+
+	// Choose egress addresses from the destination route's pool
+	clientIP := ctx.RemoteIP().String()
+	src := h.egress.Select(h.egressPool(upstreamAddr(req)), clientIP, id)
+
 	// Remove hop-by-hop headers
 	removeHopByHopHeaders(&req.Header)
 
 	// Add X-Forwarded-For header
-	clientIP := ctx.RemoteIP().String()
 	if xff := string(req.Header.Peek("X-Forwarded-For")); xff != "" {
 		req.Header.Set("X-Forwarded-For", xff+", "+clientIP)
 	} else {
 		req.Header.Set("X-Forwarded-For", clientIP)
 	}
 
-	// Execute the request
-	err := h.pool.DoTimeout(req, resp, h.config.ResponseTimeout)
+	// Bodies are buffered whole; the shaper paces them as they are
+	// forwarded. Per-user limits apply to authenticated users only.
+	bw := h.shaper.Conn(id.VerifiedUser())
+	body := ctx.Request.Body()
+
+	// Execute the request, retrying per policy
+	sent := time.Now()
+	err := h.doWithRetry(req, resp, src, timeouts, slot, bw, body)
+	dest := upstreamAddr(req)
+	e.UpstreamDur = time.Since(sent)
+	e.EgressIP = src.String()
+	e.BytesRecv = int64(len(body))
+	if r := h.routes.Match(dest); r != nil {
+		e.Route = r.Name
+	}
 	if err != nil {
+		bw.Close()
 		h.handleError(ctx, start, method, "http", err, "upstream_request_failed")
 		return
 	}
 
+	sentBytes := len(resp.Body())
+	status := strconv.Itoa(resp.StatusCode())
+	e.Upstream = dest
+	e.BytesSent = int64(sentBytes)
+	h.quotas.AddRequest(id.VerifiedUser())
+	h.quotas.Add(id.VerifiedUser(), int64(len(body)+sentBytes))
+
 	// Copy response back to context
-	resp.CopyTo(&ctx.Response)
+	streamed = sendResponse(ctx, resp, bw)
 
 	// Remove hop-by-hop headers from response
 	removeResponseHopByHopHeaders(&ctx.Response.Header)
 
 	// Record metrics
 	duration := time.Since(start).Seconds()
-	status := strconv.Itoa(resp.StatusCode())
 	h.metrics.RecordRequest(method, status, "http", duration)
-	h.metrics.BytesSent.WithLabelValues("http").Add(float64(len(resp.Body())))
-	h.metrics.BytesReceived.WithLabelValues("http").Add(float64(len(req.Body())))
+	h.metrics.BytesSent.WithLabelValues("http").Add(float64(sentBytes))
+	h.metrics.BytesReceived.WithLabelValues("http").Add(float64(len(body)))
 
-	h.logger.Debugw("proxied http request",
+	h.logger.Debugw("proxied http request", append([]interface{}{
 		"method", method,
 		"uri", string(ctx.RequestURI()),
 		"status", status,
 		"duration", duration,
-	)
+		"user", id.User,
+		"session", id.Session,
+		"egress_ip", src.String(),
+	}, peerFields(ctx.Conn())...)...)
 }
 
-// handleConnect handles HTTPS CONNECT tunneling.
-func (h *Handler) handleConnect(ctx *fasthttp.RequestCtx, start time.Time) {
-	h.metrics.IncrementTunnels()
-	defer h.metrics.DecrementTunnels()
+// sendResponse copies resp to ctx. If downloads are shaped, the body is
+// streamed to the client from resp at the rate bw allows, and the stream
+// takes over resp; sendResponse reports whether it did. bw is closed once
+// the body has been sent.
+func sendResponse(ctx *fasthttp.RequestCtx, resp *fasthttp.Response, bw *bandwidth.Conn) bool {
+	body := resp.Body()
+	if !bw.Limited(bandwidth.Download) || len(body) == 0 {
+		resp.CopyTo(&ctx.Response)
+		bw.Wait(bandwidth.Download, len(body))
+		bw.Close()
+		return false
+	}
+	resp.Header.CopyTo(&ctx.Response.Header)
+	ctx.Response.SetBodyStream(&shapedBody{
+		Reader: bw.Reader(bandwidth.Download, bytes.NewReader(body)),
+		bw:     bw,
+		resp:   resp,
+	}, len(body))
+	return true
+}
+
+// shapedBody is a response body stream read from an upstream response.
+// It releases the response and its bandwidth buckets when fasthttp closes
+// it.
+type shapedBody struct {
+	io.Reader
+	bw   *bandwidth.Conn
+	resp *fasthttp.Response
+}
+
+func (b *shapedBody) Close() error {
+	b.bw.Close()
+	fasthttp.ReleaseResponse(b.resp)
+	return nil
+}
+
+// doWithRetry sends req upstream, repeating it while the retry policy
+// allows. resp holds the outcome of the last attempt. Each attempt must
+// pass the destination's circuit breaker, and all of them together must
+// fit in the request timeout. The latency of each attempt is observed
+// on slot. If uploads are shaped, each attempt sends body, the request
+// body, at the rate bw allows.
+func (h *Handler) doWithRetry(req *fasthttp.Request, resp *fasthttp.Response, src dialer.Source, timeouts config.TimeoutConfig, slot *overload.Slot, bw *bandwidth.Conn, body []byte) error {
+	retry, responseTimeout := h.retry.Load(), h.config.Load().ResponseTimeout
+	replayable := retry.replayable(req)
+	dest := upstreamAddr(req)
+
+	var deadline time.Time
+	if total := h.routes.Timeouts(dest, timeouts).Request; total > 0 {
+		deadline = time.Now().Add(total)
+	}
+
+	for attempt := 1; ; attempt++ {
+		timeout := responseTimeout
+		capped := false
+		if !deadline.IsZero() {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				return &pool.TimeoutError{Reason: pool.ReasonRequestTimeout}
+			}
+			if timeout <= 0 || remaining < timeout {
+				timeout, capped = remaining, true
+			}
+		}
+
+		if err := h.breaker.Allow(dest); err != nil {
+			return err
+		}
+		if len(body) > 0 && bw.Limited(bandwidth.Upload) {
+			// Sending the stream takes the attempt's time, not extra.
+			req.SetBodyStream(bw.Reader(bandwidth.Upload, bytes.NewReader(body)), len(body))
+		}
+		throttled, sent := bw.Throttled(bandwidth.Upload), time.Now()
+		err := h.pool.DoTimeoutFrom(req, resp, timeout, src)
+		// The upload waiting on the shaper is not upstream latency.
+		slot.Observe(time.Since(sent) - (bw.Throttled(bandwidth.Upload) - throttled))
+		h.breaker.Record(dest, err != nil && classifyError(err) != "")
+
+		var te *pool.TimeoutError
+		if capped && errors.As(err, &te) && te.Reason == pool.ReasonResponseTimeout {
+			// The attempt ran out of the whole request's time.
+			return &pool.TimeoutError{Reason: pool.ReasonRequestTimeout, Err: err}
+		}
+		if !replayable || attempt >= retry.maxAttempts {
+			return err
+		}
+		reason := retry.reason(err, resp.StatusCode())
+		if reason == "" {
+			return err
+		}
+
+		delay := retry.delay(attempt)
+		if !deadline.IsZero() && time.Now().Add(delay).After(deadline) {
+			return err
+		}
+
+		h.metrics.RecordRetry("http", reason)
+		h.logger.Debugw("retrying upstream request",
+			"uri", string(req.RequestURI()),
+			"attempt", attempt,
+			"reason", reason,
+		)
+
+		time.Sleep(delay)
+		resp.Reset()
+	}
+}
+
+// handleConnect handles HTTPS CONNECT tunneling. slot is released once
+// the tunnel closes, or at once if it is never opened. The tunnel
+// completes e and writes it to the access log.
+func (h *Handler) handleConnect(ctx *fasthttp.RequestCtx, start time.Time, id auth.Identity, timeouts config.TimeoutConfig, slot *overload.Slot, e *accesslog.Entry) {
+	hijacked := false
+	defer func() {
+		if !hijacked {
+			slot.Release()
+		}
+	}()
 
 	host := string(ctx.Host())
 
@@ -129,68 +422,186 @@ func (h *Handler) handleConnect(ctx *fasthttp.RequestCtx, start time.Time) {
 		host = net.JoinHostPort(host, "443")
 	}
 
-	// Connect to the destination
-	destConn, err := net.DialTimeout("tcp", host, h.config.DialTimeout)
+	if !h.tunnels.accepting() {
+		h.handleError(ctx, start, "CONNECT", "tunnel", errShuttingDown, "shutting_down")
+		return
+	}
+
+	destConn, err := h.dialTunnel(host, ctx.RemoteIP().String(), id, e)
 	if err != nil {
 		h.handleError(ctx, start, "CONNECT", "tunnel", err, "dial_failed")
 		return
 	}
 
-	// Send 200 Connection Established
-	ctx.SetStatusCode(fasthttp.StatusOK)
-	ctx.Response.SetBodyRaw(nil)
-
-	// Hijack the connection for bidirectional tunneling
+	// Hijack the connection for bidirectional tunneling. The 200 is
+	// written by the hijack handler rather than fasthttp, which would skip
+	// the handler if the client were gone, leaking destConn and the slot.
+	hijacked = true
+	ctx.HijackSetNoResponse(true)
 	ctx.Hijack(func(clientConn net.Conn) {
-		h.tunnel(clientConn, destConn, host, start)
+		defer slot.Release()
+		if _, err := io.WriteString(clientConn, connectEstablished); err != nil {
+			clientConn.Close()
+			destConn.Close()
+			e.Status, e.CloseReason, e.Duration = fasthttp.StatusOK, closeError, time.Since(start)
+			h.access.Log(e)
+			return
+		}
+		h.startTunnel(clientConn, destConn, host, id, start, timeouts, e)
 	})
 }
 
-// tunnel creates a bidirectional tunnel between client and destination.
-func (h *Handler) tunnel(clientConn, destConn net.Conn, host string, start time.Time) {
-	defer clientConn.Close()
-	defer destConn.Close()
+// dialTunnel connects to host for a tunnel from clientIP, unless host is
+// known to be failing, and fills in the upstream details of e. A tunnel
+// that connects counts as a request of id's quotas.
+func (h *Handler) dialTunnel(host, clientIP string, id auth.Identity, e *accesslog.Entry) (net.Conn, error) {
+	if err := h.breaker.Allow(host); err != nil {
+		return nil, err
+	}
+	src := h.egress.Select(h.egressPool(host), clientIP, id)
+	dialStart := time.Now()
+	destConn, err := h.dialer.DialTimeoutFrom(host, h.config.Load().DialTimeout, src)
+	e.UpstreamDur = time.Since(dialStart)
+	h.breaker.Record(host, err != nil)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		err = &pool.TimeoutError{Reason: pool.ReasonDialTimeout, Err: err}
+	}
+	if err != nil {
+		return nil, err
+	}
+	h.quotas.AddRequest(id.VerifiedUser())
+	e.Upstream = destConn.RemoteAddr().String()
+	e.EgressIP = localIP(destConn)
+	return destConn, nil
+}
 
-	var wg sync.WaitGroup
-	var clientToServer, serverToClient int64
+// egressPool returns the egress pool named by the route for dest, or ""
+// for the default pool.
+func (h *Handler) egressPool(dest string) string {
+	if r := h.routes.Match(dest); r != nil {
+		return r.EgressPool
+	}
+	return ""
+}
 
-	// Client -> Server
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		clientToServer, _ = io.Copy(destConn, clientConn)
-	}()
+// startTunnel runs the tunnel between clientConn and destConn once the
+// client has been told it is open, starting it with the PROXY protocol
+// header the destination's route asks for. timeouts are the defaults for
+// the listener, before route overrides.
+func (h *Handler) startTunnel(clientConn, destConn net.Conn, host string, id auth.Identity, start time.Time, timeouts config.TimeoutConfig, e *accesslog.Entry) {
+	var pp *config.SendProxyProtocolConfig
+	if r := h.routes.Match(host); r != nil {
+		pp = r.SendProxyProtocol
+		e.Route = r.Name
+	}
 
-	// Server -> Client
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		serverToClient, _ = io.Copy(clientConn, destConn)
-	}()
+	var forwarded int64
+	if pp != nil && pp.Enabled {
+		n, sni, err := sendProxyHeader(clientConn, destConn, host, id.User, pp.SNIWait)
+		if err != nil {
+			h.metrics.RecordError("tunnel", "proxy_protocol_header")
+			h.logger.Debugw("sending PROXY protocol header failed", "host", host, "error", err)
+			clientConn.Close()
+			destConn.Close()
+			e.Status, e.CloseReason, e.Duration = fasthttp.StatusOK, closeError, time.Since(start)
+			h.access.Log(e)
+			return
+		}
+		forwarded, e.SNI = n, sni
+	}
+	h.tunnel(clientConn, destConn, tunnelInfo{
+		host:      host,
+		user:      id.VerifiedUser(),
+		start:     start,
+		timeouts:  h.routes.Timeouts(host, timeouts),
+		forwarded: forwarded,
+		access:    e,
+	})
+}
 
-	wg.Wait()
+// connectEstablished is the response to a CONNECT that opened a tunnel.
+const connectEstablished = "HTTP/1.1 200 Connection established\r\n\r\n"
 
-	// Record metrics
-	duration := time.Since(start).Seconds()
-	h.metrics.RecordRequest("CONNECT", "200", "tunnel", duration)
-	h.metrics.BytesSent.WithLabelValues("tunnel").Add(float64(serverToClient))
-	h.metrics.BytesReceived.WithLabelValues("tunnel").Add(float64(clientToServer))
+// handleOverloaded rejects a request or tunnel shed for lack of a
+// concurrency slot.
+func (h *Handler) handleOverloaded(ctx *fasthttp.RequestCtx, start time.Time, method string, kind ratelimit.Kind, err *overload.Error) {
+	ctx.Error("Proxy overloaded", fasthttp.StatusServiceUnavailable)
+	ctx.Response.Header.Set("Retry-After", strconv.Itoa(int(math.Ceil(err.RetryAfter.Seconds()))))
 
-	h.logger.Debugw("tunnel closed",
-		"host", host,
-		"duration", duration,
-		"bytes_sent", serverToClient,
-		"bytes_received", clientToServer,
-	)
+	h.metrics.RecordRequest(method, "503", kind.String(), time.Since(start).Seconds())
+	h.metrics.RecordShed(kind.String(), err.Reason)
+
+	h.logger.Debugw("request shed", append([]interface{}{
+		"method", method,
+		"host", string(ctx.Host()),
+		"reason", err.Reason,
+	}, peerFields(ctx.Conn())...)...)
+}
+
+// handleAuthRequired rejects a request with missing or invalid credentials.
+func (h *Handler) handleAuthRequired(ctx *fasthttp.RequestCtx, start time.Time, method string, id auth.Identity, a *auth.Authenticator) {
+	reqType := "http"
+	if method == fasthttp.MethodConnect {
+		reqType = "tunnel"
+	}
+
+	ctx.Error("Proxy authentication required", fasthttp.StatusProxyAuthRequired)
+	ctx.Response.Header.Set("Proxy-Authenticate", a.Challenge())
+
+	h.metrics.RecordRequest(method, "407", reqType, time.Since(start).Seconds())
+	h.metrics.RecordError(reqType, "auth_failed")
+
+	h.logger.Debugw("proxy authentication failed", append([]interface{}{
+		"method", method,
+		"user", id.User,
+		"client", ctx.RemoteIP().String(),
+	}, peerFields(ctx.Conn())...)...)
+}
+
+// handleRateLimited rejects a request that exceeded a rate limit rule.
+func (h *Handler) handleRateLimited(ctx *fasthttp.RequestCtx, start time.Time, method string, kind ratelimit.Kind, id auth.Identity, rule string, retryAfter time.Duration) {
+	ctx.Error("Rate limit exceeded", fasthttp.StatusTooManyRequests)
+	ctx.Response.Header.Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+
+	h.metrics.RecordRequest(method, "429", kind.String(), time.Since(start).Seconds())
+	h.metrics.RecordRateLimited(rule, kind.String())
+
+	h.logger.Debugw("rate limited", append([]interface{}{
+		"method", method,
+		"host", string(ctx.Host()),
+		"client_ip", ctx.RemoteIP().String(),
+		"user", id.User,
+		"rule", rule,
+		"retry_after", retryAfter,
+	}, peerFields(ctx.Conn())...)...)
+}
+
+// handleQuotaExceeded rejects a request from a user who has used up a
+// quota.
+func (h *Handler) handleQuotaExceeded(ctx *fasthttp.RequestCtx, start time.Time, method string, kind ratelimit.Kind, id auth.Identity, reset time.Duration) {
+	ctx.Error("Quota exceeded", fasthttp.StatusTooManyRequests)
+	ctx.Response.Header.Set("Retry-After", strconv.Itoa(int(math.Ceil(reset.Seconds()))))
+
+	h.metrics.RecordRequest(method, "429", kind.String(), time.Since(start).Seconds())
+	h.metrics.RecordError(kind.String(), "quota_exceeded")
+
+	h.logger.Debugw("quota exceeded", append([]interface{}{
+		"method", method,
+		"host", string(ctx.Host()),
+		"user", id.User,
+		"retry_after", reset,
+	}, peerFields(ctx.Conn())...)...)
 }
 
 // handleError handles and logs errors.
 func (h *Handler) handleError(ctx *fasthttp.RequestCtx, start time.Time, method, reqType string, err error, reason string) {
 	duration := time.Since(start).Seconds()
+	status, reason := errorStatus(err, reason)
 
-	ctx.Error(fmt.Sprintf("Proxy error: %v", err), fasthttp.StatusBadGateway)
+	ctx.Error(fmt.Sprintf("Proxy error: %v", err), status)
 
-	h.metrics.RecordRequest(method, "502", reqType, duration)
+	h.metrics.RecordRequest(method, strconv.Itoa(status), reqType, duration)
 	h.metrics.RecordError(reqType, reason)
 
 	h.logger.Warnw("proxy error",
@@ -201,6 +612,45 @@ func (h *Handler) handleError(ctx *fasthttp.RequestCtx, start time.Time, method,
 	)
 }
 
+// errorStatus returns the status to answer a failed request with, and
+// the reason to report it under if not reason.
+func errorStatus(err error, reason string) (int, string) {
+	var te *pool.TimeoutError
+	switch {
+	case errors.Is(err, breaker.ErrOpen):
+		return fasthttp.StatusServiceUnavailable, "circuit_open"
+	case errors.Is(err, errShuttingDown):
+		return fasthttp.StatusServiceUnavailable, reason
+	case errors.As(err, &te):
+		return fasthttp.StatusGatewayTimeout, te.Reason
+	}
+	return fasthttp.StatusBadGateway, reason
+}
+
+// upstreamAddr returns the host:port req is sent to.
+func upstreamAddr(req *fasthttp.Request) string {
+	uri := req.URI()
+	return fasthttp.AddMissingPort(string(uri.Host()), string(uri.Scheme()) == "https")
+}
+
+// peerFields returns log fields with the credentials of a client
+// connected over a unix socket, or nothing for other clients.
+func peerFields(c net.Conn) []interface{} {
+	cred := unixsock.CredOf(c)
+	if cred == nil {
+		return nil
+	}
+	return []interface{}{"peer_pid", cred.PID, "peer_uid", cred.UID, "peer_gid", cred.GID}
+}
+
+// localIP returns the local IP address of conn.
+func localIP(conn net.Conn) string {
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return conn.LocalAddr().String()
+}
+
 // removeHopByHopHeaders removes hop-by-hop headers from the header.
 func removeHopByHopHeaders(header *fasthttp.RequestHeader) {
 	for _, h := range hopByHopHeaders {
@@ -0,0 +1,38 @@
+package handler
+
+import (
+	"github.com/valyala/fasthttp"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/auth"
+	"github.com/yigitkonur/proxy-http-forward/pkg/config"
+)
+
+// Listener serves the requests accepted on one listener. It shares the
+// Handler's upstream pool, circuit breakers and tunnels, and can
+// authenticate and time out requests differently.
+type Listener struct {
+	h         *Handler
+	auth      *auth.Authenticator
+	overrides *config.TimeoutConfig
+}
+
+// Listener returns a Listener that authenticates with a, or with the
+// Handler's authenticator if a is nil, and applies timeouts on top of
+// proxy.timeouts. Route overrides still take precedence.
+func (h *Handler) Listener(a *auth.Authenticator, timeouts *config.TimeoutConfig) *Listener {
+	if a == nil {
+		a = h.auth
+	}
+	return &Listener{h: h, auth: a, overrides: timeouts}
+}
+
+// HandleRequest handles a request accepted on the listener.
+func (l *Listener) HandleRequest(ctx *fasthttp.RequestCtx) {
+	l.h.serve(ctx, l)
+}
+
+// timeouts returns the current proxy.timeouts with the listener's
+// overrides applied.
+func (l *Listener) timeouts() config.TimeoutConfig {
+	return l.h.timeouts.Load().Merge(l.overrides)
+}
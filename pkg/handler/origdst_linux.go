@@ -0,0 +1,57 @@
+//go:build linux
+
+package handler
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ip6tSOOriginalDst is IP6T_SO_ORIGINAL_DST from
+// linux/netfilter_ipv6/ip6_tables.h, missing from x/sys/unix.
+const ip6tSOOriginalDst = 80
+
+// originalDst returns the address c was sent to before an iptables or
+// nftables REDIRECT, read with SO_ORIGINAL_DST.
+func originalDst(c net.Conn) (*net.TCPAddr, error) {
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return nil, errors.New("not a TCP connection")
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	local, _ := c.LocalAddr().(*net.TCPAddr)
+	var addr *net.TCPAddr
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if local != nil && local.IP.To4() == nil {
+			info, err := unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, ip6tSOOriginalDst)
+			if err != nil {
+				sockErr = err
+				return
+			}
+			var port [2]byte
+			binary.NativeEndian.PutUint16(port[:], info.Addr.Port)
+			addr = &net.TCPAddr{IP: append(net.IP(nil), info.Addr.Addr[:]...), Port: int(binary.BigEndian.Uint16(port[:]))}
+			return
+		}
+		// The sockaddr_in comes back in the 16 bytes of an ipv6_mreq.
+		mreq, err := unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, unix.SO_ORIGINAL_DST)
+		if err != nil {
+			sockErr = err
+			return
+		}
+		sa := mreq.Multiaddr
+		addr = &net.TCPAddr{IP: net.IPv4(sa[4], sa[5], sa[6], sa[7]), Port: int(binary.BigEndian.Uint16(sa[2:4]))}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return addr, sockErr
+}
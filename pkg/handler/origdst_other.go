@@ -0,0 +1,13 @@
+//go:build !linux
+
+package handler
+
+import (
+	"errors"
+	"net"
+)
+
+// originalDst is only supported on Linux.
+func originalDst(net.Conn) (*net.TCPAddr, error) {
+	return nil, errors.New("transparent proxying is only supported on Linux")
+}
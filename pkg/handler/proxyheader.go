@@ -0,0 +1,125 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/proxyproto"
+)
+
+// errSniffed stops the handshake used to read a ClientHello.
+var errSniffed = errors.New("client hello read")
+
+// sendProxyHeader starts destConn with a PROXY protocol v2 header for
+// the tunnel from clientConn to host. The header carries user and the
+// server name: the SNI of the client's TLS ClientHello if one arrives
+// within sniWait, otherwise the CONNECT host name. Client data read
+// while waiting follows the header. It returns how many client bytes
+// were forwarded, and the SNI if there was one.
+func sendProxyHeader(clientConn, destConn net.Conn, host, user string, sniWait time.Duration) (int64, string, error) {
+	name, _, err := net.SplitHostPort(host)
+	if err != nil {
+		name = host
+	}
+	if net.ParseIP(name) != nil {
+		name = ""
+	}
+	var early []byte
+	var sni string
+	if sniWait > 0 {
+		sni, early = sniffServerName(clientConn, sniWait)
+		if sni != "" {
+			name = sni
+		}
+	}
+
+	hdr := &proxyproto.Header{Version: 2}
+	src, srcOK := clientConn.RemoteAddr().(*net.TCPAddr)
+	dst, dstOK := destConn.RemoteAddr().(*net.TCPAddr)
+	if srcOK && dstOK {
+		hdr.Source, hdr.Destination = src, dst
+	}
+	if name != "" {
+		hdr.TLVs = append(hdr.TLVs, proxyproto.TLV{Type: proxyproto.TypeAuthority, Value: []byte(name)})
+	}
+	if user != "" {
+		hdr.TLVs = append(hdr.TLVs, proxyproto.TLV{Type: proxyproto.TypeUser, Value: []byte(user)})
+	}
+	b, err := hdr.AppendV2(nil)
+	if err != nil {
+		return 0, "", err
+	}
+	if _, err := destConn.Write(append(b, early...)); err != nil {
+		return 0, "", err
+	}
+	return int64(len(early)), sni, nil
+}
+
+// sniffServerName waits up to wait for a TLS ClientHello on c and returns
+// its server name along with the bytes read, which the destination still
+// needs. Anything that is not a ClientHello yields no name.
+func sniffServerName(c net.Conn, wait time.Duration) (string, []byte) {
+	var read bytes.Buffer
+	c.SetReadDeadline(time.Now().Add(wait))
+	defer c.SetReadDeadline(time.Time{})
+
+	name := readServerName(c, io.TeeReader(c, &read))
+	return name, read.Bytes()
+}
+
+// readServerName returns the server name of the TLS ClientHello read
+// from r, the client side of c, or "" if there is none.
+func readServerName(c net.Conn, r io.Reader) string {
+	var name string
+	tls.Server(sniffConn{Conn: c, r: r}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			name = hello.ServerName
+			return nil, errSniffed
+		},
+	}).Handshake()
+	return name
+}
+
+// helloRecorder keeps a copy of what is read from r until it holds a
+// whole TLS record, enough for the ClientHello that starts a TLS
+// connection, or turns out not to be a handshake.
+type helloRecorder struct {
+	r    io.Reader
+	data []byte
+	done bool
+}
+
+// maxHello caps how much a helloRecorder keeps.
+const maxHello = 16 * 1024
+
+func (h *helloRecorder) Read(b []byte) (int, error) {
+	n, err := h.r.Read(b)
+	if !h.done && n > 0 {
+		h.data = append(h.data, b[:n]...)
+		switch {
+		case h.data[0] != 0x16 || len(h.data) >= maxHello:
+			h.done = true
+		case len(h.data) >= 5:
+			h.done = len(h.data) >= 5+(int(h.data[3])<<8|int(h.data[4]))
+		}
+	}
+	return n, err
+}
+
+// sniffConn lets a TLS server read a ClientHello without answering it.
+type sniffConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c sniffConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c sniffConn) Write([]byte) (int, error) {
+	return 0, errSniffed
+}
@@ -0,0 +1,128 @@
+package handler
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/valyala/fasthttp"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/config"
+)
+
+// Retry conditions.
+const (
+	retryConnect = "connect" // the upstream could not be dialed
+	retryReset   = "reset"   // the connection was reset or closed mid-request
+	retryTimeout = "timeout" // the upstream did not respond in time
+	retryStatus  = "status"  // the upstream answered with a retryable status
+)
+
+// idempotentMethods are safe to replay (RFC 9110, section 9.2.2).
+var idempotentMethods = map[string]bool{
+	fasthttp.MethodGet:     true,
+	fasthttp.MethodHead:    true,
+	fasthttp.MethodOptions: true,
+	fasthttp.MethodTrace:   true,
+	fasthttp.MethodPut:     true,
+	fasthttp.MethodDelete:  true,
+}
+
+// retryPolicy decides whether and when a failed upstream request is
+// attempted again.
+type retryPolicy struct {
+	maxAttempts   int
+	backoff       time.Duration
+	maxBackoff    time.Duration
+	on            map[string]bool
+	statuses      map[int]bool
+	nonIdempotent bool
+}
+
+// newRetryPolicy builds a policy from configuration.
+func newRetryPolicy(cfg config.RetryConfig) *retryPolicy {
+	p := &retryPolicy{
+		maxAttempts:   cfg.MaxAttempts,
+		backoff:       cfg.Backoff,
+		maxBackoff:    cfg.MaxBackoff,
+		on:            make(map[string]bool, len(cfg.RetryOn)),
+		statuses:      make(map[int]bool, len(cfg.RetryStatuses)),
+		nonIdempotent: cfg.RetryNonIdempotent,
+	}
+	if p.maxAttempts < 1 {
+		p.maxAttempts = 1
+	}
+	for _, on := range cfg.RetryOn {
+		p.on[on] = true
+	}
+	for _, code := range cfg.RetryStatuses {
+		p.statuses[code] = true
+	}
+	return p
+}
+
+// replayable reports whether req may be sent more than once.
+func (p *retryPolicy) replayable(req *fasthttp.Request) bool {
+	if idempotentMethods[string(req.Header.Method())] {
+		return true
+	}
+	// Buffered bodies can be resent as-is; streamed ones are consumed.
+	return p.nonIdempotent && !req.IsBodyStream()
+}
+
+// reason returns why the outcome of an attempt should be retried, or ""
+// if it should not.
+func (p *retryPolicy) reason(err error, status int) string {
+	if err == nil {
+		if p.statuses[status] {
+			return retryStatus
+		}
+		return ""
+	}
+	if cond := classifyError(err); p.on[cond] {
+		return cond
+	}
+	return ""
+}
+
+// delay returns the pause before retry number n (1-based): exponential
+// backoff capped at maxBackoff, with the upper half randomised so that
+// clients retrying together spread out.
+func (p *retryPolicy) delay(n int) time.Duration {
+	d := p.backoff << (n - 1)
+	if d <= 0 || (p.maxBackoff > 0 && d > p.maxBackoff) {
+		d = p.maxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
+
+// classifyError maps an upstream error to a retry condition.
+func classifyError(err error) string {
+	var opErr *net.OpError
+	switch {
+	case errors.As(err, &opErr) && opErr.Op == "dial",
+		errors.Is(err, fasthttp.ErrDialTimeout),
+		errors.Is(err, syscall.ECONNREFUSED):
+		return retryConnect
+	case errors.Is(err, fasthttp.ErrConnectionClosed),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.EPIPE),
+		errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF):
+		return retryReset
+	case errors.Is(err, fasthttp.ErrTimeout):
+		return retryTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return retryTimeout
+	}
+	return ""
+}
@@ -0,0 +1,275 @@
+package handler
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/valyala/fasthttp"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/auth"
+)
+
+// SOCKS5 protocol values (RFC 1928, RFC 1929).
+const (
+	socksVersion = 0x05
+
+	socksMethodNone     = 0x00
+	socksMethodPassword = 0x02
+	socksNoMethod       = 0xff
+
+	socksPasswordVersion = 0x01
+
+	socksCmdConnect = 0x01
+
+	socksAddrIPv4   = 0x01
+	socksAddrDomain = 0x03
+	socksAddrIPv6   = 0x04
+
+	socksSucceeded        = 0x00
+	socksGeneralFailure   = 0x01
+	socksNotAllowed       = 0x02
+	socksHostUnreachable  = 0x04
+	socksCmdNotSupported  = 0x07
+	socksAddrNotSupported = 0x08
+)
+
+// errSOCKSVersion rejects clients that do not speak SOCKS5.
+var errSOCKSVersion = errors.New("not a SOCKS5 client")
+
+// ServeSOCKS serves a SOCKS5 client on c: CONNECT only, authenticated
+// with the username/password method when the listener's auth is enabled.
+// The handshake must finish within timeout, if it is positive. It
+// returns when the tunnel closes, closing c.
+func (l *Listener) ServeSOCKS(c net.Conn, timeout time.Duration) {
+	start := time.Now()
+	if timeout > 0 {
+		c.SetDeadline(start.Add(timeout))
+	}
+	br := bufio.NewReader(c)
+	id, host, err := l.socksHandshake(c, br)
+	if err != nil {
+		l.h.metrics.RecordError("tunnel", "socks_handshake")
+		l.h.logger.Debugw("SOCKS5 handshake failed", append([]interface{}{
+			"client", c.RemoteAddr().String(),
+			"error", err,
+		}, peerFields(c)...)...)
+		c.Close()
+		return
+	}
+	c.SetDeadline(time.Time{})
+
+	l.serveConn(&connRequest{
+		conn:  &bufferedConn{Conn: c, r: br},
+		proto: "SOCKS5",
+		host:  host,
+		id:    id,
+		start: start,
+		reply: func(status int, bound net.Addr) error {
+			return writeSOCKSReply(c, socksReplyCode(status), bound)
+		},
+	})
+}
+
+// socksHandshake negotiates the method, authenticates the client and
+// reads its request. It returns the identity and the host:port to
+// connect to, having answered the client itself if it failed.
+func (l *Listener) socksHandshake(c net.Conn, br *bufio.Reader) (auth.Identity, string, error) {
+	var id auth.Identity
+	var hdr [2]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return id, "", err
+	}
+	if hdr[0] != socksVersion {
+		return id, "", errSOCKSVersion
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return id, "", err
+	}
+
+	// Offer the password method whenever the client does, so that
+	// usernames carry session IDs even without authentication.
+	method := byte(socksNoMethod)
+	for _, m := range methods {
+		if m == socksMethodPassword {
+			method = socksMethodPassword
+			break
+		}
+		if m == socksMethodNone && !l.auth.Enabled() {
+			method = socksMethodNone
+		}
+	}
+	if _, err := c.Write([]byte{socksVersion, method}); err != nil {
+		return id, "", err
+	}
+	switch method {
+	case socksNoMethod:
+		return id, "", errors.New("no acceptable authentication method")
+	case socksMethodNone:
+		id, _ = l.auth.Check("", "", false)
+	case socksMethodPassword:
+		user, pass, err := readSOCKSPassword(br)
+		if err != nil {
+			return id, "", err
+		}
+		var ok bool
+		id, ok = l.auth.Check(user, pass, true)
+		status := byte(0)
+		if !ok {
+			status = 1
+		}
+		if _, err := c.Write([]byte{socksPasswordVersion, status}); err != nil {
+			return id, "", err
+		}
+		if !ok {
+			l.h.metrics.RecordRequest(fasthttp.MethodConnect, "407", "tunnel", 0)
+			l.h.metrics.RecordError("tunnel", "auth_failed")
+			return id, "", fmt.Errorf("authentication failed for user %q", id.User)
+		}
+	}
+
+	var req [4]byte
+	if _, err := io.ReadFull(br, req[:]); err != nil {
+		return id, "", err
+	}
+	if req[0] != socksVersion {
+		return id, "", errSOCKSVersion
+	}
+	host, err := readSOCKSAddr(br, req[3])
+	if err != nil {
+		if errors.Is(err, errSOCKSAddrType) {
+			writeSOCKSReply(c, socksAddrNotSupported, nil)
+		}
+		return id, "", err
+	}
+	if req[1] != socksCmdConnect {
+		writeSOCKSReply(c, socksCmdNotSupported, nil)
+		return id, "", fmt.Errorf("unsupported command %d", req[1])
+	}
+	return id, host, nil
+}
+
+// readSOCKSPassword reads a username/password request (RFC 1929).
+func readSOCKSPassword(br *bufio.Reader) (user, pass string, err error) {
+	ver, err := br.ReadByte()
+	if err != nil {
+		return "", "", err
+	}
+	if ver != socksPasswordVersion {
+		return "", "", fmt.Errorf("unknown password auth version %d", ver)
+	}
+	if user, err = readSOCKSString(br); err != nil {
+		return "", "", err
+	}
+	if pass, err = readSOCKSString(br); err != nil {
+		return "", "", err
+	}
+	return user, pass, nil
+}
+
+// readSOCKSString reads a string prefixed with its length in one byte.
+func readSOCKSString(br *bufio.Reader) (string, error) {
+	n, err := br.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(br, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// errSOCKSAddrType rejects requests with an unknown address type.
+var errSOCKSAddrType = errors.New("unsupported address type")
+
+// readSOCKSAddr reads an address and port of type atyp as host:port.
+func readSOCKSAddr(br *bufio.Reader, atyp byte) (string, error) {
+	var host string
+	switch atyp {
+	case socksAddrIPv4, socksAddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if atyp == socksAddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(br, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksAddrDomain:
+		name, err := readSOCKSString(br)
+		if err != nil {
+			return "", err
+		}
+		host = name
+	default:
+		return "", errSOCKSAddrType
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(br, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// writeSOCKSReply answers a request with code and the bound address,
+// which is all zeros if bound is not a TCP address.
+func writeSOCKSReply(c net.Conn, code byte, bound net.Addr) error {
+	ip, port := net.IP(net.IPv4zero.To4()), 0
+	if addr, ok := bound.(*net.TCPAddr); ok {
+		ip, port = addr.IP, addr.Port
+	}
+	b := []byte{socksVersion, code, 0}
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(append(b, socksAddrIPv4), ip4...)
+	} else {
+		b = append(append(b, socksAddrIPv6), ip.To16()...)
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(port))
+	_, err := c.Write(b)
+	return err
+}
+
+// socksReplyCode maps the HTTP status a CONNECT would get to a SOCKS5
+// reply code.
+func socksReplyCode(status int) byte {
+	switch status {
+	case fasthttp.StatusOK:
+		return socksSucceeded
+	case fasthttp.StatusTooManyRequests, fasthttp.StatusForbidden:
+		return socksNotAllowed
+	case fasthttp.StatusBadGateway, fasthttp.StatusGatewayTimeout:
+		return socksHostUnreachable
+	}
+	return socksGeneralFailure
+}
+
+// bufferedConn is a connection whose first bytes were read into r.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// NetConn returns the underlying connection.
+func (c *bufferedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// CloseWrite shuts down the writing side if the underlying connection
+// supports it.
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("half-close not supported")
+}
@@ -0,0 +1,103 @@
+package handler
+
+import (
+	"net"
+	"time"
+)
+
+// ServeTransparent serves a connection redirected to the listener by the
+// firewall, tunnelling it to the destination the client originally
+// dialed. Clients do not know they are proxied, so they are not asked to
+// authenticate. Connections whose destination is the proxy itself, such
+// as those made straight to the listener, are refused rather than looped
+// back. It returns when the tunnel closes, closing c.
+func (l *Listener) ServeTransparent(c net.Conn) {
+	start := time.Now()
+	dst, err := originalDst(c)
+	if err != nil {
+		l.h.metrics.RecordError("tunnel", "original_destination")
+		l.h.logger.Debugw("no original destination for redirected connection",
+			"client", c.RemoteAddr().String(),
+			"error", err,
+		)
+		c.Close()
+		return
+	}
+	if l.h.isSelf(dst, c.LocalAddr()) {
+		l.h.metrics.RecordError("tunnel", "proxy_loop")
+		l.h.logger.Debugw("refused redirected connection to the proxy itself",
+			"client", c.RemoteAddr().String(),
+			"destination", dst.String(),
+		)
+		c.Close()
+		return
+	}
+
+	id, _ := l.auth.Check("", "", false)
+	l.serveConn(&connRequest{
+		conn:  c,
+		proto: "transparent",
+		host:  dst.String(),
+		id:    id,
+		start: start,
+		reply: func(int, net.Addr) error { return nil },
+	})
+}
+
+// selfAddrs are the TCP addresses the proxy listens on and, for those
+// bound to the unspecified address, the IP addresses of the host.
+type selfAddrs struct {
+	listen []*net.TCPAddr
+	local  []net.IP
+}
+
+// SetListenAddrs tells the handler the addresses the proxy listens on,
+// so that transparent connections to them are refused. Addresses that
+// are not TCP are ignored.
+func (h *Handler) SetListenAddrs(addrs []net.Addr) {
+	s := &selfAddrs{}
+	for _, a := range addrs {
+		if tcp, ok := a.(*net.TCPAddr); ok {
+			s.listen = append(s.listen, tcp)
+		}
+	}
+	if ifaddrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range ifaddrs {
+			if n, ok := a.(*net.IPNet); ok {
+				s.local = append(s.local, n.IP)
+			}
+		}
+	}
+	h.self.Store(s)
+}
+
+// isSelf reports whether dst is local, the address a connection was
+// accepted on, or an address the proxy listens on.
+func (h *Handler) isSelf(dst *net.TCPAddr, local net.Addr) bool {
+	if l, ok := local.(*net.TCPAddr); ok && l.IP.Equal(dst.IP) && l.Port == dst.Port {
+		return true
+	}
+	s := h.self.Load()
+	if s == nil {
+		return false
+	}
+	for _, a := range s.listen {
+		if a.Port != dst.Port {
+			continue
+		}
+		if a.IP.Equal(dst.IP) || (a.IP.IsUnspecified() && (dst.IP.IsLoopback() || s.isLocal(dst.IP))) {
+			return true
+		}
+	}
+	return false
+}
+
+// isLocal reports whether ip is one of the host's addresses.
+func (s *selfAddrs) isLocal(ip net.IP) bool {
+	for _, l := range s.local {
+		if l.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,358 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/accesslog"
+	"github.com/yigitkonur/proxy-http-forward/pkg/bandwidth"
+	"github.com/yigitkonur/proxy-http-forward/pkg/config"
+	"github.com/yigitkonur/proxy-http-forward/pkg/quota"
+)
+
+// Tunnel close reasons, reported in logs and proxy_tunnel_closes_total.
+const (
+	closeClientEOF = "client_eof" // the client finished sending
+	closeServerEOF = "server_eof" // the destination finished sending
+	closeIdle      = "idle"       // no traffic for tunnel_idle
+	closeLifetime  = "lifetime"   // open for tunnel_lifetime
+	closeShutdown  = "shutdown"   // the proxy is shutting down
+	closeQuota     = "quota"      // the user used up a traffic quota
+	closeError     = "error"      // a read or write failed
+)
+
+// tunnelInfo describes a tunnel to run.
+type tunnelInfo struct {
+	host      string
+	user      string // verified user for per-user limits, "" if none
+	start     time.Time
+	timeouts  config.TimeoutConfig // tunnel limits in effect for the destination
+	forwarded int64                // client bytes already sent to the destination
+	access    *accesslog.Entry     // completed and logged when the tunnel closes
+}
+
+// tunnel creates a bidirectional tunnel between client and destination.
+// When one side finishes sending, the other is told with a half-close
+// and the opposite direction keeps flowing until it finishes too.
+func (h *Handler) tunnel(clientConn, destConn net.Conn, info tunnelInfo) {
+	defer clientConn.Close()
+	defer destConn.Close()
+
+	bw := h.shaper.Conn(info.user)
+	defer bw.Close()
+
+	t := &tunnelState{timer: newTunnelTimer(clientConn, destConn, info.timeouts, info.start)}
+	if !h.tunnels.add(t) {
+		// Shutdown began between the CONNECT and the hijack.
+		return
+	}
+	defer h.tunnels.remove(t)
+	h.metrics.IncrementTunnels()
+	defer h.metrics.DecrementTunnels()
+	h.quotas.Add(info.user, info.forwarded)
+
+	var wg sync.WaitGroup
+	var clientToServer, serverToClient int64
+
+	// Keep the ClientHello for the access log, unless its server name is
+	// already known
+	var hello *helloRecorder
+	e := info.access
+	upload := h.quotas.Reader(info.user, t.timer.reader(clientConn))
+	if e.SNI == "" && info.forwarded == 0 && h.access.Wants("sni") {
+		hello = &helloRecorder{r: upload}
+		upload = hello
+	}
+
+	// Client -> Server
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		src := bw.Reader(bandwidth.Upload, upload)
+		clientToServer = info.forwarded + t.pipe(destConn, src, closeClientEOF)
+	}()
+
+	// Server -> Client
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		src := bw.Reader(bandwidth.Download, h.quotas.Reader(info.user, t.timer.reader(destConn)))
+		serverToClient = t.pipe(clientConn, src, closeServerEOF)
+	}()
+
+	wg.Wait()
+
+	// Record metrics
+	duration := time.Since(info.start).Seconds()
+	reason := t.closeReason()
+	h.metrics.RecordRequest("CONNECT", "200", "tunnel", duration)
+	h.metrics.RecordTunnelClose(reason)
+	h.metrics.BytesSent.WithLabelValues("tunnel").Add(float64(serverToClient))
+	h.metrics.BytesReceived.WithLabelValues("tunnel").Add(float64(clientToServer))
+
+	h.logger.Debugw("tunnel closed", append([]interface{}{
+		"host", info.host,
+		"egress_ip", localIP(destConn),
+		"reason", reason,
+		"duration", duration,
+		"bytes_sent", serverToClient,
+		"bytes_received", clientToServer,
+	}, peerFields(clientConn)...)...)
+
+	if h.access != nil {
+		if hello != nil {
+			e.SNI = readServerName(clientConn, bytes.NewReader(hello.data))
+		}
+		e.Status = fasthttp.StatusOK
+		e.Duration = time.Since(info.start)
+		e.BytesSent, e.BytesRecv = serverToClient, clientToServer
+		e.CloseReason = reason
+		h.access.Log(e)
+	}
+}
+
+// DrainTunnels stops new tunnels from being opened and waits for open
+// ones to finish until ctx is done. Tunnels still open then are closed
+// with reason "shutdown". It returns how many tunnels finished on their
+// own and how many were closed.
+func (h *Handler) DrainTunnels(ctx context.Context) (drained, closed int) {
+	return h.tunnels.drain(ctx)
+}
+
+// CloseTunnels stops new tunnels from being opened and closes all open
+// ones immediately.
+func (h *Handler) CloseTunnels() {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	h.tunnels.drain(ctx)
+}
+
+// errShuttingDown rejects CONNECT requests once tunnels are draining.
+var errShuttingDown = errors.New("proxy is shutting down")
+
+// tunnelRegistry tracks open tunnels so that shutdown can drain them.
+type tunnelRegistry struct {
+	mu       sync.Mutex
+	open     map[*tunnelState]struct{}
+	draining bool
+	wg       sync.WaitGroup
+}
+
+func newTunnelRegistry() *tunnelRegistry {
+	return &tunnelRegistry{open: make(map[*tunnelState]struct{})}
+}
+
+// accepting reports whether new tunnels may be opened.
+func (r *tunnelRegistry) accepting() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !r.draining
+}
+
+// add registers t, or returns false once draining has begun.
+func (r *tunnelRegistry) add(t *tunnelState) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.draining {
+		return false
+	}
+	r.open[t] = struct{}{}
+	r.wg.Add(1)
+	return true
+}
+
+// remove unregisters t once it has fully closed.
+func (r *tunnelRegistry) remove(t *tunnelState) {
+	r.mu.Lock()
+	delete(r.open, t)
+	r.mu.Unlock()
+	r.wg.Done()
+}
+
+// drain implements Handler.DrainTunnels.
+func (r *tunnelRegistry) drain(ctx context.Context) (drained, closed int) {
+	r.mu.Lock()
+	r.draining = true
+	total := len(r.open)
+	r.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return total, 0
+	case <-ctx.Done():
+	}
+
+	r.mu.Lock()
+	closed = len(r.open)
+	for t := range r.open {
+		t.abort(closeShutdown)
+	}
+	r.mu.Unlock()
+
+	<-done
+	return total - closed, closed
+}
+
+// tunnelState records why a tunnel closed. The first reason wins, except
+// that a forced close (idle, lifetime, shutdown, error) replaces an
+// earlier EOF in one direction, since it is what ended the other.
+type tunnelState struct {
+	timer *tunnelTimer
+
+	mu     sync.Mutex
+	reason string
+	forced bool
+}
+
+// pipe copies src, read from the other end of the tunnel, to dst until
+// src is done, then half-closes dst, or on failure, stops the whole
+// tunnel. It returns the bytes copied.
+func (t *tunnelState) pipe(dst net.Conn, src io.Reader, eofReason string) int64 {
+	n, err := io.Copy(dst, src)
+	var netErr net.Error
+	switch {
+	case err == nil:
+		if !closeWrite(dst) {
+			// Without half-close the peer would never see the end.
+			t.abort(eofReason)
+			break
+		}
+		t.setReason(eofReason, false)
+	case errors.Is(err, quota.ErrExceeded):
+		t.abort(closeQuota)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		t.abort(t.timer.expired())
+	default:
+		t.abort(closeError)
+	}
+	return n
+}
+
+// abort records reason and unblocks both directions.
+func (t *tunnelState) abort(reason string) {
+	t.setReason(reason, true)
+	t.timer.stop()
+}
+
+func (t *tunnelState) setReason(reason string, forced bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.reason == "" || (forced && !t.forced) {
+		t.reason, t.forced = reason, forced
+	}
+}
+
+func (t *tunnelState) closeReason() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.reason
+}
+
+// closeWrite half-closes conn if it supports it.
+func closeWrite(conn net.Conn) bool {
+	// Hijacked connections wrap the TCP connection.
+	if u, ok := conn.(interface{ UnsafeConn() net.Conn }); ok {
+		conn = u.UnsafeConn()
+	}
+	cw, ok := conn.(interface{ CloseWrite() error })
+	return ok && cw.CloseWrite() == nil
+}
+
+// tunnelTimer enforces the idle and lifetime limits of a tunnel. Whenever
+// either end delivers data, the read deadlines of both ends move to idle
+// from now, capped at the lifetime deadline.
+type tunnelTimer struct {
+	conns    [2]net.Conn
+	idle     time.Duration
+	lifetime time.Time // zero for none
+
+	// mu orders deadline changes so that none made after stop undoes it.
+	mu      sync.Mutex
+	stopped bool
+}
+
+// newTunnelTimer arms the limits in t for a tunnel between a and b that
+// started at start.
+func newTunnelTimer(a, b net.Conn, t config.TimeoutConfig, start time.Time) *tunnelTimer {
+	tt := &tunnelTimer{conns: [2]net.Conn{a, b}, idle: t.TunnelIdle}
+	if t.TunnelLifetime > 0 {
+		tt.lifetime = start.Add(t.TunnelLifetime)
+		a.SetWriteDeadline(tt.lifetime)
+		b.SetWriteDeadline(tt.lifetime)
+	}
+	tt.touch()
+	return tt
+}
+
+// touch records activity.
+func (t *tunnelTimer) touch() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopped {
+		return
+	}
+	d := t.lifetime
+	if t.idle > 0 {
+		if next := time.Now().Add(t.idle); d.IsZero() || next.Before(d) {
+			d = next
+		}
+	}
+	for _, c := range t.conns {
+		c.SetReadDeadline(d)
+	}
+}
+
+// stop expires both ends immediately, ending any blocked reads and writes.
+func (t *tunnelTimer) stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stopped = true
+	past := time.Unix(1, 0)
+	for _, c := range t.conns {
+		c.SetDeadline(past)
+	}
+}
+
+// expired returns which limit a timed-out read ran into.
+func (t *tunnelTimer) expired() string {
+	if !t.lifetime.IsZero() && !time.Now().Before(t.lifetime) {
+		return closeLifetime
+	}
+	return closeIdle
+}
+
+// reader returns c as a reader that records activity. Without an idle
+// limit c is returned as is, keeping io.Copy's zero-copy paths.
+func (t *tunnelTimer) reader(c net.Conn) io.Reader {
+	if t.idle <= 0 {
+		return c
+	}
+	return &activityReader{r: c, timer: t}
+}
+
+// activityReader touches its timer after every read that returns data.
+type activityReader struct {
+	r     io.Reader
+	timer *tunnelTimer
+}
+
+func (a *activityReader) Read(b []byte) (int, error) {
+	n, err := a.r.Read(b)
+	if n > 0 {
+		a.timer.touch()
+	}
+	return n, err
+}
@@ -15,6 +15,8 @@ import (
 type Logger struct {
 	*zap.Logger
 	sugar *zap.SugaredLogger
+	level zap.AtomicLevel
+	out   zapcore.WriteSyncer
 }
 
 // New creates a new Logger based on the provided configuration.
@@ -48,17 +50,20 @@ func New(cfg config.LoggingConfig) (*Logger, error) {
 		encoder = zapcore.NewConsoleEncoder(encoderConfig)
 	}
 
-	output, err := getOutput(cfg.Output)
+	output, err := Output(cfg.Output, cfg.Rotation)
 	if err != nil {
 		return nil, err
 	}
 
-	core := zapcore.NewCore(encoder, output, level)
+	atomicLevel := zap.NewAtomicLevelAt(level)
+	core := zapcore.NewCore(encoder, output, atomicLevel)
 	logger := zap.New(core, zap.AddCaller(), zap.AddStacktrace(zapcore.ErrorLevel))
 
 	return &Logger{
 		Logger: logger,
 		sugar:  logger.Sugar(),
+		level:  atomicLevel,
+		out:    output,
 	}, nil
 }
 
@@ -67,12 +72,31 @@ func (l *Logger) Sugar() *zap.SugaredLogger {
 	return l.sugar
 }
 
+// SetLevel changes the minimum level logged. It applies to this logger
+// and every logger derived from it.
+func (l *Logger) SetLevel(level string) error {
+	lvl, err := parseLevel(level)
+	if err != nil {
+		return err
+	}
+	l.level.SetLevel(lvl)
+	return nil
+}
+
+// Reopen reopens the output if it is a file, for use after an external
+// tool moved it away.
+func (l *Logger) Reopen() error {
+	return Reopen(l.out)
+}
+
 // With creates a child logger with additional fields.
 func (l *Logger) With(fields ...zap.Field) *Logger {
 	newLogger := l.Logger.With(fields...)
 	return &Logger{
 		Logger: newLogger,
 		sugar:  newLogger.Sugar(),
+		level:  l.level,
+		out:    l.out,
 	}
 }
 
@@ -81,7 +105,7 @@ func parseLevel(level string) (zapcore.Level, error) {
 	switch level {
 	case "debug":
 		return zapcore.DebugLevel, nil
-	case "info":
+	case "info", "":
 		return zapcore.InfoLevel, nil
 	case "warn", "warning":
 		return zapcore.WarnLevel, nil
@@ -94,18 +118,24 @@ func parseLevel(level string) (zapcore.Level, error) {
 	}
 }
 
-// getOutput returns the appropriate output writer.
-func getOutput(output string) (zapcore.WriteSyncer, error) {
+// Output opens a log destination: stdout, stderr or a file path. Files
+// are rotated as rot says.
+func Output(output string, rot config.RotationConfig) (zapcore.WriteSyncer, error) {
 	switch output {
 	case "stdout", "":
 		return zapcore.AddSync(os.Stdout), nil
 	case "stderr":
 		return zapcore.AddSync(os.Stderr), nil
 	default:
-		file, err := os.OpenFile(output, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
-			return nil, fmt.Errorf("failed to open log file %s: %w", output, err)
-		}
-		return zapcore.AddSync(file), nil
+		return OpenFile(output, rot)
+	}
+}
+
+// Reopen reopens out if it was opened by Output for a file, and does
+// nothing otherwise.
+func Reopen(out zapcore.WriteSyncer) error {
+	if f, ok := out.(*File); ok {
+		return f.Reopen()
 	}
+	return nil
 }
@@ -0,0 +1,238 @@
+package log
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/config"
+)
+
+// backupFormat is the timestamp appended to the name of a rotated file.
+// It sorts in time order.
+const backupFormat = "2006-01-02T15-04-05.000"
+
+// File is a log file that rotates itself by size and time, keeping a
+// limited number of compressed backups, and that can be reopened after
+// an external tool such as logrotate moved it away.
+type File struct {
+	path string
+	cfg  config.RotationConfig
+
+	mu      sync.Mutex
+	f       *os.File
+	size    int64
+	started time.Time // when the current file got its first line
+
+	millMu sync.Mutex // serializes compression and cleanup of backups
+}
+
+// OpenFile opens path for appending, rotating it as cfg says.
+func OpenFile(path string, cfg config.RotationConfig) (*File, error) {
+	f := &File{path: path, cfg: cfg}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Write appends b, rotating the file first if b would take it over the
+// size limit or the rotation interval has passed.
+func (f *File) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.f == nil {
+		return 0, os.ErrClosed
+	}
+	now := time.Now()
+	if f.size > 0 && f.due(len(b), now) {
+		if err := f.rotate(now); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.f.Write(b)
+	if f.size == 0 {
+		f.started = now
+	}
+	f.size += int64(n)
+	return n, err
+}
+
+// Sync commits the file to disk.
+func (f *File) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.f == nil {
+		return os.ErrClosed
+	}
+	return f.f.Sync()
+}
+
+// Reopen opens path again, starting a new file if the old one was moved
+// away. If that fails, writes keep going to the old file.
+func (f *File) Reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.open()
+}
+
+// Rotate moves the file aside and starts a new one.
+func (f *File) Rotate() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.f == nil {
+		return os.ErrClosed
+	}
+	return f.rotate(time.Now())
+}
+
+// Close closes the file.
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.f == nil {
+		return nil
+	}
+	err := f.f.Close()
+	f.f = nil
+	return err
+}
+
+// open opens path for appending and, once it is open, closes the file
+// it replaces. The caller must hold f.mu.
+func (f *File) open() error {
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file %s: %w", f.path, err)
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if f.f != nil {
+		f.f.Close()
+	}
+	f.f, f.size, f.started = file, fi.Size(), fi.ModTime()
+	return nil
+}
+
+// due reports whether writing n bytes at now should start a new file.
+// The caller must hold f.mu.
+func (f *File) due(n int, now time.Time) bool {
+	if f.cfg.MaxSize > 0 && f.size+int64(n) > f.cfg.MaxSize {
+		return true
+	}
+	// Intervals are aligned to the zero time, so 24h turns at midnight UTC.
+	if i := f.cfg.Interval; i > 0 && !now.Truncate(i).Equal(f.started.Truncate(i)) {
+		return true
+	}
+	return false
+}
+
+// rotate renames the file to a backup and opens a new one, then
+// compresses and prunes backups in the background. The caller must hold
+// f.mu.
+func (f *File) rotate(now time.Time) error {
+	f.f.Close()
+	f.f = nil
+	backup := f.path + "." + now.Format(backupFormat)
+	if err := os.Rename(f.path, backup); err != nil && !os.IsNotExist(err) {
+		// Keep logging to the old file rather than losing lines.
+		if oerr := f.open(); oerr != nil {
+			return oerr
+		}
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	go f.mill()
+	return nil
+}
+
+// mill compresses backups if configured and removes those past the
+// retention limits.
+func (f *File) mill() {
+	f.millMu.Lock()
+	defer f.millMu.Unlock()
+
+	backups := f.backups()
+	if f.cfg.Compress {
+		for i, b := range backups {
+			if strings.HasSuffix(b, ".gz") {
+				continue
+			}
+			if err := compress(b); err == nil {
+				backups[i] = b + ".gz"
+			}
+		}
+	}
+
+	// Newest first
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+	cutoff := time.Now().Add(-f.cfg.MaxAge)
+	for i, b := range backups {
+		if f.cfg.MaxBackups > 0 && i >= f.cfg.MaxBackups {
+			os.Remove(b)
+			continue
+		}
+		if f.cfg.MaxAge > 0 {
+			if fi, err := os.Stat(b); err == nil && fi.ModTime().Before(cutoff) {
+				os.Remove(b)
+			}
+		}
+	}
+}
+
+// backups lists the rotated files of f.
+func (f *File) backups() []string {
+	matches, _ := filepath.Glob(f.path + ".*")
+	var backups []string
+	for _, m := range matches {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(m, f.path+"."), ".gz")
+		if _, err := time.ParseInLocation(backupFormat, stamp, time.Local); err == nil {
+			backups = append(backups, m)
+		}
+	}
+	return backups
+}
+
+// compress replaces path with a gzipped copy.
+func compress(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+	// Keep the backup's time for max_age.
+	if fi, err := in.Stat(); err == nil {
+		os.Chtimes(out.Name(), fi.ModTime(), fi.ModTime())
+	}
+	return os.Remove(path)
+}
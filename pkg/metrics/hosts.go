@@ -0,0 +1,126 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// OtherHost is the label that hosts outside the top N are folded into.
+const OtherHost = "other"
+
+// HostStat holds connection statistics for one upstream host.
+type HostStat struct {
+	Host     string `json:"host"`
+	Open     int    `json:"open_conns"`
+	Idle     int    `json:"idle_conns"`
+	Pending  int    `json:"pending_requests"`
+	Requests uint64 `json:"requests"`
+	Dials    uint64 `json:"dials"`
+}
+
+// ReuseRatio returns the fraction of requests that reused a connection.
+func (s HostStat) ReuseRatio() float64 {
+	if s.Requests == 0 || s.Dials >= s.Requests {
+		return 0
+	}
+	return 1 - float64(s.Dials)/float64(s.Requests)
+}
+
+// TopHosts keeps the n busiest hosts, ranked by open connections plus
+// pending requests and then by request count, and folds the rest into a
+// single OtherHost entry. With n <= 0 all hosts are kept.
+func TopHosts(stats []HostStat, n int) []HostStat {
+	sorted := make([]HostStat, len(stats))
+	copy(sorted, stats)
+	sort.Slice(sorted, func(i, j int) bool {
+		li, lj := sorted[i].Open+sorted[i].Pending, sorted[j].Open+sorted[j].Pending
+		if li != lj {
+			return li > lj
+		}
+		if sorted[i].Requests != sorted[j].Requests {
+			return sorted[i].Requests > sorted[j].Requests
+		}
+		return sorted[i].Host < sorted[j].Host
+	})
+	if n <= 0 || len(sorted) <= n {
+		return sorted
+	}
+
+	other := HostStat{Host: OtherHost}
+	for _, s := range sorted[n:] {
+		other.Open += s.Open
+		other.Idle += s.Idle
+		other.Pending += s.Pending
+		other.Requests += s.Requests
+		other.Dials += s.Dials
+	}
+	return append(sorted[:n], other)
+}
+
+// hostCollector exports per-host statistics on every scrape, so series
+// for hosts that drop out of the top N disappear rather than going stale.
+type hostCollector struct {
+	stats func() []HostStat
+	topN  int
+
+	open    *prometheus.Desc
+	idle    *prometheus.Desc
+	pending *prometheus.Desc
+	reuse   *prometheus.Desc
+}
+
+// RegisterHostStats exports the per-host statistics returned by stats,
+// limited to the topN busiest hosts plus an "other" bucket.
+func (m *Metrics) RegisterHostStats(stats func() []HostStat, topN int) error {
+	labels := []string{"host"}
+	c := &hostCollector{
+		stats: stats,
+		topN:  topN,
+		open: prometheus.NewDesc("proxy_upstream_open_connections",
+			"Open upstream connections per host", labels, nil),
+		idle: prometheus.NewDesc("proxy_upstream_idle_connections",
+			"Idle keep-alive upstream connections per host", labels, nil),
+		pending: prometheus.NewDesc("proxy_upstream_pending_requests",
+			"Requests waiting for an upstream connection per host", labels, nil),
+		reuse: prometheus.NewDesc("proxy_upstream_connection_reuse_ratio",
+			"Fraction of requests per host served on a reused connection", labels, nil),
+	}
+	return prometheus.Register(c)
+}
+
+func (c *hostCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.open
+	ch <- c.idle
+	ch <- c.pending
+	ch <- c.reuse
+}
+
+func (c *hostCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, s := range TopHosts(c.stats(), c.topN) {
+		ch <- prometheus.MustNewConstMetric(c.open, prometheus.GaugeValue, float64(s.Open), s.Host)
+		ch <- prometheus.MustNewConstMetric(c.idle, prometheus.GaugeValue, float64(s.Idle), s.Host)
+		ch <- prometheus.MustNewConstMetric(c.pending, prometheus.GaugeValue, float64(s.Pending), s.Host)
+		ch <- prometheus.MustNewConstMetric(c.reuse, prometheus.GaugeValue, s.ReuseRatio(), s.Host)
+	}
+}
+
+// hostStatsHandler serves per-host statistics as JSON.
+func hostStatsHandler(stats func() []HostStat, topN int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		type entry struct {
+			HostStat
+			ReuseRatio float64 `json:"reuse_ratio"`
+		}
+		top := TopHosts(stats(), topN)
+		out := make([]entry, len(top))
+		for i, s := range top {
+			out[i] = entry{HostStat: s, ReuseRatio: s.ReuseRatio()}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	})
+}
@@ -2,6 +2,7 @@
 package metrics
 
 import (
+	"net"
 	"net/http"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -20,6 +21,19 @@ type Metrics struct {
 	BytesReceived     *prometheus.CounterVec
 	ErrorsTotal       *prometheus.CounterVec
 	TunnelConnections prometheus.Gauge
+	DialFamily        *prometheus.CounterVec
+	ActiveSessions    prometheus.Gauge
+	RetriesTotal      *prometheus.CounterVec
+	BreakerState      *prometheus.GaugeVec
+	TunnelCloses      *prometheus.CounterVec
+	RateLimited       *prometheus.CounterVec
+	Throughput        *prometheus.CounterVec
+	ThrottledSeconds  *prometheus.CounterVec
+	InFlight          *prometheus.GaugeVec
+	QueueDepth        *prometheus.GaugeVec
+	QueueWait         *prometheus.HistogramVec
+	ConcurrencyLimit  *prometheus.GaugeVec
+	Shed              *prometheus.CounterVec
 }
 
 // New creates and registers all metrics.
@@ -80,6 +94,110 @@ func New() *Metrics {
 				Help:      "Number of active CONNECT tunnel connections",
 			},
 		),
+		DialFamily: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "proxy",
+				Name:      "dial_family_total",
+				Help:      "Successful upstream dials by winning address family",
+			},
+			[]string{"family"},
+		),
+		ActiveSessions: promauto.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "proxy",
+				Name:      "active_sessions",
+				Help:      "Number of sticky egress sessions in the session table",
+			},
+		),
+		RetriesTotal: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "proxy",
+				Name:      "retries_total",
+				Help:      "Total number of upstream request retries",
+			},
+			[]string{"type", "reason"},
+		),
+		BreakerState: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "proxy",
+				Name:      "circuit_breaker_state",
+				Help:      "Circuit breaker state per upstream host (1 = open, 2 = half-open); closed breakers are not exported",
+			},
+			[]string{"host"},
+		),
+		TunnelCloses: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "proxy",
+				Name:      "tunnel_closes_total",
+				Help:      "Total number of closed CONNECT tunnels by close reason",
+			},
+			[]string{"reason"},
+		),
+		RateLimited: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "proxy",
+				Name:      "rate_limited_total",
+				Help:      "Total number of requests and tunnels rejected by a rate limit rule",
+			},
+			[]string{"rule", "type"},
+		),
+		Throughput: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "proxy",
+				Name:      "throughput_bytes_total",
+				Help:      "Bytes relayed through tunnels and HTTP bodies, counted as they flow",
+			},
+			[]string{"direction"},
+		),
+		ThrottledSeconds: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "proxy",
+				Name:      "bandwidth_throttled_seconds_total",
+				Help:      "Time transfers waited for bandwidth, by the limit that held them back",
+			},
+			[]string{"direction", "level"},
+		),
+		InFlight: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "proxy",
+				Name:      "in_flight",
+				Help:      "Plain HTTP requests being handled and CONNECT tunnels open, holding a concurrency slot",
+			},
+			[]string{"type"},
+		),
+		QueueDepth: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "proxy",
+				Name:      "queue_depth",
+				Help:      "Requests and tunnels waiting for a concurrency slot",
+			},
+			[]string{"type"},
+		),
+		QueueWait: promauto.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: "proxy",
+				Name:      "queue_wait_seconds",
+				Help:      "Time requests and tunnels waited for a concurrency slot",
+				Buckets:   prometheus.ExponentialBuckets(0.001, 2, 12),
+			},
+			[]string{"type"},
+		),
+		ConcurrencyLimit: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "proxy",
+				Name:      "concurrency_limit",
+				Help:      "Current cap on concurrent requests and tunnels (0 = unlimited), lowered by adaptive shedding",
+			},
+			[]string{"type"},
+		),
+		Shed: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "proxy",
+				Name:      "shed_total",
+				Help:      "Total number of requests and tunnels rejected because the proxy was overloaded",
+			},
+			[]string{"type", "reason"},
+		),
 	}
 }
 
@@ -114,19 +232,66 @@ func (m *Metrics) DecrementTunnels() {
 	m.TunnelConnections.Dec()
 }
 
+// RecordDialFamily records the address family of a successful upstream dial.
+func (m *Metrics) RecordDialFamily(family string) {
+	m.DialFamily.WithLabelValues(family).Inc()
+}
+
+// RecordRetry records a retried upstream request.
+func (m *Metrics) RecordRetry(reqType, reason string) {
+	m.RetriesTotal.WithLabelValues(reqType, reason).Inc()
+}
+
+// RecordTunnelClose records a closed tunnel and why it closed.
+func (m *Metrics) RecordTunnelClose(reason string) {
+	m.TunnelCloses.WithLabelValues(reason).Inc()
+}
+
+// RecordRateLimited records a request rejected by a rate limit rule.
+func (m *Metrics) RecordRateLimited(rule, reqType string) {
+	m.RateLimited.WithLabelValues(rule, reqType).Inc()
+}
+
+// RecordShed records a request or tunnel rejected by overload shedding.
+func (m *Metrics) RecordShed(reqType, reason string) {
+	m.Shed.WithLabelValues(reqType, reason).Inc()
+}
+
+// SetBreakerState records the circuit breaker state of host. Closed
+// breakers (state 0) are removed so that only troubled hosts are
+// exported.
+func (m *Metrics) SetBreakerState(host string, state int) {
+	if state == 0 {
+		m.BreakerState.DeleteLabelValues(host)
+		return
+	}
+	m.BreakerState.WithLabelValues(host).Set(float64(state))
+}
+
+// SetActiveSessions sets the number of sticky egress sessions.
+func (m *Metrics) SetActiveSessions(n int) {
+	m.ActiveSessions.Set(float64(n))
+}
+
 // Server starts the metrics HTTP server.
 type Server struct {
 	cfg    config.MetricsConfig
+	mux    *http.ServeMux
 	server *http.Server
 }
 
-// NewServer creates a new metrics server.
-func NewServer(cfg config.MetricsConfig) *Server {
+// NewServer creates a new metrics server. If hostStats is non-nil and
+// an upstreams path is configured, per-host statistics are served there.
+func NewServer(cfg config.MetricsConfig, hostStats func() []HostStat) *Server {
 	mux := http.NewServeMux()
 	mux.Handle(cfg.Path, promhttp.Handler())
+	if hostStats != nil && cfg.UpstreamsPath != "" {
+		mux.Handle(cfg.UpstreamsPath, hostStatsHandler(hostStats, cfg.HostsTopN))
+	}
 
 	return &Server{
 		cfg: cfg,
+		mux: mux,
 		server: &http.Server{
 			Addr:    cfg.Address,
 			Handler: mux,
@@ -134,11 +299,22 @@ func NewServer(cfg config.MetricsConfig) *Server {
 	}
 }
 
+// Handle serves h at path alongside the metrics. It must be called
+// before the server starts.
+func (s *Server) Handle(path string, h http.Handler) {
+	s.mux.Handle(path, h)
+}
+
 // Start starts the metrics server.
 func (s *Server) Start() error {
 	return s.server.ListenAndServe()
 }
 
+// Serve serves metrics on an existing listener.
+func (s *Server) Serve(ln net.Listener) error {
+	return s.server.Serve(ln)
+}
+
 // Shutdown gracefully shuts down the metrics server.
 func (s *Server) Shutdown() error {
 	return s.server.Close()
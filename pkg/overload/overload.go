@@ -0,0 +1,300 @@
+// Package overload caps how many HTTP requests and CONNECT tunnels are
+// handled at once. Work over a cap waits in a bounded FIFO queue, and is
+// shed once the queue is full, the wait takes too long, or, with the
+// adaptive limit, while upstream latency is high.
+package overload
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/config"
+	"github.com/yigitkonur/proxy-http-forward/pkg/metrics"
+)
+
+// Kind is what a slot is for.
+type Kind int
+
+// Kinds of work, each with its own cap and queue.
+const (
+	Request Kind = iota // plain HTTP request
+	Tunnel              // CONNECT tunnel, for as long as it is open
+)
+
+// String returns the kind as used in metric labels.
+func (k Kind) String() string {
+	if k == Tunnel {
+		return "tunnel"
+	}
+	return "http"
+}
+
+// Reasons for shedding, reported in proxy_shed_total.
+const (
+	ReasonQueueFull    = "queue_full"    // the queue was full
+	ReasonQueueTimeout = "queue_timeout" // no slot within queue_timeout
+	ReasonLatency      = "latency"       // over the adaptive cap while latency is high
+)
+
+// Error is returned for shed requests and tunnels.
+type Error struct {
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return "overloaded: " + strings.ReplaceAll(e.Reason, "_", " ")
+}
+
+// Limiter hands out concurrency slots. Its settings can be replaced
+// while it is in use; slots already held are kept.
+type Limiter struct {
+	gates [2]*gate
+}
+
+// New creates a Limiter from configuration. m may be nil.
+func New(cfg config.ConcurrencyConfig, m *metrics.Metrics) *Limiter {
+	l := &Limiter{}
+	for _, k := range []Kind{Request, Tunnel} {
+		g := &gate{}
+		if m != nil {
+			g.inFlight = m.InFlight.WithLabelValues(k.String())
+			g.depth = m.QueueDepth.WithLabelValues(k.String())
+			g.wait = m.QueueWait.WithLabelValues(k.String())
+			g.limitGauge = m.ConcurrencyLimit.WithLabelValues(k.String())
+		}
+		l.gates[k] = g
+	}
+	l.Update(cfg)
+	return l
+}
+
+// Update applies new caps. Only plain HTTP requests have an adaptive
+// cap; it starts over at max_requests when the settings change.
+func (l *Limiter) Update(cfg config.ConcurrencyConfig) {
+	l.gates[Request].update(gateConfig{
+		max:          cfg.MaxRequests,
+		queueSize:    cfg.QueueSize,
+		queueTimeout: cfg.QueueTimeout,
+		retryAfter:   cfg.RetryAfter,
+		adaptive:     cfg.Adaptive.Enabled,
+		target:       cfg.Adaptive.TargetLatency,
+		min:          cfg.Adaptive.MinRequests,
+	})
+	l.gates[Tunnel].update(gateConfig{
+		max:          cfg.MaxTunnels,
+		queueSize:    cfg.QueueSize,
+		queueTimeout: cfg.QueueTimeout,
+		retryAfter:   cfg.RetryAfter,
+	})
+}
+
+// Acquire takes a slot for k, waiting in the queue if all are taken. It
+// returns an *Error if the request or tunnel is shed. The caller must
+// Release the slot when done.
+func (l *Limiter) Acquire(k Kind) (*Slot, error) {
+	return l.gates[k].acquire()
+}
+
+// Slot is a held concurrency slot.
+type Slot struct {
+	g    *gate
+	once sync.Once
+}
+
+// Observe feeds the latency of an upstream attempt made while holding
+// the slot to the adaptive cap, if the slot's kind has one. Only time
+// spent on upstream should be observed, not waits of the proxy's own
+// such as retry backoff. A nil Slot is ignored.
+func (s *Slot) Observe(d time.Duration) {
+	if s == nil {
+		return
+	}
+	s.g.observe(d)
+}
+
+// Release gives the slot back. Release may be called more than once; a
+// nil Slot is ignored.
+func (s *Slot) Release() {
+	if s == nil {
+		return
+	}
+	s.once.Do(s.g.release)
+}
+
+// gateConfig is the configuration of one gate.
+type gateConfig struct {
+	max          int // 0 = unlimited
+	queueSize    int
+	queueTimeout time.Duration
+	retryAfter   time.Duration
+
+	adaptive bool
+	target   time.Duration
+	min      int
+}
+
+// gate is the cap and queue of one kind of work.
+type gate struct {
+	inFlight   prometheus.Gauge
+	depth      prometheus.Gauge
+	wait       prometheus.Observer
+	limitGauge prometheus.Gauge
+
+	mu      sync.Mutex
+	cfg     gateConfig
+	active  int
+	queue   []*waiter
+	limit   float64       // current cap; below cfg.max while adaptive shedding
+	latency time.Duration // moving average of upstream latency
+	changed time.Time     // when limit was last lowered
+}
+
+// waiter is a queued acquire.
+type waiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+func (g *gate) update(cfg gateConfig) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if cfg == g.cfg {
+		return
+	}
+	g.cfg = cfg
+	g.limit = float64(cfg.max)
+	g.latency = 0
+	g.setGauges()
+	g.grant()
+}
+
+func (g *gate) acquire() (*Slot, error) {
+	g.mu.Lock()
+	cfg := g.cfg
+	if len(g.queue) == 0 && g.free() {
+		g.active++
+		g.setGauges()
+		g.mu.Unlock()
+		return &Slot{g: g}, nil
+	}
+	if cfg.adaptive && g.latency > cfg.target {
+		g.mu.Unlock()
+		return nil, &Error{Reason: ReasonLatency, RetryAfter: cfg.retryAfter}
+	}
+	if len(g.queue) >= cfg.queueSize {
+		g.mu.Unlock()
+		return nil, &Error{Reason: ReasonQueueFull, RetryAfter: cfg.retryAfter}
+	}
+	w := &waiter{ready: make(chan struct{})}
+	g.queue = append(g.queue, w)
+	g.setGauges()
+	g.mu.Unlock()
+
+	start := time.Now()
+	timer := time.NewTimer(cfg.queueTimeout)
+	defer timer.Stop()
+	select {
+	case <-w.ready:
+	case <-timer.C:
+		g.mu.Lock()
+		if !w.granted {
+			g.remove(w)
+			g.setGauges()
+			g.mu.Unlock()
+			g.observeWait(start)
+			return nil, &Error{Reason: ReasonQueueTimeout, RetryAfter: cfg.retryAfter}
+		}
+		// Granted just as the wait ran out.
+		g.mu.Unlock()
+	}
+	g.observeWait(start)
+	return &Slot{g: g}, nil
+}
+
+func (g *gate) release() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.active--
+	g.grant()
+	g.setGauges()
+}
+
+func (g *gate) observe(d time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.cfg.adaptive {
+		return
+	}
+	g.adapt(d, !g.free())
+	g.grant()
+	g.setGauges()
+}
+
+// adapt updates the latency average with an upstream attempt and moves
+// the cap: down by a tenth at most once per target latency while the
+// average is above target, up by about one per cap's worth of attempts
+// made at the cap otherwise. The caller must hold g.mu.
+func (g *gate) adapt(d time.Duration, saturated bool) {
+	if g.latency == 0 {
+		g.latency = d
+	} else {
+		g.latency += (d - g.latency) / 10
+	}
+
+	now := time.Now()
+	switch {
+	case g.latency > g.cfg.target:
+		if now.Sub(g.changed) >= g.cfg.target {
+			g.limit = max(float64(g.cfg.min), g.limit*0.9)
+			g.changed = now
+		}
+	case saturated:
+		g.limit = min(float64(g.cfg.max), g.limit+1/g.limit)
+	}
+}
+
+// free reports whether a slot is free. The caller must hold g.mu.
+func (g *gate) free() bool {
+	return g.cfg.max == 0 || g.active < int(g.limit)
+}
+
+// grant hands free slots to waiters in order. The caller must hold g.mu.
+func (g *gate) grant() {
+	for len(g.queue) > 0 && g.free() {
+		w := g.queue[0]
+		g.queue = g.queue[1:]
+		w.granted = true
+		g.active++
+		close(w.ready)
+	}
+}
+
+// remove drops w from the queue. The caller must hold g.mu.
+func (g *gate) remove(w *waiter) {
+	for i, q := range g.queue {
+		if q == w {
+			g.queue = append(g.queue[:i], g.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// setGauges exports the gate's state. The caller must hold g.mu.
+func (g *gate) setGauges() {
+	if g.inFlight == nil {
+		return
+	}
+	g.inFlight.Set(float64(g.active))
+	g.depth.Set(float64(len(g.queue)))
+	g.limitGauge.Set(float64(int(g.limit)))
+}
+
+func (g *gate) observeWait(start time.Time) {
+	if g.wait != nil {
+		g.wait.Observe(time.Since(start).Seconds())
+	}
+}
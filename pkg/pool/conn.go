@@ -0,0 +1,122 @@
+package pool
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timeout reasons reported by TimeoutError, used as error metric labels.
+const (
+	ReasonDialTimeout         = "dial_timeout"
+	ReasonTLSHandshakeTimeout = "tls_handshake_timeout"
+	ReasonFirstByteTimeout    = "first_byte_timeout"
+	ReasonReadIdleTimeout     = "read_idle_timeout"
+	ReasonResponseTimeout     = "response_timeout"
+	ReasonRequestTimeout      = "request_timeout"
+)
+
+// TimeoutError reports which upstream timeout expired.
+type TimeoutError struct {
+	Reason string
+	Err    error // underlying error, if any
+}
+
+func (e *TimeoutError) Error() string {
+	return strings.ReplaceAll(e.Reason, "_", " ")
+}
+
+// Unwrap returns the underlying error.
+func (e *TimeoutError) Unwrap() error { return e.Err }
+
+// Timeout reports true; TimeoutError satisfies net.Error.
+func (e *TimeoutError) Timeout() bool { return true }
+
+// Temporary reports true so that TLS connections stay usable after a
+// deadline; the connection is closed by the client regardless.
+func (e *TimeoutError) Temporary() bool { return true }
+
+// isTimeout reports whether err is a timeout.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// upstreamConn is a pooled upstream connection. It releases its slot in
+// the global limit once, on Close, and layers the first-byte and
+// read-idle timeouts over the read deadline the HTTP client sets for
+// each response.
+type upstreamConn struct {
+	net.Conn
+	firstByte time.Duration
+	readIdle  time.Duration
+
+	once    sync.Once
+	release func()
+
+	// Read state for the current response. The client reads one
+	// response at a time, so no locking is needed.
+	armed    bool      // a response is being read
+	gotFirst bool      // its first byte has arrived
+	outer    time.Time // deadline set by the client, zero for none
+	inner    time.Time // deadline from firstByte or readIdle
+}
+
+func (c *upstreamConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// SetReadDeadline is called by the client right before it reads a
+// response, which starts the first-byte timer.
+func (c *upstreamConn) SetReadDeadline(t time.Time) error {
+	c.outer = t
+	c.armed, c.gotFirst = true, false
+	c.inner = time.Time{}
+	if c.firstByte > 0 {
+		c.inner = time.Now().Add(c.firstByte)
+	}
+	return c.Conn.SetReadDeadline(c.effective())
+}
+
+func (c *upstreamConn) Read(b []byte) (int, error) {
+	if c.armed && c.gotFirst && c.readIdle > 0 {
+		c.inner = time.Now().Add(c.readIdle)
+		if err := c.Conn.SetReadDeadline(c.effective()); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := c.Conn.Read(b)
+	if n > 0 && c.armed && !c.gotFirst {
+		c.gotFirst = true
+		if c.readIdle <= 0 && !c.inner.IsZero() {
+			// Only the client's own deadline applies to the rest.
+			c.inner = time.Time{}
+			c.Conn.SetReadDeadline(c.outer)
+		}
+	}
+	if err != nil && c.armed && isTimeout(err) && c.innerFired() {
+		reason := ReasonReadIdleTimeout
+		if !c.gotFirst {
+			reason = ReasonFirstByteTimeout
+		}
+		return n, &TimeoutError{Reason: reason, Err: err}
+	}
+	return n, err
+}
+
+// effective returns the earlier of the inner and outer deadlines.
+func (c *upstreamConn) effective() time.Time {
+	if c.inner.IsZero() || (!c.outer.IsZero() && c.outer.Before(c.inner)) {
+		return c.outer
+	}
+	return c.inner
+}
+
+// innerFired reports whether the inner deadline is the one that expired.
+func (c *upstreamConn) innerFired() bool {
+	return !c.inner.IsZero() && (c.outer.IsZero() || c.inner.Before(c.outer))
+}
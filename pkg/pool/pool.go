@@ -1,52 +1,146 @@
 // Package pool provides connection pooling for upstream HTTP requests.
+//
+// A single Pool holds one fasthttp.HostClient per upstream host (and egress
+// source), so every request to a host shares the same keep-alive
+// connections. Connection counts are capped per host by the HostClient and
+// across all hosts by the Pool itself.
 package pool
 
 import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/valyala/fasthttp"
 
 	"github.com/yigitkonur/proxy-http-forward/pkg/config"
+	"github.com/yigitkonur/proxy-http-forward/pkg/dialer"
+	"github.com/yigitkonur/proxy-http-forward/pkg/metrics"
+	"github.com/yigitkonur/proxy-http-forward/pkg/route"
 )
 
-// Pool manages a pool of fasthttp clients for making upstream requests.
+// ErrTooManyConns is returned when opening a connection would exceed the
+// global connection limit.
+var ErrTooManyConns = errors.New("global upstream connection limit reached")
+
+// defaultIdleConnTimeout applies when no idle timeout is configured.
+const defaultIdleConnTimeout = 5 * time.Minute
+
+// hostKey identifies a HostClient: one per scheme, address and source.
+type hostKey struct {
+	addr   string
+	isTLS  bool
+	source string
+}
+
+// host is a HostClient with the bookkeeping the Pool needs for limits,
+// eviction and statistics.
+type host struct {
+	client   *fasthttp.HostClient
+	tls      *tls.Config // nil for plain HTTP
+	timeouts config.TimeoutConfig
+	dial     time.Duration // dial timeout
+	lastUsed int64         // unix nanoseconds
+	inFlight int64
+	requests uint64
+	dials    uint64
+}
+
+// Stats is a snapshot of pool-wide connection statistics.
+type Stats struct {
+	Hosts     int    // HostClients currently held
+	OpenConns int    // upstream connections currently open
+	Requests  uint64 // requests sent since the pool was created
+	Dials     uint64 // connections dialed since the pool was created
+}
+
+// ReuseRatio returns the fraction of requests served on an existing
+// connection rather than a newly dialed one.
+func (s Stats) ReuseRatio() float64 {
+	if s.Requests == 0 || s.Dials >= s.Requests {
+		return 0
+	}
+	return 1 - float64(s.Dials)/float64(s.Requests)
+}
+
+// Pool manages shared per-host clients for making upstream requests.
 type Pool struct {
-	pool   sync.Pool
-	config config.ProxyConfig
+	config      config.ProxyConfig
+	dialer      *dialer.Dialer
+	routes      *route.Table
+	maxConns    int64
+	perHost     int
+	idleTimeout time.Duration
+
+	mu    sync.RWMutex
+	hosts map[hostKey]*host
+	tls   map[*config.RouteConfig]*tls.Config // by matching route; nil key for proxy.tls
+
+	openConns int64
+	requests  uint64
+	dials     uint64
+
+	stop      chan struct{}
+	closeOnce sync.Once
 }
 
 // New creates a new connection pool with the given configuration.
-func New(cfg config.ProxyConfig) *Pool {
+// Upstream connections are established through d, and routes in rt
+// override TLS settings and timeouts per destination. Close stops the background
+// eviction of idle hosts.
+func New(cfg config.ProxyConfig, d *dialer.Dialer, rt *route.Table) *Pool {
 	p := &Pool{
-		config: cfg,
+		config:      cfg,
+		dialer:      d,
+		routes:      rt,
+		maxConns:    int64(cfg.MaxConns),
+		perHost:     cfg.MaxConnsPerHost,
+		idleTimeout: cfg.IdleConnTimeout,
+		hosts:       make(map[hostKey]*host),
+		tls:         make(map[*config.RouteConfig]*tls.Config),
+		stop:        make(chan struct{}),
 	}
-
-	p.pool = sync.Pool{
-		New: func() interface{} {
-			return p.newClient()
-		},
+	if p.perHost <= 0 {
+		// max_idle_conns predates max_conns_per_host and was used as such.
+		p.perHost = cfg.MaxIdleConns
+	}
+	if p.idleTimeout <= 0 {
+		p.idleTimeout = defaultIdleConnTimeout
 	}
 
+	go p.evictLoop()
 	return p
 }
 
-// newClient creates a new fasthttp client with the pool configuration.
-func (p *Pool) newClient() *fasthttp.Client {
-	return &fasthttp.Client{
+// newHostClient creates a client for a single upstream address whose
+// connections are bound to src and counted against the global limit.
+func (p *Pool) newHostClient(key hostKey, src dialer.Source, h *host) *fasthttp.HostClient {
+	return &fasthttp.HostClient{
+		Addr:  key.addr,
+		IsTLS: key.isTLS,
+
 		// Connection settings
-		MaxConnsPerHost:     p.config.MaxIdleConns,
-		MaxIdleConnDuration: time.Minute * 5,
+		MaxConns:            p.perHost,
+		MaxIdleConnDuration: p.idleTimeout,
+		MaxConnWaitTimeout:  p.config.DialTimeout,
+		ConnPoolStrategy:    fasthttp.LIFO,
+
+		// Retries are left to the handler's retry policy
+		MaxIdemponentCallAttempts: 1,
 
 		// Timeout settings
 		ReadTimeout:  p.config.ResponseTimeout,
 		WriteTimeout: p.config.ResponseTimeout,
 
-		// Dialer settings
-		Dial: (&fasthttp.TCPDialer{
-			Concurrency:      4096,
-			DNSCacheDuration: time.Hour,
-		}).Dial,
+		// Dialer settings (resolution and DNS caching happen in the
+		// dialer, the TLS handshake in dial)
+		Dial: func(addr string) (net.Conn, error) {
+			return p.dial(addr, src, h)
+		},
 
 		// Disable automatic redirect following (proxy should forward as-is)
 		NoDefaultUserAgentHeader: true,
@@ -56,26 +150,284 @@ func (p *Pool) newClient() *fasthttp.Client {
 	}
 }
 
-// Get retrieves a client from the pool.
-func (p *Pool) Get() *fasthttp.Client {
-	return p.pool.Get().(*fasthttp.Client)
+// dial opens a connection if the global limit allows it, and completes
+// the TLS handshake for HTTPS hosts.
+func (p *Pool) dial(addr string, src dialer.Source, h *host) (net.Conn, error) {
+	if open := atomic.AddInt64(&p.openConns, 1); p.maxConns > 0 && open > p.maxConns {
+		atomic.AddInt64(&p.openConns, -1)
+		return nil, ErrTooManyConns
+	}
+
+	conn, err := p.dialer.DialTimeoutFrom(addr, h.dial, src)
+	if err != nil {
+		atomic.AddInt64(&p.openConns, -1)
+		if isTimeout(err) {
+			return nil, &TimeoutError{Reason: ReasonDialTimeout, Err: err}
+		}
+		return nil, err
+	}
+
+	atomic.AddUint64(&p.dials, 1)
+	atomic.AddUint64(&h.dials, 1)
+	uc := &upstreamConn{
+		Conn:      conn,
+		firstByte: h.timeouts.FirstByte,
+		readIdle:  h.timeouts.ReadIdle,
+		release:   func() { atomic.AddInt64(&p.openConns, -1) },
+	}
+	if h.tls == nil {
+		return uc, nil
+	}
+	return handshake(uc, addr, h.tls, h.timeouts.TLSHandshake)
+}
+
+// handshake runs a client TLS handshake over conn, bounded by timeout.
+// Unless overridden, the server name is the host part of addr.
+func handshake(conn net.Conn, addr string, c *tls.Config, timeout time.Duration) (net.Conn, error) {
+	if c.ServerName == "" {
+		c = c.Clone()
+		c.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	tc := tls.Client(conn, c)
+	if err := tc.Handshake(); err != nil {
+		conn.Close()
+		if isTimeout(err) {
+			return nil, &TimeoutError{Reason: ReasonTLSHandshakeTimeout, Err: err}
+		}
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+	return tc, nil
+}
+
+// hostFor returns the host for the request's destination, creating it on
+// first use.
+func (p *Pool) hostFor(req *fasthttp.Request, src dialer.Source) (*host, error) {
+	uri := req.URI()
+	var isTLS bool
+	switch string(uri.Scheme()) {
+	case "https":
+		isTLS = true
+	case "http":
+	default:
+		return nil, fmt.Errorf("unsupported protocol %q. http and https are supported", uri.Scheme())
+	}
+	key := hostKey{
+		addr:   fasthttp.AddMissingPort(string(uri.Host()), isTLS),
+		isTLS:  isTLS,
+		source: src.String(),
+	}
+
+	p.mu.RLock()
+	h, ok := p.hosts[key]
+	p.mu.RUnlock()
+	if ok {
+		return h, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if h, ok = p.hosts[key]; !ok {
+		h = &host{
+			timeouts: p.routes.Timeouts(key.addr, p.config.Timeouts),
+			dial:     p.config.DialTimeout,
+		}
+		if isTLS {
+			var err error
+			if h.tls, err = p.tlsConfig(key.addr); err != nil {
+				return nil, err
+			}
+		}
+		h.client = p.newHostClient(key, src, h)
+		p.hosts[key] = h
+	}
+	return h, nil
 }
 
-// Put returns a client to the pool.
-func (p *Pool) Put(client *fasthttp.Client) {
-	p.pool.Put(client)
+// tlsConfig returns the TLS settings for addr: proxy.tls with the
+// matching route's overrides applied. Configurations are built once per
+// route. The caller must hold p.mu.
+func (p *Pool) tlsConfig(addr string) (*tls.Config, error) {
+	r := p.routes.Match(addr)
+	if r != nil && r.TLS == nil {
+		r = nil
+	}
+	if c, ok := p.tls[r]; ok {
+		return c, nil
+	}
+
+	settings := p.config.TLS
+	if r != nil {
+		settings = settings.Merge(r.TLS)
+	}
+	c, err := settings.Build()
+	if err != nil {
+		return nil, fmt.Errorf("upstream tls: %w", err)
+	}
+	p.tls[r] = c
+	return c, nil
 }
 
-// Do executes an HTTP request using a pooled client.
+// Do executes an HTTP request using the shared client for its host.
 func (p *Pool) Do(req *fasthttp.Request, resp *fasthttp.Response) error {
-	client := p.Get()
-	defer p.Put(client)
-	return client.Do(req, resp)
+	return p.DoTimeoutFrom(req, resp, 0, dialer.Source{})
 }
 
-// DoTimeout executes an HTTP request with a timeout using a pooled client.
+// DoTimeout executes an HTTP request with a timeout.
 func (p *Pool) DoTimeout(req *fasthttp.Request, resp *fasthttp.Response, timeout time.Duration) error {
-	client := p.Get()
-	defer p.Put(client)
-	return client.DoTimeout(req, resp, timeout)
+	return p.DoTimeoutFrom(req, resp, timeout, dialer.Source{})
+}
+
+// DoTimeoutFrom executes an HTTP request with a timeout over connections
+// bound to src. A zero timeout waits indefinitely. Expired timeouts are
+// reported as *TimeoutError.
+func (p *Pool) DoTimeoutFrom(req *fasthttp.Request, resp *fasthttp.Response, timeout time.Duration, src dialer.Source) error {
+	h, err := p.hostFor(req, src)
+	if err != nil {
+		return err
+	}
+
+	atomic.StoreInt64(&h.lastUsed, time.Now().UnixNano())
+	atomic.AddInt64(&h.inFlight, 1)
+	defer atomic.AddInt64(&h.inFlight, -1)
+	atomic.AddUint64(&h.requests, 1)
+	atomic.AddUint64(&p.requests, 1)
+
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+		err = h.client.DoTimeout(req, resp, timeout)
+	} else {
+		err = h.client.Do(req, resp)
+	}
+	if errors.Is(err, fasthttp.ErrTimeout) {
+		// The client reports an expired deadline on the first response
+		// byte as ErrTimeout. If the overall deadline has not passed, the
+		// first-byte timeout fired.
+		reason := ReasonResponseTimeout
+		if h.timeouts.FirstByte > 0 && (deadline.IsZero() || time.Now().Before(deadline)) {
+			reason = ReasonFirstByteTimeout
+		}
+		return &TimeoutError{Reason: reason, Err: err}
+	}
+	return err
+}
+
+// Stats returns a snapshot of pool statistics.
+func (p *Pool) Stats() Stats {
+	p.mu.RLock()
+	hosts := len(p.hosts)
+	p.mu.RUnlock()
+
+	return Stats{
+		Hosts:     hosts,
+		OpenConns: int(atomic.LoadInt64(&p.openConns)),
+		Requests:  atomic.LoadUint64(&p.requests),
+		Dials:     atomic.LoadUint64(&p.dials),
+	}
+}
+
+// HostStats returns connection statistics per upstream address, summed
+// across schemes and egress sources.
+func (p *Pool) HostStats() []metrics.HostStat {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	byAddr := make(map[string]*metrics.HostStat, len(p.hosts))
+	for key, h := range p.hosts {
+		open := h.client.ConnsCount()
+		inFlight := int(atomic.LoadInt64(&h.inFlight))
+		busy := inFlight
+		if busy > open {
+			busy = open
+		}
+
+		s, ok := byAddr[key.addr]
+		if !ok {
+			s = &metrics.HostStat{Host: key.addr}
+			byAddr[key.addr] = s
+		}
+		s.Open += open
+		s.Idle += open - busy
+		s.Pending += inFlight - busy
+		s.Requests += atomic.LoadUint64(&h.requests)
+		s.Dials += atomic.LoadUint64(&h.dials)
+	}
+
+	stats := make([]metrics.HostStat, 0, len(byAddr))
+	for _, s := range byAddr {
+		stats = append(stats, *s)
+	}
+	return stats
+}
+
+// Reload applies the TLS settings and timeouts from cfg, along with any
+// route changes already made to the pool's route table. Hosts created
+// under the previous settings are retired: their idle connections are
+// closed, requests in flight on them finish, and the next request to each
+// destination creates a new host. Other settings in cfg are ignored.
+func (p *Pool) Reload(cfg config.ProxyConfig) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.config.DialTimeout = cfg.DialTimeout
+	p.config.ResponseTimeout = cfg.ResponseTimeout
+	p.config.Timeouts = cfg.Timeouts
+	p.config.TLS = cfg.TLS
+	p.tls = make(map[*config.RouteConfig]*tls.Config)
+	for _, h := range p.hosts {
+		h.client.CloseIdleConnections()
+	}
+	p.hosts = make(map[hostKey]*host)
+}
+
+// Close stops idle eviction and closes all idle connections.
+func (p *Pool) Close() {
+	p.closeOnce.Do(func() {
+		close(p.stop)
+	})
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, h := range p.hosts {
+		h.client.CloseIdleConnections()
+	}
+}
+
+// evictLoop periodically drops hosts that have been idle too long.
+func (p *Pool) evictLoop() {
+	ticker := time.NewTicker(p.idleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.evictIdle(time.Now().Add(-p.idleTimeout))
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// evictIdle removes hosts with no connections or requests since cutoff.
+// Their HostClients close idle connections on their own after the same
+// timeout, so an evicted host normally has none left.
+func (p *Pool) evictIdle(cutoff time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for key, h := range p.hosts {
+		if atomic.LoadInt64(&h.inFlight) > 0 || atomic.LoadInt64(&h.lastUsed) > cutoff.UnixNano() {
+			continue
+		}
+		if h.client.ConnsCount() > 0 {
+			continue
+		}
+		delete(p.hosts, key)
+	}
 }
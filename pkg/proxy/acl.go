@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"net"
+)
+
+// aclListener refuses connections from client addresses its listener's
+// ACL does not allow. It sits above any PROXY protocol listener, so the
+// address checked is the relayed client's.
+type aclListener struct {
+	net.Listener
+	allow, deny []*net.IPNet
+	onDeny      func(remote net.Addr)
+}
+
+// Accept returns the next allowed connection, closing refused ones.
+func (l *aclListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.allowed(c.RemoteAddr()) {
+			return c, nil
+		}
+		c.Close()
+		l.onDeny(c.RemoteAddr())
+	}
+}
+
+// allowed reports whether the ACL lets addr connect. Clients without an
+// IP address only pass ACLs without an allow list.
+func (l *aclListener) allowed(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return len(l.allow) == 0
+	}
+	if contains(l.deny, tcp.IP) {
+		return false
+	}
+	return len(l.allow) == 0 || contains(l.allow, tcp.IP)
+}
+
+// contains reports whether any of nets contains ip.
+func contains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// acceptRetryDelay paces Accept after a temporary error, such as running
+// out of file descriptors.
+const acceptRetryDelay = 50 * time.Millisecond
+
+// listenerServer accepts and serves the connections of one listener.
+type listenerServer interface {
+	Serve(ln net.Listener) error
+	Shutdown() error
+}
+
+// connServer serves listeners whose protocol is not HTTP, handing each
+// connection to handle in a goroutine of its own.
+type connServer struct {
+	handle func(net.Conn)
+
+	mu     sync.Mutex
+	ln     net.Listener
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// Serve accepts connections on ln until Shutdown is called.
+func (s *connServer) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.ln = ln
+	s.mu.Unlock()
+
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			var temp interface{ Temporary() bool }
+			if errors.As(err, &temp) && temp.Temporary() {
+				time.Sleep(acceptRetryDelay)
+				continue
+			}
+			return err
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(c)
+		}()
+	}
+}
+
+// Shutdown stops accepting and waits for the connections being served,
+// whose tunnels the caller drains.
+func (s *connServer) Shutdown() error {
+	s.mu.Lock()
+	s.closed = true
+	var err error
+	if s.ln != nil {
+		err = s.ln.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
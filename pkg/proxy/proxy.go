@@ -3,112 +3,453 @@ package proxy
 
 import (
 	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/valyala/fasthttp"
 	"go.uber.org/zap"
 
+	"github.com/yigitkonur/proxy-http-forward/pkg/accesslog"
+	"github.com/yigitkonur/proxy-http-forward/pkg/auth"
 	"github.com/yigitkonur/proxy-http-forward/pkg/config"
+	"github.com/yigitkonur/proxy-http-forward/pkg/dialer"
+	"github.com/yigitkonur/proxy-http-forward/pkg/egress"
 	"github.com/yigitkonur/proxy-http-forward/pkg/handler"
 	"github.com/yigitkonur/proxy-http-forward/pkg/metrics"
 	"github.com/yigitkonur/proxy-http-forward/pkg/pool"
+	"github.com/yigitkonur/proxy-http-forward/pkg/proxyproto"
+	"github.com/yigitkonur/proxy-http-forward/pkg/quota"
+	"github.com/yigitkonur/proxy-http-forward/pkg/resolver"
+	"github.com/yigitkonur/proxy-http-forward/pkg/route"
+	"github.com/yigitkonur/proxy-http-forward/pkg/unixsock"
 )
 
 // Server represents the proxy server.
 type Server struct {
 	config        *config.Config
 	logger        *zap.SugaredLogger
-	server        *fasthttp.Server
+	listeners     []*listener
 	metricsServer *metrics.Server
 	handler       *handler.Handler
 	pool          *pool.Pool
 	metrics       *metrics.Metrics
+	auth          *auth.Authenticator
+	routes        *route.Table
+	quotas        *quota.Tracker
+	access        *accesslog.Logger
+
+	metricsListener net.Listener
+
+	reloadMu sync.Mutex
+}
+
+// reloadable lists the settings Reload applies to the running server.
+// Changes to any other setting take effect after a restart.
+var reloadable = []string{
+	"auth.",
+	"logging.level", // applied by the caller, which owns the logger
+	"proxy.bandwidth",
+	"proxy.concurrency",
+	"proxy.dial_timeout",
+	"proxy.rate_limits",
+	"proxy.response_timeout",
+	"proxy.retry",
+	"proxy.timeouts",
+	"proxy.tls",
+	"quotas.daily",
+	"quotas.groups",
+	"quotas.monthly",
+	"routes",
 }
 
-// New creates a new proxy server.
-func New(cfg *config.Config, logger *zap.SugaredLogger) *Server {
+// listener is one client-facing socket and the server accepting on it.
+type listener struct {
+	cfg    config.ListenerConfig
+	auth   *auth.Authenticator // nil if the listener uses the top-level auth
+	server listenerServer
+	ln     net.Listener
+}
+
+// newServer creates the server for a listener, taking client timeouts
+// from the listener where set and from server otherwise. SOCKS5 clients
+// must finish their handshake within the read timeout.
+func newServer(server config.ServerConfig, lc config.ListenerConfig, l *handler.Listener) listenerServer {
+	switch lc.Protocol {
+	case config.ProtocolSOCKS5:
+		timeout := server.ReadTimeout
+		if lc.ReadTimeout > 0 {
+			timeout = lc.ReadTimeout
+		}
+		return &connServer{handle: func(c net.Conn) { l.ServeSOCKS(c, timeout) }}
+	case config.ProtocolTransparent:
+		return &connServer{handle: l.ServeTransparent}
+	}
+
+	s := &fasthttp.Server{
+		Handler:                       l.HandleRequest,
+		Name:                          "proxy-http-forward",
+		ReadTimeout:                   server.ReadTimeout,
+		WriteTimeout:                  server.WriteTimeout,
+		IdleTimeout:                   server.IdleTimeout,
+		MaxConnsPerIP:                 server.MaxConnsPerIP,
+		MaxRequestsPerConn:            server.MaxRequestsPerConn,
+		DisableKeepalive:              false,
+		TCPKeepalive:                  true,
+		TCPKeepalivePeriod:            time.Minute,
+		NoDefaultServerHeader:         true,
+		NoDefaultDate:                 true,
+		DisableHeaderNamesNormalizing: true,
+	}
+	if lc.ReadTimeout > 0 {
+		s.ReadTimeout = lc.ReadTimeout
+	}
+	if lc.WriteTimeout > 0 {
+		s.WriteTimeout = lc.WriteTimeout
+	}
+	if lc.IdleTimeout > 0 {
+		s.IdleTimeout = lc.IdleTimeout
+	}
+	return s
+}
+
+// ListenFunc opens a listener, like net.Listen.
+type ListenFunc func(network, addr string) (net.Listener, error)
+
+// New creates a new proxy server. It fails if the quota usage log
+// cannot be read or the access log cannot be opened.
+func New(cfg *config.Config, logger *zap.SugaredLogger) (*Server, error) {
 	// Initialize metrics
 	m := metrics.New()
 
+	// Per-destination overrides, shared by the dialer and the pool
+	rt := route.New(cfg.Routes)
+
+	// Initialize the shared upstream dialer
+	d := dialer.New(cfg.Proxy, rt, resolver.New(cfg.DNS), m)
+
 	// Initialize connection pool
-	p := pool.New(cfg.Proxy)
+	p := pool.New(cfg.Proxy, d, rt)
 
-	// Initialize handler
-	h := handler.New(p, m, logger, cfg.Proxy)
-
-	// Create fasthttp server
-	server := &fasthttp.Server{
-		Handler:               h.HandleRequest,
-		Name:                  "proxy-http-forward",
-		ReadTimeout:          cfg.Server.ReadTimeout,
-		WriteTimeout:         cfg.Server.WriteTimeout,
-		IdleTimeout:          cfg.Server.IdleTimeout,
-		MaxConnsPerIP:        cfg.Server.MaxConnsPerIP,
-		MaxRequestsPerConn:   cfg.Server.MaxRequestsPerConn,
-		DisableKeepalive:     false,
-		TCPKeepalive:         true,
-		TCPKeepalivePeriod:   time.Minute,
-		NoDefaultServerHeader: true,
-		NoDefaultDate:        true,
-		DisableHeaderNamesNormalizing: true,
+	// Load quota usage from before a restart
+	q, err := quota.Open(cfg.Quotas, logger)
+	if err != nil {
+		p.Close()
+		return nil, fmt.Errorf("quotas: %w", err)
 	}
 
+	// Open the access log
+	al, err := accesslog.New(cfg.Logging.Access)
+	if err != nil {
+		p.Close()
+		q.Close()
+		return nil, fmt.Errorf("access log: %w", err)
+	}
+
+	// Initialize handler
+	a := auth.New(cfg.Auth)
+	h := handler.New(p, d, rt, a, egress.New(cfg.Egress, m), q, m, logger, al, cfg.Proxy)
+
+	// Reload updates the server's copy of the configuration
+	running := *cfg
 	s := &Server{
-		config:  cfg,
+		config:  &running,
 		logger:  logger,
-		server:  server,
 		pool:    p,
 		metrics: m,
 		handler: h,
+		auth:    a,
+		routes:  rt,
+		quotas:  q,
+		access:  al,
+	}
+
+	// One fasthttp server per listener, all sharing the handler
+	for _, lc := range cfg.Listeners() {
+		var la *auth.Authenticator
+		if lc.Auth != nil {
+			la = auth.New(*lc.Auth)
+		}
+		s.listeners = append(s.listeners, &listener{
+			cfg:    lc,
+			auth:   la,
+			server: newServer(cfg.Server, lc, h.Listener(la, lc.Timeouts)),
+		})
 	}
 
 	// Initialize metrics server if enabled
 	if cfg.Metrics.Enabled {
-		s.metricsServer = metrics.NewServer(cfg.Metrics)
+		if err := m.RegisterHostStats(p.HostStats, cfg.Metrics.HostsTopN); err != nil {
+			logger.Warnw("failed to register upstream host metrics", "error", err)
+		}
+		s.metricsServer = metrics.NewServer(cfg.Metrics, p.HostStats)
+		if q != nil && cfg.Quotas.ReportPath != "" {
+			s.metricsServer.Handle(cfg.Quotas.ReportPath, q.ReportHandler())
+		}
 	}
 
-	return s
+	return s, nil
 }
 
 // Start starts the proxy server.
 func (s *Server) Start() error {
+	if err := s.Listen(net.Listen); err != nil {
+		return err
+	}
+	return s.Serve()
+}
+
+// Listen binds the proxy and metrics listeners with listen, which may
+// return sockets inherited from a previous process. https listeners
+// terminate TLS on top of the socket listen returns, after any PROXY
+// protocol header and the listener's ACL. Stale unix socket files are removed before binding.
+func (s *Server) Listen(listen ListenFunc) error {
+	var opened []net.Listener
+	var addrs []net.Addr
+	fail := func(err error) error {
+		for _, ln := range opened {
+			ln.Close()
+		}
+		return err
+	}
+
+	for _, l := range s.listeners {
+		network, addr := l.cfg.Network()
+		if network == "unix" {
+			if err := unixsock.RemoveStale(addr); err != nil {
+				return fail(fmt.Errorf("listener %s: %w", l.cfg.Name, err))
+			}
+		}
+		ln, err := listen(network, addr)
+		if err != nil {
+			return fail(err)
+		}
+		opened = append(opened, ln)
+
+		if network == "unix" {
+			if err := unixsock.Configure(addr, l.cfg.SocketMode, l.cfg.SocketOwner, l.cfg.SocketGroup); err != nil {
+				return fail(fmt.Errorf("listener %s: %w", l.cfg.Name, err))
+			}
+			ln = unixsock.WithCred(ln)
+		}
+		if pp := l.cfg.ProxyProtocol; pp.Enabled {
+			trusted, err := pp.Trusted()
+			if err != nil {
+				return fail(fmt.Errorf("listener %s: %w", l.cfg.Name, err))
+			}
+			ln = proxyproto.NewListener(ln, trusted, pp.HeaderTimeout, s.proxyHeaderError(l.cfg.Name))
+		}
+		if l.cfg.ACL.Enabled() {
+			allow, deny, err := l.cfg.ACL.Nets()
+			if err != nil {
+				return fail(fmt.Errorf("listener %s: acl.%w", l.cfg.Name, err))
+			}
+			ln = &aclListener{Listener: ln, allow: allow, deny: deny, onDeny: s.aclDenied(l.cfg.Name)}
+		}
+
+		if l.cfg.Protocol == config.ProtocolHTTPS {
+			tlsConfig, err := l.cfg.TLS.Build()
+			if err != nil {
+				return fail(fmt.Errorf("listener %s: %w", l.cfg.Name, err))
+			}
+			ln = tls.NewListener(ln, tlsConfig)
+		}
+		l.ln = ln
+		addrs = append(addrs, ln.Addr())
+	}
+	s.handler.SetListenAddrs(addrs)
+
+	if s.metricsServer != nil {
+		ln, err := listen("tcp", s.config.Metrics.Address)
+		if err != nil {
+			return fail(err)
+		}
+		s.metricsListener = ln
+	}
+	return nil
+}
+
+// proxyHeaderError returns the callback for connections a listener
+// closes for lacking a valid PROXY protocol header.
+func (s *Server) proxyHeaderError(name string) func(net.Addr, error) {
+	return func(remote net.Addr, err error) {
+		s.metrics.RecordError("connection", "proxy_protocol_header")
+		s.logger.Debugw("closed connection without a valid PROXY protocol header",
+			"listener", name,
+			"remote", remote.String(),
+			"error", err,
+		)
+	}
+}
+
+// aclDenied returns the callback for connections a listener's ACL
+// refuses.
+func (s *Server) aclDenied(name string) func(net.Addr) {
+	return func(remote net.Addr) {
+		s.metrics.RecordError("connection", "acl_denied")
+		s.logger.Debugw("refused connection by listener ACL",
+			"listener", name,
+			"remote", remote.String(),
+		)
+	}
+}
+
+// Serve accepts connections on the listeners bound by Listen. It blocks
+// until the server shuts down or a listener fails.
+func (s *Server) Serve() error {
 	// Start metrics server if enabled
 	if s.metricsServer != nil {
 		go func() {
 			s.logger.Infow("starting metrics server",
-				"address", s.config.Metrics.Address,
+				"address", s.metricsListener.Addr().String(),
 				"path", s.config.Metrics.Path,
 			)
-			if err := s.metricsServer.Start(); err != nil {
+			if err := s.metricsServer.Serve(s.metricsListener); err != nil {
 				s.logger.Errorw("metrics server error", "error", err)
 			}
 		}()
 	}
 
-	s.logger.Infow("starting proxy server",
-		"address", s.config.Server.Address,
-		"max_conns_per_ip", s.config.Server.MaxConnsPerIP,
-	)
+	errs := make(chan error, len(s.listeners))
+	for _, l := range s.listeners {
+		s.logger.Infow("starting proxy server",
+			"listener", l.cfg.Name,
+			"address", l.ln.Addr().String(),
+			"protocol", l.cfg.Protocol,
+			"max_conns_per_ip", s.config.Server.MaxConnsPerIP,
+		)
+		go func(l *listener) {
+			errs <- l.server.Serve(l.ln)
+		}(l)
+	}
+	for range s.listeners {
+		if err := <-errs; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reload applies the reloadable settings of cfg, which must already be
+// validated: auth users, including those of listeners, routes, upstream
+// TLS, timeouts, the retry policy, rate limits, bandwidth limits,
+// concurrency caps and quota limits. Requests and tunnels already in
+// progress keep the settings they started with, except that quota limits
+// apply to open tunnels too. Reload returns the keys of changed settings
+// that were not applied and need a restart.
+func (s *Server) Reload(cfg *config.Config) (restart []string) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
 
-	return s.server.ListenAndServe(s.config.Server.Address)
+	listenersChanged := s.reloadListenerAuth(cfg)
+	for _, key := range config.Diff(s.config, cfg) {
+		if !isReloadable(key) && (key != "server.listeners" || listenersChanged) {
+			restart = append(restart, key)
+		}
+	}
+
+	cur := s.config
+	if !reflect.DeepEqual(cur.Auth, cfg.Auth) {
+		s.auth.Update(cfg.Auth)
+	}
+	// Pooled hosts hold TLS settings and timeouts from when they were
+	// created, so only retire them when those may have changed.
+	if !reflect.DeepEqual(cur.Routes, cfg.Routes) ||
+		!reflect.DeepEqual(cur.Proxy.TLS, cfg.Proxy.TLS) ||
+		!reflect.DeepEqual(cur.Proxy.Timeouts, cfg.Proxy.Timeouts) ||
+		cur.Proxy.DialTimeout != cfg.Proxy.DialTimeout ||
+		cur.Proxy.ResponseTimeout != cfg.Proxy.ResponseTimeout {
+		s.routes.Update(cfg.Routes)
+		s.pool.Reload(cfg.Proxy)
+	}
+	s.handler.Reload(cfg.Proxy)
+	s.quotas.Update(quotaLimits(cur.Quotas, cfg.Quotas))
+
+	// Remember what is now in effect so the next reload compares
+	// against it.
+	cur.Auth = cfg.Auth
+	cur.Routes = cfg.Routes
+	cur.Logging.Level = cfg.Logging.Level
+	cur.Proxy.Bandwidth = cfg.Proxy.Bandwidth
+	cur.Proxy.Concurrency = cfg.Proxy.Concurrency
+	cur.Proxy.DialTimeout = cfg.Proxy.DialTimeout
+	cur.Proxy.RateLimits = cfg.Proxy.RateLimits
+	cur.Proxy.ResponseTimeout = cfg.Proxy.ResponseTimeout
+	cur.Proxy.Retry = cfg.Proxy.Retry
+	cur.Proxy.Timeouts = cfg.Proxy.Timeouts
+	cur.Proxy.TLS = cfg.Proxy.TLS
+	cur.Quotas = quotaLimits(cur.Quotas, cfg.Quotas)
+	if !listenersChanged {
+		cur.Server.Listeners = cfg.Server.Listeners
+	}
+	return restart
 }
 
-// Shutdown gracefully shuts down the server.
-func (s *Server) Shutdown() error {
-	s.logger.Info("shutting down proxy server...")
+// reloadListenerAuth updates the users of listeners with their own auth
+// block, which also inherit the top-level realm. It reports whether
+// server.listeners changed in anything but those blocks; then the other
+// changes need a restart, though the auth blocks are still applied where
+// the listener kept its place.
+func (s *Server) reloadListenerAuth(cfg *config.Config) (changed bool) {
+	next := cfg.Listeners()
+	if len(next) != len(s.listeners) {
+		return true
+	}
+	for i, l := range s.listeners {
+		lc := next[i]
+		if (l.auth == nil) != (lc.Auth == nil) {
+			changed = true
+			continue
+		}
+		a, b := l.cfg, lc
+		a.Auth, b.Auth = nil, nil
+		if !reflect.DeepEqual(a, b) {
+			changed = true
+		}
+		if l.auth != nil && !reflect.DeepEqual(l.cfg.Auth, lc.Auth) {
+			l.auth.Update(*lc.Auth)
+			l.cfg.Auth = lc.Auth
+		}
+	}
+	return changed
+}
 
-	// Shutdown metrics server
-	if s.metricsServer != nil {
-		if err := s.metricsServer.Shutdown(); err != nil {
-			s.logger.Warnw("error shutting down metrics server", "error", err)
+// quotaLimits returns cur with the limits of next.
+func quotaLimits(cur, next config.QuotaConfig) config.QuotaConfig {
+	cur.Daily = next.Daily
+	cur.Monthly = next.Monthly
+	cur.Groups = next.Groups
+	return cur
+}
+
+// ReopenLogs reopens the access log file, for use after an external tool
+// such as logrotate moved it away.
+func (s *Server) ReopenLogs() error {
+	return s.access.Reopen()
+}
+
+// isReloadable reports whether the setting key can change at runtime.
+func isReloadable(key string) bool {
+	for _, r := range reloadable {
+		if key == r || (strings.HasSuffix(r, ".") && strings.HasPrefix(key, r)) {
+			return true
 		}
 	}
+	return false
+}
 
-	// Shutdown main server
-	return s.server.Shutdown()
+// Shutdown gracefully shuts down the server.
+func (s *Server) Shutdown() error {
+	return s.ShutdownWithContext(context.Background())
 }
 
 // ShutdownWithContext gracefully shuts down the server with context.
+// CONNECT tunnels get up to server.tunnel_drain_timeout (and no longer
+// than ctx allows) to finish before they are closed.
 func (s *Server) ShutdownWithContext(ctx context.Context) error {
 	s.logger.Info("shutting down proxy server...")
 
@@ -119,16 +460,65 @@ func (s *Server) ShutdownWithContext(ctx context.Context) error {
 		}
 	}
 
-	// Shutdown main server with context
+	// Stop accepting tunnels and drain open ones alongside the main server
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		s.drainTunnels(ctx)
+	}()
+
+	// Shutdown main server with context, then release pooled upstream
+	// connections once tunnels are done
+	defer s.pool.Close()
 	done := make(chan error, 1)
 	go func() {
-		done <- s.server.Shutdown()
+		done <- s.shutdownListeners()
 	}()
 
+	var err error
 	select {
-	case err := <-done:
-		return err
+	case err = <-done:
 	case <-ctx.Done():
-		return ctx.Err()
+		err = ctx.Err()
+	}
+	<-drained
+
+	// Save usage counted up to the end
+	if qerr := s.quotas.Close(); qerr != nil {
+		s.logger.Warnw("failed to write quota usage", "error", qerr)
+	}
+	s.access.Sync()
+	return err
+}
+
+// shutdownListeners stops all proxy listeners, waiting for their
+// in-flight requests, and returns the first error.
+func (s *Server) shutdownListeners() error {
+	errs := make(chan error, len(s.listeners))
+	for _, l := range s.listeners {
+		go func(l *listener) {
+			errs <- l.server.Shutdown()
+		}(l)
+	}
+	var first error
+	for range s.listeners {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+		}
 	}
+	return first
+}
+
+// drainTunnels waits for open tunnels to finish, then closes the rest.
+func (s *Server) drainTunnels(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, s.config.Server.TunnelDrainTimeout)
+	defer cancel()
+
+	start := time.Now()
+	drained, closed := s.handler.DrainTunnels(ctx)
+	s.logger.Infow("tunnels drained",
+		"drained", drained,
+		"force_closed", closed,
+		"duration", time.Since(start).Seconds(),
+	)
 }
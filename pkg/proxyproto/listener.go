@@ -0,0 +1,183 @@
+package proxyproto
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// acceptRetryDelay paces Accept after a temporary error, such as running
+// out of file descriptors.
+const acceptRetryDelay = 50 * time.Millisecond
+
+// Listener accepts connections that start with a PROXY protocol header
+// when they come from a trusted source. Headers are read off the accept
+// path, so a slow or silent peer does not hold up other connections, and
+// accepted connections already report the relayed addresses.
+//
+// Connections from trusted sources without a valid header within the
+// timeout are closed. Connections from other sources are passed through
+// unchanged and keep their own addresses.
+type Listener struct {
+	net.Listener
+	trusted []*net.IPNet // nil trusts no source
+	timeout time.Duration
+	onError func(remote net.Addr, err error)
+
+	accepted  chan accepted
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// accepted is the outcome of one accept.
+type accepted struct {
+	conn net.Conn
+	err  error
+}
+
+// NewListener wraps ln. An empty trusted list trusts no source. A zero
+// timeout waits for headers indefinitely. onError, if set, is told about
+// connections closed for a missing or malformed header.
+func NewListener(ln net.Listener, trusted []*net.IPNet, timeout time.Duration, onError func(remote net.Addr, err error)) *Listener {
+	l := &Listener{
+		Listener: ln,
+		trusted:  trusted,
+		timeout:  timeout,
+		onError:  onError,
+		accepted: make(chan accepted),
+		done:     make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+// Accept returns the next connection whose header, if one is required,
+// has been read.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case a := <-l.accepted:
+		return a.conn, a.err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting and closes the underlying listener.
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// acceptLoop accepts raw connections and reads their headers.
+func (l *Listener) acceptLoop() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			var temp interface{ Temporary() bool }
+			if errors.As(err, &temp) && temp.Temporary() {
+				time.Sleep(acceptRetryDelay)
+				continue
+			}
+			l.deliver(accepted{err: err})
+			return
+		}
+		if !l.isTrusted(c.RemoteAddr()) {
+			go l.deliver(accepted{conn: c})
+			continue
+		}
+		go l.handshake(c)
+	}
+}
+
+// handshake reads the header of c and hands the connection to Accept.
+func (l *Listener) handshake(c net.Conn) {
+	if l.timeout > 0 {
+		c.SetReadDeadline(time.Now().Add(l.timeout))
+	}
+	r := bufio.NewReader(c)
+	h, err := ReadHeader(r)
+	if err != nil {
+		if l.onError != nil {
+			l.onError(c.RemoteAddr(), err)
+		}
+		c.Close()
+		return
+	}
+	c.SetReadDeadline(time.Time{})
+	l.deliver(accepted{conn: &Conn{Conn: c, r: r, header: h}})
+}
+
+// deliver passes a to Accept, or drops it once the listener is closed.
+func (l *Listener) deliver(a accepted) {
+	select {
+	case l.accepted <- a:
+	case <-l.done:
+		if a.conn != nil {
+			a.conn.Close()
+		}
+	}
+}
+
+// isTrusted reports whether addr may send a header.
+func (l *Listener) isTrusted(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range l.trusted {
+		if n.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Conn is a connection whose PROXY protocol header has been read. Its
+// addresses are the ones the header relayed.
+type Conn struct {
+	net.Conn
+	r      *bufio.Reader
+	header *Header
+}
+
+// Read reads from the data following the header.
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the original client address.
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the address the client originally connected to.
+func (c *Conn) LocalAddr() net.Addr {
+	if c.header.Destination != nil {
+		return c.header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+// Header returns the header read from the connection.
+func (c *Conn) Header() *Header {
+	return c.header
+}
+
+// NetConn returns the underlying connection.
+func (c *Conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// CloseWrite shuts down the writing side if the underlying connection
+// supports it.
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("proxyproto: half-close not supported")
+}
@@ -0,0 +1,252 @@
+// Package proxyproto reads HAProxy PROXY protocol headers (versions 1
+// and 2) so that connections relayed by a load balancer report the
+// original client address, and writes version 2 headers for backends
+// that want the same from the proxy.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// signatureV2 starts every version 2 header.
+var signatureV2 = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// maxV1Length is the longest valid version 1 header, CRLF included.
+const maxV1Length = 107
+
+// Version 2 commands and address families.
+const (
+	cmdLocal = 0x0
+	cmdProxy = 0x1
+
+	famUnspec = 0x00
+	famTCP4   = 0x11
+	famUDP4   = 0x12
+	famTCP6   = 0x21
+	famUDP6   = 0x22
+	famUnix   = 0x31
+	famUnixDg = 0x32
+)
+
+// addrLen is the size of the address block of each v2 family.
+var addrLen = map[byte]int{
+	famTCP4: 12, famUDP4: 12,
+	famTCP6: 36, famUDP6: 36,
+	famUnix: 216, famUnixDg: 216,
+}
+
+// TLV types used by the proxy.
+const (
+	TypeAuthority = 0x02 // PP2_TYPE_AUTHORITY: host name the client asked for (SNI)
+	TypeUser      = 0xE0 // first custom type: user authenticated by the proxy
+)
+
+// TLV is a type-length-value extension carried by a version 2 header.
+type TLV struct {
+	Type  byte
+	Value []byte
+}
+
+// ErrNoHeader is returned when a connection does not start with a PROXY
+// protocol header.
+var ErrNoHeader = errors.New("proxyproto: missing PROXY protocol header")
+
+// Header is a parsed PROXY protocol header. Source and Destination are
+// nil when the sender relayed no addresses (v1 UNKNOWN, v2 LOCAL or a
+// non-TCP family), in which case the connection's own addresses apply.
+type Header struct {
+	Version     int
+	Source      *net.TCPAddr
+	Destination *net.TCPAddr
+	TLVs        []TLV // version 2 only
+}
+
+// TLV returns the value of the first TLV of type typ.
+func (h *Header) TLV(typ byte) ([]byte, bool) {
+	for _, t := range h.TLVs {
+		if t.Type == typ {
+			return t.Value, true
+		}
+	}
+	return nil, false
+}
+
+// AppendV2 appends h, encoded as a version 2 PROXY header, to b. Both
+// addresses must be set for them to be relayed; otherwise the header
+// carries only the TLVs and the receiver keeps the connection's own
+// addresses. An IPv4 address paired with an IPv6 one is sent in its
+// IPv4-mapped form.
+func (h *Header) AppendV2(b []byte) ([]byte, error) {
+	var addrs []byte
+	fam := byte(famUnspec)
+	if h.Source != nil && h.Destination != nil {
+		src4, dst4 := h.Source.IP.To4(), h.Destination.IP.To4()
+		if src4 != nil && dst4 != nil {
+			fam = famTCP4
+			addrs = append(append(addrs, src4...), dst4...)
+		} else {
+			fam = famTCP6
+			addrs = append(append(addrs, h.Source.IP.To16()...), h.Destination.IP.To16()...)
+		}
+		addrs = binary.BigEndian.AppendUint16(addrs, uint16(h.Source.Port))
+		addrs = binary.BigEndian.AppendUint16(addrs, uint16(h.Destination.Port))
+	}
+
+	length := len(addrs)
+	for _, t := range h.TLVs {
+		length += 3 + len(t.Value)
+	}
+	if length > 0xffff {
+		return nil, errors.New("proxyproto: v2 header too long")
+	}
+
+	b = append(b, signatureV2...)
+	b = append(b, 0x20|cmdProxy, fam)
+	b = binary.BigEndian.AppendUint16(b, uint16(length))
+	b = append(b, addrs...)
+	for _, t := range h.TLVs {
+		b = append(b, t.Type)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(t.Value)))
+		b = append(b, t.Value...)
+	}
+	return b, nil
+}
+
+// ReadHeader reads a version 1 or 2 header from r.
+func ReadHeader(r *bufio.Reader) (*Header, error) {
+	// Every valid header is at least as long as the v2 signature.
+	sig, err := r.Peek(len(signatureV2))
+	if err != nil {
+		return nil, fmt.Errorf("proxyproto: read header: %w", err)
+	}
+	switch {
+	case bytes.Equal(sig, signatureV2):
+		return readV2(r)
+	case bytes.HasPrefix(sig, []byte("PROXY ")):
+		return readV1(r)
+	}
+	return nil, ErrNoHeader
+}
+
+// readV1 parses "PROXY TCP4 src dst sport dport\r\n".
+func readV1(r *bufio.Reader) (*Header, error) {
+	var line []byte
+	for len(line) < maxV1Length {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("proxyproto: read v1 header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("proxyproto: v1 header too long or not CRLF-terminated")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	h := &Header{Version: 1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return h, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("proxyproto: malformed v1 header %q", line)
+	}
+	src, err := parseV1Addr(fields[1], fields[2], fields[4])
+	if err != nil {
+		return nil, err
+	}
+	dst, err := parseV1Addr(fields[1], fields[3], fields[5])
+	if err != nil {
+		return nil, err
+	}
+	h.Source, h.Destination = src, dst
+	return h, nil
+}
+
+// parseV1Addr parses an address and port of the given v1 protocol.
+func parseV1Addr(proto, ip, port string) (*net.TCPAddr, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil || (proto == "TCP4") != (addr.To4() != nil) {
+		return nil, fmt.Errorf("proxyproto: invalid %s address %q", proto, ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("proxyproto: invalid port %q", port)
+	}
+	return &net.TCPAddr{IP: addr, Port: int(p)}, nil
+}
+
+// readV2 parses a binary header.
+func readV2(r *bufio.Reader) (*Header, error) {
+	var fixed [16]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return nil, fmt.Errorf("proxyproto: read v2 header: %w", err)
+	}
+	if fixed[12]>>4 != 2 {
+		return nil, fmt.Errorf("proxyproto: unsupported version %d", fixed[12]>>4)
+	}
+	cmd, fam := fixed[12]&0x0f, fixed[13]
+	body := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("proxyproto: read v2 addresses: %w", err)
+	}
+
+	h := &Header{Version: 2}
+	switch cmd {
+	case cmdLocal:
+		return h, nil
+	case cmdProxy:
+	default:
+		return nil, fmt.Errorf("proxyproto: unknown v2 command %d", cmd)
+	}
+
+	switch fam {
+	case famTCP4:
+		if len(body) < 12 {
+			return nil, errors.New("proxyproto: v2 IPv4 addresses truncated")
+		}
+		h.Source = &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}
+		h.Destination = &net.TCPAddr{IP: net.IP(body[4:8]), Port: int(binary.BigEndian.Uint16(body[10:12]))}
+	case famTCP6:
+		if len(body) < 36 {
+			return nil, errors.New("proxyproto: v2 IPv6 addresses truncated")
+		}
+		h.Source = &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}
+		h.Destination = &net.TCPAddr{IP: net.IP(body[16:32]), Port: int(binary.BigEndian.Uint16(body[34:36]))}
+	}
+	if n := addrLen[fam]; len(body) >= n {
+		tlvs, err := parseTLVs(body[n:])
+		if err != nil {
+			return nil, err
+		}
+		h.TLVs = tlvs
+	}
+	return h, nil
+}
+
+// parseTLVs splits the TLVs following the addresses of a v2 header.
+func parseTLVs(b []byte) ([]TLV, error) {
+	var tlvs []TLV
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return nil, errors.New("proxyproto: v2 TLV truncated")
+		}
+		n := int(binary.BigEndian.Uint16(b[1:3]))
+		if len(b) < 3+n {
+			return nil, errors.New("proxyproto: v2 TLV truncated")
+		}
+		tlvs = append(tlvs, TLV{Type: b[0], Value: b[3 : 3+n]})
+		b = b[3+n:]
+	}
+	return tlvs, nil
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package quota
+
+import "os"
+
+// lockFile does nothing: without flock, only one process may use the
+// usage log at a time.
+func lockFile(f *os.File) error {
+	return nil
+}
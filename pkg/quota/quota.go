@@ -0,0 +1,290 @@
+// Package quota enforces per-user daily and monthly byte and request
+// quotas and keeps usage in a file so that it survives restarts.
+package quota
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/config"
+)
+
+// ErrExceeded is returned once a user has used up a quota.
+var ErrExceeded = errors.New("quota exceeded")
+
+// compactSize is the log size past which a flush compacts it.
+const compactSize = 1 << 20
+
+// Usage is the traffic of a user in a period.
+type Usage struct {
+	Bytes    int64
+	Requests int64
+}
+
+// Tracker counts usage and checks it against the limits. A nil Tracker
+// allows everything; so do all methods for requests without a user.
+type Tracker struct {
+	store  *store
+	cfg    atomic.Pointer[config.QuotaConfig]
+	logger *zap.SugaredLogger
+
+	mu      sync.Mutex
+	usage   map[key]*Usage // totals, including pending
+	pending map[key]*Usage // not yet written to the log
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Open loads usage from cfg.File and starts writing to it every
+// cfg.FlushInterval. It returns nil if quotas are disabled.
+func Open(cfg config.QuotaConfig, logger *zap.SugaredLogger) (*Tracker, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	s := &store{path: cfg.File}
+	usage, err := s.compact(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	t := &Tracker{
+		store:   s,
+		logger:  logger,
+		usage:   usage,
+		pending: make(map[key]*Usage),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	t.cfg.Store(&cfg)
+	go t.flushLoop(cfg.FlushInterval)
+	return t, nil
+}
+
+// Update replaces the limits. The file and flush interval stay as they
+// were opened.
+func (t *Tracker) Update(cfg config.QuotaConfig) {
+	if t == nil {
+		return
+	}
+	t.cfg.Store(&cfg)
+}
+
+// Check returns ErrExceeded and how long until the quota resets if user
+// has used up a quota. It counts nothing; see AddRequest.
+func (t *Tracker) Check(user string) (time.Duration, error) {
+	if t == nil || user == "" {
+		return 0, nil
+	}
+	now := time.Now().UTC()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if reset, over := t.exceeded(user, now); over {
+		return reset, ErrExceeded
+	}
+	return 0, nil
+}
+
+// AddRequest counts a request by user.
+func (t *Tracker) AddRequest(user string) {
+	if t == nil || user == "" {
+		return
+	}
+	now := time.Now().UTC()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.add(user, now, Usage{Requests: 1})
+}
+
+// Add counts n bytes transferred by user. It returns ErrExceeded once
+// user has used up a quota.
+func (t *Tracker) Add(user string, n int64) error {
+	if t == nil || user == "" || n <= 0 {
+		return nil
+	}
+	now := time.Now().UTC()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.add(user, now, Usage{Bytes: n})
+	if _, over := t.exceeded(user, now); over {
+		return ErrExceeded
+	}
+	return nil
+}
+
+// Reader counts the bytes read from r against user's quotas, and fails
+// with ErrExceeded once they are used up.
+func (t *Tracker) Reader(user string, r io.Reader) io.Reader {
+	if t == nil || user == "" {
+		return r
+	}
+	return &reader{r: r, t: t, user: user}
+}
+
+// Flush writes pending usage to the log, compacting it once it has
+// grown.
+func (t *Tracker) Flush() error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	pending := t.pending
+	t.pending = make(map[key]*Usage)
+	t.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	size, err := t.store.append(records(pending))
+	if err != nil {
+		// Keep the usage for the next attempt.
+		t.mu.Lock()
+		for k, u := range pending {
+			addTo(t.pending, k, *u)
+		}
+		t.mu.Unlock()
+		return err
+	}
+	if size < compactSize {
+		return nil
+	}
+
+	// Take the totals from the log, which also has the usage of any other
+	// process writing to it, plus what was counted since.
+	usage, err := t.store.compact(time.Now())
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	for k, u := range t.pending {
+		addTo(usage, k, *u)
+	}
+	t.usage = usage
+	t.mu.Unlock()
+	return nil
+}
+
+// Close stops the periodic flush and writes what is pending.
+func (t *Tracker) Close() error {
+	if t == nil {
+		return nil
+	}
+	close(t.stop)
+	<-t.done
+	return t.Flush()
+}
+
+// Usage returns the usage of user today and this month.
+func (t *Tracker) Usage(user string) (today, month Usage) {
+	if t == nil {
+		return Usage{}, Usage{}
+	}
+	now := time.Now().UTC()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if u := t.usage[key{user, now.Format(dayFormat)}]; u != nil {
+		today = *u
+	}
+	if u := t.usage[key{user, now.Format(monthFormat)}]; u != nil {
+		month = *u
+	}
+	return today, month
+}
+
+// flushLoop flushes every interval until Close.
+func (t *Tracker) flushLoop(interval time.Duration) {
+	defer close(t.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := t.Flush(); err != nil {
+				t.logger.Warnw("failed to write quota usage", "file", t.store.path, "error", err)
+			}
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// add counts u for user today and this month. The caller must hold t.mu.
+func (t *Tracker) add(user string, now time.Time, u Usage) {
+	for _, period := range []string{now.Format(dayFormat), now.Format(monthFormat)} {
+		k := key{user, period}
+		addTo(t.usage, k, u)
+		addTo(t.pending, k, u)
+	}
+}
+
+// exceeded reports whether user has used up a quota, and how long until
+// it resets. The caller must hold t.mu.
+func (t *Tracker) exceeded(user string, now time.Time) (time.Duration, bool) {
+	daily, monthly := t.cfg.Load().Limits(user)
+	if over(t.usage[key{user, now.Format(dayFormat)}], daily) {
+		y, m, d := now.Date()
+		return time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC).Sub(now), true
+	}
+	if over(t.usage[key{user, now.Format(monthFormat)}], monthly) {
+		y, m, _ := now.Date()
+		return time.Date(y, m+1, 1, 0, 0, 0, 0, time.UTC).Sub(now), true
+	}
+	return 0, false
+}
+
+// over reports whether u has reached a limit in l.
+func over(u *Usage, l config.QuotaLimit) bool {
+	if u == nil {
+		return false
+	}
+	return (l.Bytes > 0 && u.Bytes >= l.Bytes) || (l.Requests > 0 && u.Requests >= l.Requests)
+}
+
+// addTo adds u to m[k].
+func addTo(m map[key]*Usage, k key, u Usage) {
+	cur, ok := m[k]
+	if !ok {
+		cur = &Usage{}
+		m[k] = cur
+	}
+	cur.Bytes += u.Bytes
+	cur.Requests += u.Requests
+}
+
+// records returns usage as records sorted by user and period.
+func records(usage map[key]*Usage) []Record {
+	recs := make([]Record, 0, len(usage))
+	for k, u := range usage {
+		recs = append(recs, Record{User: k.user, Period: k.period, Bytes: u.Bytes, Requests: u.Requests})
+	}
+	sort.Slice(recs, func(i, j int) bool {
+		if recs[i].User != recs[j].User {
+			return recs[i].User < recs[j].User
+		}
+		return recs[i].Period < recs[j].Period
+	})
+	return recs
+}
+
+// reader counts reads against a user's quotas.
+type reader struct {
+	r    io.Reader
+	t    *Tracker
+	user string
+}
+
+func (r *reader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if qerr := r.t.Add(r.user, int64(n)); qerr != nil && err == nil {
+		err = qerr
+	}
+	return n, err
+}
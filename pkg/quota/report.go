@@ -0,0 +1,84 @@
+package quota
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// Report formats.
+const (
+	FormatJSON = "json"
+	FormatCSV  = "csv"
+)
+
+// Report returns the usage this process knows of, sorted by user and
+// period.
+func (t *Tracker) Report() []Record {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return records(t.usage)
+}
+
+// ReadReport returns the usage recorded in the log at path, for reports
+// while the proxy is not running.
+func ReadReport(path string) ([]Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	usage, err := readUsage(f)
+	if err != nil {
+		return nil, err
+	}
+	return records(usage), nil
+}
+
+// WriteReport writes recs to w as JSON or CSV.
+func WriteReport(w io.Writer, recs []Record, format string) error {
+	switch format {
+	case FormatJSON:
+		if recs == nil {
+			recs = []Record{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(recs)
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"user", "period", "bytes", "requests"})
+		for _, r := range recs {
+			cw.Write([]string{r.User, r.Period, strconv.FormatInt(r.Bytes, 10), strconv.FormatInt(r.Requests, 10)})
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+	return fmt.Errorf("unknown report format %q (want json or csv)", format)
+}
+
+// ReportHandler serves the usage report, as JSON unless the format query
+// parameter asks for csv.
+func (t *Tracker) ReportHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		format := r.URL.Query().Get("format")
+		switch format {
+		case "", FormatJSON:
+			format = FormatJSON
+			w.Header().Set("Content-Type", "application/json")
+		case FormatCSV:
+			w.Header().Set("Content-Type", "text/csv")
+		default:
+			http.Error(w, "format must be json or csv", http.StatusBadRequest)
+			return
+		}
+		WriteReport(w, t.Report(), format)
+	})
+}
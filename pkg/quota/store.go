@@ -0,0 +1,178 @@
+package quota
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// dailyRetention is how long compaction keeps daily usage. Monthly usage
+// is kept indefinitely.
+const dailyRetention = 90 * 24 * time.Hour
+
+// Period formats.
+const (
+	dayFormat   = "2006-01-02"
+	monthFormat = "2006-01"
+)
+
+// Record is the usage of a user in a period: a day (2006-01-02) or a
+// month (2006-01), in UTC. Each line of the usage log is a Record that
+// adds to the user's usage in the period.
+type Record struct {
+	User     string `json:"user"`
+	Period   string `json:"period"`
+	Bytes    int64  `json:"bytes"`
+	Requests int64  `json:"requests"`
+}
+
+// key identifies the usage of a user in a period.
+type key struct {
+	user   string
+	period string
+}
+
+// store is the usage log, one JSON record per line. Several processes
+// may write to it at once, as during an upgrade: appends and compaction
+// hold an exclusive lock, and an append that finds the file replaced by
+// compaction while it waited reopens it.
+type store struct {
+	path string
+}
+
+// append writes recs to the log and returns its new size.
+func (s *store) append(recs []Record) (int64, error) {
+	var buf []byte
+	for _, r := range recs {
+		b, err := json.Marshal(r)
+		if err != nil {
+			return 0, err
+		}
+		buf = append(append(buf, b...), '\n')
+	}
+
+	for {
+		f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+		if err != nil {
+			return 0, err
+		}
+		if err := lockFile(f); err != nil {
+			f.Close()
+			return 0, err
+		}
+		if !s.current(f) {
+			f.Close()
+			continue
+		}
+		_, err = f.Write(buf)
+		var size int64
+		if fi, serr := f.Stat(); serr == nil {
+			size = fi.Size()
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		return size, err
+	}
+}
+
+// compact rewrites the log with one record per user and period, dropping
+// daily usage older than dailyRetention, and returns the totals.
+func (s *store) compact(now time.Time) (map[key]*Usage, error) {
+	for {
+		f, err := os.OpenFile(s.path, os.O_RDONLY|os.O_CREATE, 0o640)
+		if err != nil {
+			return nil, err
+		}
+		if err := lockFile(f); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if !s.current(f) {
+			f.Close()
+			continue
+		}
+		usage, err := s.rewrite(f, now)
+		f.Close()
+		return usage, err
+	}
+}
+
+// rewrite replaces the log, locked and open as f, with its totals.
+func (s *store) rewrite(f *os.File, now time.Time) (map[key]*Usage, error) {
+	usage, err := readUsage(f)
+	if err != nil {
+		return nil, err
+	}
+	oldest := now.Add(-dailyRetention).UTC().Format(dayFormat)
+	for k := range usage {
+		if len(k.period) == len(dayFormat) && k.period < oldest {
+			delete(usage, k)
+		}
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, r := range records(usage) {
+		if err := enc.Encode(r); err != nil {
+			tmp.Close()
+			return nil, err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if fi, err := f.Stat(); err == nil {
+		tmp.Chmod(fi.Mode().Perm())
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// current reports whether f is still the file at s.path.
+func (s *store) current(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	pi, err := os.Stat(s.path)
+	return err == nil && os.SameFile(fi, pi)
+}
+
+// readUsage sums the records in r. Lines that do not parse, such as one
+// cut short by a crash, are skipped.
+func readUsage(r io.Reader) (map[key]*Usage, error) {
+	usage := make(map[key]*Usage)
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		var rec Record
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil || rec.User == "" || rec.Period == "" {
+			continue
+		}
+		addTo(usage, key{rec.User, rec.Period}, Usage{Bytes: rec.Bytes, Requests: rec.Requests})
+	}
+	if err := sc.Err(); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return usage, nil
+}
@@ -0,0 +1,233 @@
+// Package ratelimit limits how fast requests and CONNECT tunnels may
+// start, with a token bucket per client IP, user or destination.
+package ratelimit
+
+import (
+	"math"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/config"
+)
+
+// sweepInterval bounds how often refilled buckets are purged.
+const sweepInterval = time.Minute
+
+// Kind is what a request starts.
+type Kind int
+
+// Kinds of requests, each limited by its own rate.
+const (
+	Request Kind = iota // a plain HTTP request
+	Tunnel              // a CONNECT tunnel
+)
+
+// String returns the kind as used in metric labels.
+func (k Kind) String() string {
+	if k == Tunnel {
+		return "tunnel"
+	}
+	return "http"
+}
+
+// Client identifies who a request comes from and where it goes.
+type Client struct {
+	IP          net.IP
+	User        string // verified user, empty when not authenticated
+	Destination string // host, with or without a port
+}
+
+// Limiter applies the configured rules. The rules can be replaced while
+// the Limiter is in use.
+type Limiter struct {
+	state atomic.Pointer[state]
+}
+
+// state is the configuration in effect and the rules built from it.
+type state struct {
+	cfg   config.RateLimitConfig
+	rules []*rule
+}
+
+// rule is a configured rule with its buckets.
+type rule struct {
+	name     string
+	key      string
+	users    map[string]bool
+	clients  []*net.IPNet
+	rates    [2]float64 // by Kind
+	capacity [2]float64
+
+	mu        sync.Mutex
+	buckets   map[bucketKey]*bucket
+	lastSweep time.Time
+}
+
+type bucketKey struct {
+	kind  Kind
+	value string
+}
+
+// bucket holds the tokens of one key value.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// New creates a Limiter from configuration. Rules are assumed to have
+// been validated.
+func New(cfg config.RateLimitConfig) *Limiter {
+	l := &Limiter{}
+	l.Update(cfg)
+	return l
+}
+
+// Update replaces the rules unless cfg is unchanged. Buckets of new rules
+// start full.
+func (l *Limiter) Update(cfg config.RateLimitConfig) {
+	if cur := l.state.Load(); cur != nil && reflect.DeepEqual(cur.cfg, cfg) {
+		return
+	}
+	rules := make([]*rule, 0, len(cfg.Rules))
+	for _, rc := range cfg.Rules {
+		r := &rule{
+			name:      rc.Name,
+			key:       rc.Key,
+			rates:     [2]float64{rc.RequestsPerSecond, rc.TunnelsPerSecond},
+			buckets:   make(map[bucketKey]*bucket),
+			lastSweep: time.Now(),
+		}
+		if r.name == "" {
+			r.name = rc.Key
+		}
+		if len(rc.Users) > 0 {
+			r.users = make(map[string]bool, len(rc.Users))
+			for _, u := range rc.Users {
+				r.users[u] = true
+			}
+		}
+		r.clients, _ = rc.ClientNets()
+		for k, rate := range r.rates {
+			r.capacity[k] = float64(rc.Burst)
+			if rc.Burst == 0 {
+				r.capacity[k] = math.Max(1, math.Ceil(rate))
+			}
+		}
+		rules = append(rules, r)
+	}
+	l.state.Store(&state{cfg: cfg, rules: rules})
+}
+
+// Allow takes a token for a request of kind k by c from the first
+// matching rule of each key. If one of them has none left, it returns
+// that rule's name and how long until a token is available.
+func (l *Limiter) Allow(k Kind, c Client) (rule string, retryAfter time.Duration, ok bool) {
+	if l == nil {
+		return "", 0, true
+	}
+	now := time.Now()
+	var seen [3]bool
+	for _, r := range l.state.Load().rules {
+		i := keyIndex(r.key)
+		if seen[i] || !r.matches(c) {
+			continue
+		}
+		seen[i] = true
+		if r.rates[k] == 0 {
+			continue
+		}
+		value := r.value(c)
+		if value == "" {
+			continue
+		}
+		if wait := r.take(k, value, now); wait > 0 {
+			return r.name, wait, false
+		}
+	}
+	return "", 0, true
+}
+
+// keyIndex numbers the keys so that Allow can track which it has seen.
+func keyIndex(key string) int {
+	switch key {
+	case config.RateLimitKeyUser:
+		return 1
+	case config.RateLimitKeyDestination:
+		return 2
+	}
+	return 0
+}
+
+// matches reports whether c belongs to the rule's identity group.
+func (r *rule) matches(c Client) bool {
+	if r.users != nil && !r.users[c.User] {
+		return false
+	}
+	if r.clients == nil {
+		return true
+	}
+	for _, n := range r.clients {
+		if n.Contains(c.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// value returns the bucket key of c, or "" if c has none.
+func (r *rule) value(c Client) string {
+	switch r.key {
+	case config.RateLimitKeyUser:
+		return c.User
+	case config.RateLimitKeyDestination:
+		host := c.Destination
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return strings.ToLower(strings.TrimSuffix(host, "."))
+	}
+	if c.IP == nil {
+		return ""
+	}
+	return c.IP.String()
+}
+
+// take removes a token from the bucket of value, or returns how long
+// until one is available.
+func (r *rule) take(k Kind, value string, now time.Time) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if now.Sub(r.lastSweep) >= sweepInterval {
+		r.sweep(now)
+	}
+
+	key := bucketKey{k, value}
+	b, ok := r.buckets[key]
+	if !ok {
+		b = &bucket{tokens: r.capacity[k], last: now}
+		r.buckets[key] = b
+	}
+	b.tokens = math.Min(r.capacity[k], b.tokens+now.Sub(b.last).Seconds()*r.rates[k])
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / r.rates[k] * float64(time.Second))
+}
+
+// sweep removes buckets that have refilled, since a new bucket would
+// start in the same state. The caller must hold r.mu.
+func (r *rule) sweep(now time.Time) {
+	for key, b := range r.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*r.rates[key.kind] >= r.capacity[key.kind] {
+			delete(r.buckets, key)
+		}
+	}
+	r.lastSweep = now
+}
@@ -0,0 +1,119 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/config"
+)
+
+// dnsMessageType is the media type for DNS wire format (RFC 8484).
+const dnsMessageType = "application/dns-message"
+
+// maxMessageSize bounds the size of a DNS response body.
+const maxMessageSize = 65535
+
+// doh is a DNS-over-HTTPS upstream. Its HTTP client keeps connections
+// alive so repeated queries reuse the same TLS session.
+type doh struct {
+	url    string
+	method string
+	client *http.Client
+}
+
+// newDoH creates a DoH upstream from its configuration.
+func newDoH(cfg config.DNSUpstreamConfig, timeout time.Duration) *doh {
+	dialer := &net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}
+	transport := &http.Transport{
+		DialContext:         dialer.DialContext,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: timeout,
+		TLSClientConfig:     &tls.Config{ServerName: cfg.ServerName},
+	}
+	if cfg.Bootstrap != "" {
+		transport.DialContext = bootstrapDial(dialer, cfg.Bootstrap)
+	}
+
+	method := cfg.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+
+	return &doh{
+		url:    cfg.Address,
+		method: method,
+		client: &http.Client{Transport: transport},
+	}
+}
+
+func (d *doh) lookup(ctx context.Context, name string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	query, err := buildQuery(0, name, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var req *http.Request
+	if d.method == http.MethodGet {
+		var u *url.URL
+		u, err = url.Parse(d.url)
+		if err != nil {
+			return nil, 0, err
+		}
+		q := u.Query()
+		q.Set("dns", base64.RawURLEncoding.EncodeToString(query))
+		u.RawQuery = q.Encode()
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(query))
+		if req != nil {
+			req.Header.Set("Content-Type", dnsMessageType)
+		}
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Accept", dnsMessageType)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxMessageSize))
+	if err != nil {
+		return nil, 0, err
+	}
+	return parseAnswer(0, body, qtype)
+}
+
+func (d *doh) String() string {
+	return "doh " + d.url
+}
+
+// bootstrapDial returns a dial function that connects to ip instead of
+// resolving the upstream's own hostname, keeping the port from addr.
+func bootstrapDial(dialer *net.Dialer, ip string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		return dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+	}
+}
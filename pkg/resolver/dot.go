@@ -0,0 +1,135 @@
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/config"
+)
+
+// dotIdleTimeout closes a DoT connection that has not been used recently.
+const dotIdleTimeout = 60 * time.Second
+
+// dot is a DNS-over-TLS upstream. A single connection is kept open and
+// reused for successive queries; it is re-established after an error.
+type dot struct {
+	addr      string
+	dialAddr  string
+	timeout   time.Duration
+	tlsConfig *tls.Config
+
+	mu       sync.Mutex
+	conn     net.Conn
+	lastUsed time.Time
+}
+
+// newDoT creates a DoT upstream from its configuration.
+func newDoT(cfg config.DNSUpstreamConfig, timeout time.Duration) *dot {
+	host, port, _ := net.SplitHostPort(cfg.Address)
+
+	serverName := cfg.ServerName
+	if serverName == "" {
+		serverName = host
+	}
+	dialAddr := cfg.Address
+	if cfg.Bootstrap != "" {
+		dialAddr = net.JoinHostPort(cfg.Bootstrap, port)
+	}
+
+	return &dot{
+		addr:      cfg.Address,
+		dialAddr:  dialAddr,
+		timeout:   timeout,
+		tlsConfig: &tls.Config{ServerName: serverName, ClientSessionCache: tls.NewLRUClientSessionCache(4)},
+	}
+}
+
+func (d *dot) lookup(ctx context.Context, name string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	id := uint16(rand.Intn(1 << 16))
+	query, err := buildQuery(id, name, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// A reused connection may have been closed by the server; retry once
+	// on a fresh connection before giving up.
+	reused := d.conn != nil && time.Since(d.lastUsed) < dotIdleTimeout
+	resp, err := d.exchange(ctx, query)
+	if err != nil && reused && ctx.Err() == nil {
+		resp, err = d.exchange(ctx, query)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return parseAnswer(id, resp, qtype)
+}
+
+// exchange sends a length-prefixed query and reads the response.
+// The caller must hold d.mu.
+func (d *dot) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	if d.conn != nil && time.Since(d.lastUsed) >= dotIdleTimeout {
+		d.conn.Close()
+		d.conn = nil
+	}
+	if d.conn == nil {
+		dialer := &tls.Dialer{
+			NetDialer: &net.Dialer{Timeout: d.timeout},
+			Config:    d.tlsConfig,
+		}
+		conn, err := dialer.DialContext(ctx, "tcp", d.dialAddr)
+		if err != nil {
+			return nil, err
+		}
+		d.conn = conn
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(d.timeout)
+	}
+	d.conn.SetDeadline(deadline)
+
+	resp, err := d.roundTrip(query)
+	if err != nil {
+		d.conn.Close()
+		d.conn = nil
+		return nil, err
+	}
+	d.lastUsed = time.Now()
+	return resp, nil
+}
+
+// roundTrip writes one framed message and reads one framed reply.
+func (d *dot) roundTrip(query []byte) ([]byte, error) {
+	buf := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(buf, uint16(len(query)))
+	copy(buf[2:], query)
+	if _, err := d.conn.Write(buf); err != nil {
+		return nil, err
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(d.conn, length[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(d.conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (d *dot) String() string {
+	return "dot " + d.addr
+}
@@ -0,0 +1,294 @@
+// Package resolver provides hostname resolution for upstream dials.
+// It supports DNS-over-HTTPS (RFC 8484), DNS-over-TLS (RFC 7858) and the
+// system resolver, tried in configured order, with a shared answer cache.
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/config"
+)
+
+// negativeTTL is how long, in seconds, an empty answer without an SOA
+// record is cached.
+const negativeTTL = 30
+
+// Cache bounds: expired entries are swept at most once per sweepInterval
+// when an answer is stored, and once the cache holds maxCacheEntries
+// unexpired answers, arbitrary ones are dropped to make room.
+const (
+	maxCacheEntries = 10000
+	sweepInterval   = time.Minute
+)
+
+// ErrNoAddresses is returned when a name resolves to no usable addresses.
+var ErrNoAddresses = errors.New("no addresses found")
+
+// upstream is a single resolver that can answer one query type for a name.
+type upstream interface {
+	lookup(ctx context.Context, name string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error)
+	String() string
+}
+
+// cacheEntry holds resolved addresses until they expire.
+type cacheEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+// Resolver resolves hostnames through an ordered list of upstreams.
+type Resolver struct {
+	upstreams []upstream
+	timeout   time.Duration
+	maxTTL    time.Duration
+
+	mu    sync.RWMutex
+	cache map[string]cacheEntry
+	swept time.Time // when expired entries were last removed
+}
+
+// New creates a Resolver from the DNS configuration.
+func New(cfg config.DNSConfig) *Resolver {
+	r := &Resolver{
+		timeout: cfg.Timeout,
+		maxTTL:  cfg.CacheDuration,
+		cache:   make(map[string]cacheEntry),
+	}
+	if r.timeout <= 0 {
+		r.timeout = 5 * time.Second
+	}
+
+	for _, u := range cfg.Upstreams {
+		switch u.Type {
+		case "doh":
+			r.upstreams = append(r.upstreams, newDoH(u, r.timeout))
+		case "dot":
+			r.upstreams = append(r.upstreams, newDoT(u, r.timeout))
+		default:
+			r.upstreams = append(r.upstreams, &system{ttl: r.maxTTL})
+		}
+	}
+	if len(r.upstreams) == 0 {
+		r.upstreams = []upstream{&system{ttl: r.maxTTL}}
+	}
+
+	return r
+}
+
+// LookupIP returns the addresses of host for network, which is "ip4",
+// "ip6" or "ip" for both. With "ip", IPv4 addresses are listed first.
+func (r *Resolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		is4 := ip.To4() != nil
+		if (network == "ip4" && !is4) || (network == "ip6" && is4) {
+			return nil, fmt.Errorf("lookup %s: %w", host, ErrNoAddresses)
+		}
+		return []net.IP{ip}, nil
+	}
+
+	switch network {
+	case "ip4":
+		return r.lookupFamily(ctx, host, dnsmessage.TypeA)
+	case "ip6":
+		return r.lookupFamily(ctx, host, dnsmessage.TypeAAAA)
+	}
+
+	var wg sync.WaitGroup
+	var v4, v6 []net.IP
+	var err4, err6 error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		v4, err4 = r.lookupFamily(ctx, host, dnsmessage.TypeA)
+	}()
+	go func() {
+		defer wg.Done()
+		v6, err6 = r.lookupFamily(ctx, host, dnsmessage.TypeAAAA)
+	}()
+	wg.Wait()
+
+	if len(v4) == 0 && len(v6) == 0 {
+		if err4 != nil {
+			return nil, err4
+		}
+		return nil, err6
+	}
+	ips := make([]net.IP, 0, len(v4)+len(v6))
+	return append(append(ips, v4...), v6...), nil
+}
+
+// lookupFamily resolves one record type and reports an error if it
+// yields no addresses.
+func (r *Resolver) lookupFamily(ctx context.Context, host string, qtype dnsmessage.Type) ([]net.IP, error) {
+	ips, err := r.lookupType(ctx, host, qtype)
+	if err == nil && len(ips) == 0 {
+		err = ErrNoAddresses
+	}
+	if err != nil {
+		return nil, fmt.Errorf("lookup %s: %w", host, err)
+	}
+	return ips, nil
+}
+
+// lookupType resolves one record type, consulting the cache first and
+// falling back through the upstreams in order on failure.
+func (r *Resolver) lookupType(ctx context.Context, host string, qtype dnsmessage.Type) ([]net.IP, error) {
+	key := qtype.String() + ":" + strings.ToLower(host)
+
+	r.mu.RLock()
+	entry, ok := r.cache[key]
+	r.mu.RUnlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.ips, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	var lastErr error
+	for _, u := range r.upstreams {
+		ips, ttl, err := u.lookup(ctx, host, qtype)
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %w", u, err)
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		if r.maxTTL > 0 && ttl > r.maxTTL {
+			ttl = r.maxTTL
+		}
+		if ttl > 0 {
+			r.store(key, ips, ttl)
+		}
+		return ips, nil
+	}
+	return nil, lastErr
+}
+
+// store caches ips under key for ttl, keeping the cache within its
+// bounds.
+func (r *Resolver) store(key string, ips []net.IP, ttl time.Duration) {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if now.Sub(r.swept) >= sweepInterval || len(r.cache) >= maxCacheEntries {
+		for k, e := range r.cache {
+			if !now.Before(e.expires) {
+				delete(r.cache, k)
+			}
+		}
+		r.swept = now
+	}
+	for k := range r.cache {
+		if len(r.cache) < maxCacheEntries {
+			break
+		}
+		delete(r.cache, k)
+	}
+	r.cache[key] = cacheEntry{ips: ips, expires: now.Add(ttl)}
+}
+
+// system resolves names using the operating system resolver.
+type system struct {
+	ttl time.Duration
+}
+
+func (s *system) lookup(ctx context.Context, name string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	network := "ip4"
+	if qtype == dnsmessage.TypeAAAA {
+		network = "ip6"
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, network, name)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, negativeTTL * time.Second, nil
+		}
+		return nil, 0, err
+	}
+	return ips, s.ttl, nil
+}
+
+func (s *system) String() string {
+	return "system"
+}
+
+// buildQuery encodes a recursive query for name. DoH uses ID 0 so that
+// identical queries are cacheable by HTTP intermediaries.
+func buildQuery(id uint16, name string, qtype dnsmessage.Type) ([]byte, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, err
+	}
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  qname,
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	return msg.Pack()
+}
+
+// parseAnswer extracts addresses of the queried type and the lowest TTL
+// from a response message.
+func parseAnswer(id uint16, resp []byte, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		return nil, 0, fmt.Errorf("malformed response: %w", err)
+	}
+	if msg.Header.ID != id {
+		return nil, 0, errors.New("response id mismatch")
+	}
+	switch msg.Header.RCode {
+	case dnsmessage.RCodeSuccess, dnsmessage.RCodeNameError:
+	default:
+		return nil, 0, fmt.Errorf("server returned %s", msg.Header.RCode)
+	}
+
+	var ips []net.IP
+	var minTTL uint32
+	for _, ans := range msg.Answers {
+		if ans.Header.Type != qtype {
+			continue
+		}
+		switch body := ans.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(body.A[:]))
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(body.AAAA[:]))
+		default:
+			continue
+		}
+		if minTTL == 0 || ans.Header.TTL < minTTL {
+			minTTL = ans.Header.TTL
+		}
+	}
+
+	// Negative answers are cached for the SOA minimum (RFC 2308).
+	if len(ips) == 0 {
+		minTTL = negativeTTL
+		for _, auth := range msg.Authorities {
+			if soa, ok := auth.Body.(*dnsmessage.SOAResource); ok {
+				minTTL = soa.MinTTL
+				if auth.Header.TTL < minTTL {
+					minTTL = auth.Header.TTL
+				}
+			}
+		}
+	}
+	return ips, time.Duration(minTTL) * time.Second, nil
+}
@@ -0,0 +1,121 @@
+// Package route matches upstream destinations against configured routes
+// so that per-destination settings can override global ones.
+package route
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/config"
+)
+
+// entry is a route with its match patterns pre-parsed.
+type entry struct {
+	cfg      *config.RouteConfig
+	any      bool
+	exact    map[string]bool
+	suffixes []string
+	nets     []*net.IPNet
+}
+
+// Table holds routes in priority order. The routes can be replaced while
+// the Table is in use.
+type Table struct {
+	entries atomic.Pointer[[]entry]
+}
+
+// New builds a Table from route configuration. Patterns are assumed to
+// have been validated; unparsable CIDRs are ignored.
+func New(routes []config.RouteConfig) *Table {
+	t := &Table{}
+	t.Update(routes)
+	return t
+}
+
+// Update replaces the routes. Lookups already in progress finish against
+// the previous routes.
+func (t *Table) Update(routes []config.RouteConfig) {
+	entries := make([]entry, 0, len(routes))
+	for i := range routes {
+		e := entry{cfg: &routes[i], exact: make(map[string]bool)}
+		for _, m := range routes[i].Match {
+			m = normalize(m)
+			switch {
+			case m == "*":
+				e.any = true
+			case strings.HasPrefix(m, "*."):
+				e.suffixes = append(e.suffixes, m[1:])
+			case strings.Contains(m, "/"):
+				if _, n, err := net.ParseCIDR(m); err == nil {
+					e.nets = append(e.nets, n)
+				}
+			default:
+				e.exact[m] = true
+			}
+		}
+		entries = append(entries, e)
+	}
+	t.entries.Store(&entries)
+}
+
+// Match returns the first route matching host, or nil. host may carry a
+// port, which is ignored.
+func (t *Table) Match(host string) *config.RouteConfig {
+	if t == nil {
+		return nil
+	}
+	entries := *t.entries.Load()
+	if len(entries) == 0 {
+		return nil
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = normalize(host)
+	ip := net.ParseIP(host)
+
+	for _, e := range entries {
+		if e.matches(host, ip) {
+			return e.cfg
+		}
+	}
+	return nil
+}
+
+// Timeouts returns base with the timeout overrides of the route matching
+// host applied.
+func (t *Table) Timeouts(host string, base config.TimeoutConfig) config.TimeoutConfig {
+	if r := t.Match(host); r != nil {
+		return base.Merge(r.Timeouts)
+	}
+	return base
+}
+
+// matches reports whether host (or its IP form) satisfies any pattern.
+func (e *entry) matches(host string, ip net.IP) bool {
+	if e.any || e.exact[host] {
+		return true
+	}
+	if ip != nil {
+		for _, n := range e.nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, suffix := range e.suffixes {
+		if strings.HasSuffix(host, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalize lowercases a hostname and strips a trailing dot and IPv6
+// brackets.
+func normalize(host string) string {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
@@ -0,0 +1,29 @@
+//go:build linux
+
+package unixsock
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// peerCred reads SO_PEERCRED from c.
+func peerCred(c *net.UnixConn) (*Cred, error) {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var ucred *unix.Ucred
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		ucred, sockErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		return nil, sockErr
+	}
+	return &Cred{PID: ucred.Pid, UID: ucred.Uid, GID: ucred.Gid}, nil
+}
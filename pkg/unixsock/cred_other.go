@@ -0,0 +1,13 @@
+//go:build !linux
+
+package unixsock
+
+import (
+	"errors"
+	"net"
+)
+
+// peerCred is unsupported: SO_PEERCRED is Linux-only.
+func peerCred(c *net.UnixConn) (*Cred, error) {
+	return nil, errors.New("peer credentials are only supported on Linux")
+}
@@ -0,0 +1,190 @@
+// Package unixsock prepares unix domain socket listeners and exposes the
+// credentials of the processes connecting to them.
+package unixsock
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Cred identifies the process at the other end of a unix socket, as
+// reported by the kernel when it connected.
+type Cred struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+// IsAbstract reports whether path names a socket in the Linux abstract
+// namespace, which has no file.
+func IsAbstract(path string) bool {
+	return strings.HasPrefix(path, "@")
+}
+
+// RemoveStale removes the socket file at path if no process is accepting
+// on it, so that binding does not fail after an unclean exit. A live
+// socket, or any file that is not a socket, is left alone.
+func RemoveStale(path string) error {
+	if IsAbstract(path) {
+		return nil
+	}
+	fi, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		// Someone is serving; binding will report the address in use
+		// unless that someone is us through an inherited listener.
+		conn.Close()
+		return nil
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("remove stale socket: %w", err)
+	}
+	return nil
+}
+
+// Configure sets the permissions and ownership of the socket file at
+// path. mode is octal, such as "0660"; owner and group are names or
+// numeric IDs. Empty values are left unchanged.
+func Configure(path, mode, owner, group string) error {
+	if IsAbstract(path) {
+		return nil
+	}
+	if mode != "" {
+		m, err := ParseMode(mode)
+		if err != nil {
+			return err
+		}
+		if err := os.Chmod(path, m); err != nil {
+			return err
+		}
+	}
+	if owner == "" && group == "" {
+		return nil
+	}
+
+	uid, gid := -1, -1
+	if owner != "" {
+		id, err := lookupID(owner, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+		if err != nil {
+			return fmt.Errorf("socket owner: %w", err)
+		}
+		uid = id
+	}
+	if group != "" {
+		id, err := lookupID(group, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			return fmt.Errorf("socket group: %w", err)
+		}
+		gid = id
+	}
+	return os.Chown(path, uid, gid)
+}
+
+// ParseMode parses an octal permission string such as "0660".
+func ParseMode(mode string) (os.FileMode, error) {
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || m > 0o777 {
+		return 0, fmt.Errorf("invalid socket mode %q (want octal permissions such as 0660)", mode)
+	}
+	return os.FileMode(m), nil
+}
+
+// lookupID returns name as a number, or resolves it with lookup.
+func lookupID(name string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	id, err := lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(id)
+}
+
+// WithCred wraps a unix socket listener so that accepted connections
+// carry the peer's credentials; see CredOf.
+func WithCred(ln net.Listener) net.Listener {
+	return &credListener{Listener: ln}
+}
+
+// credListener reads peer credentials when accepting.
+type credListener struct {
+	net.Listener
+}
+
+// Accept accepts a connection and records its peer credentials. Failing
+// to read them is not fatal; the connection simply has none.
+func (l *credListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return c, nil
+	}
+	cred, _ := peerCred(uc)
+	return &Conn{UnixConn: uc, cred: cred}, nil
+}
+
+// Conn is an accepted unix socket connection with its peer credentials.
+type Conn struct {
+	*net.UnixConn
+	cred *Cred
+}
+
+// Cred returns the peer credentials, or nil if they are unavailable.
+func (c *Conn) Cred() *Cred {
+	return c.cred
+}
+
+// CredOf returns the peer credentials of a connection accepted through
+// WithCred, looking through wrappers such as TLS and hijacked
+// connections. It returns nil for other connections.
+func CredOf(c net.Conn) *Cred {
+	for c != nil {
+		switch v := c.(type) {
+		case *Conn:
+			return v.cred
+		case interface{ NetConn() net.Conn }:
+			c = v.NetConn()
+		case interface{ UnsafeConn() net.Conn }:
+			c = v.UnsafeConn()
+		default:
+			return nil
+		}
+	}
+	return nil
+}
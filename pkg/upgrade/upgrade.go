@@ -0,0 +1,277 @@
+// Package upgrade hands listening sockets from a running process to a
+// freshly started binary, so the proxy can be upgraded or restarted
+// without refusing connections. It also accepts sockets passed by
+// systemd socket activation.
+package upgrade
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Environment variables describing inherited sockets. Upgrades use their
+// own variable because LISTEN_PID cannot be known before the child is
+// started.
+const (
+	envUpgradeFDs = "UPGRADE_LISTEN_FDS" // listeners passed by a parent process
+	envListenFDs  = "LISTEN_FDS"         // systemd socket activation
+	envListenPID  = "LISTEN_PID"
+	envFDNames    = "LISTEN_FDNAMES"
+)
+
+// firstFD is the first inherited descriptor, after stdin, stdout and stderr.
+const firstFD = 3
+
+// ErrUpgrading is returned by Upgrade while another upgrade is running.
+var ErrUpgrading = errors.New("upgrade already in progress")
+
+// filer is implemented by listeners whose socket can be duplicated.
+type filer interface {
+	File() (*os.File, error)
+}
+
+// Upgrader tracks inherited and active listeners.
+type Upgrader struct {
+	mu        sync.Mutex
+	inherited []net.Listener // not yet claimed by Listen
+	active    []net.Listener // in use, handed on by Upgrade
+	ready     *os.File       // pipe to the parent, nil if there is none
+	upgrading bool
+}
+
+// New creates an Upgrader, taking over any sockets passed by a parent
+// process or by systemd.
+func New() (*Upgrader, error) {
+	u := &Upgrader{}
+
+	n, names, err := inheritedFDs()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < n; i++ {
+		name := "listener"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(firstFD+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inherited fd %d: %w", firstFD+i, err)
+		}
+		u.inherited = append(u.inherited, l)
+	}
+
+	if v := os.Getenv(envUpgradeFDs); v != "" {
+		u.ready = os.NewFile(uintptr(firstFD+n), "upgrade-ready")
+	}
+	for _, env := range []string{envUpgradeFDs, envListenFDs, envListenPID, envFDNames} {
+		os.Unsetenv(env)
+	}
+	return u, nil
+}
+
+// inheritedFDs returns how many sockets were passed in, and their names
+// if systemd named them.
+func inheritedFDs() (int, []string, error) {
+	if v := os.Getenv(envUpgradeFDs); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, nil, fmt.Errorf("invalid %s %q", envUpgradeFDs, v)
+		}
+		return n, nil, nil
+	}
+	if os.Getenv(envListenPID) != strconv.Itoa(os.Getpid()) {
+		return 0, nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv(envListenFDs))
+	if err != nil || n < 0 {
+		return 0, nil, fmt.Errorf("invalid %s %q", envListenFDs, os.Getenv(envListenFDs))
+	}
+	return n, strings.Split(os.Getenv(envFDNames), ":"), nil
+}
+
+// Inherited reports whether this process was started by an upgrade.
+func (u *Upgrader) Inherited() bool {
+	return u.ready != nil
+}
+
+// Listen returns the inherited listener for addr if there is one, and
+// binds a new one otherwise. Either way the listener is handed on by the
+// next Upgrade.
+func (u *Upgrader) Listen(network, addr string) (net.Listener, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for i, l := range u.inherited {
+		if sameAddr(l.Addr(), network, addr) {
+			u.inherited = append(u.inherited[:i], u.inherited[i+1:]...)
+			u.active = append(u.active, l)
+			return l, nil
+		}
+	}
+
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	u.active = append(u.active, l)
+	return l, nil
+}
+
+// Ready closes inherited listeners nobody claimed and, after an upgrade,
+// tells the parent that this process is serving so it can drain.
+func (u *Upgrader) Ready() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for _, l := range u.inherited {
+		l.Close()
+	}
+	u.inherited = nil
+
+	if u.ready == nil {
+		return nil
+	}
+	defer func() {
+		u.ready.Close()
+		u.ready = nil
+	}()
+	_, err := u.ready.Write([]byte{1})
+	return err
+}
+
+// Upgrade starts the current executable again with the same arguments,
+// passing it the active listeners, and waits up to timeout for it to
+// call Ready. On success the caller should shut down gracefully; the new
+// process is already accepting connections. On failure the new process
+// is killed and the caller keeps serving.
+func (u *Upgrader) Upgrade(timeout time.Duration) (pid int, err error) {
+	u.mu.Lock()
+	if u.upgrading {
+		u.mu.Unlock()
+		return 0, ErrUpgrading
+	}
+	u.upgrading = true
+	files, err := listenerFiles(u.active)
+	u.mu.Unlock()
+
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+		u.mu.Lock()
+		u.upgrading = false
+		u.mu.Unlock()
+	}()
+	if err != nil {
+		return 0, err
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, fmt.Errorf("locate executable: %w", err)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, w)
+	cmd.Env = append(os.Environ(), envUpgradeFDs+"="+strconv.Itoa(len(files)))
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return 0, fmt.Errorf("start %s: %w", exe, err)
+	}
+
+	ready := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1)
+		_, err := r.Read(b)
+		ready <- err
+	}()
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-ready:
+		if err == nil {
+			u.keepSocketFiles()
+			return cmd.Process.Pid, nil
+		}
+		// The pipe closed without a byte: the child died before Ready.
+		cmd.Process.Kill()
+		return 0, fmt.Errorf("new process failed before becoming ready: %v", <-exited)
+	case err := <-exited:
+		return 0, fmt.Errorf("new process exited before becoming ready: %v", err)
+	case <-timer.C:
+		cmd.Process.Kill()
+		return 0, fmt.Errorf("new process not ready after %s", timeout)
+	}
+}
+
+// keepSocketFiles stops unix listeners from removing their socket files
+// on Close, now that the new process serves on them.
+func (u *Upgrader) keepSocketFiles() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, l := range u.active {
+		if ul, ok := l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+}
+
+// listenerFiles duplicates the sockets of ls.
+func listenerFiles(ls []net.Listener) ([]*os.File, error) {
+	files := make([]*os.File, 0, len(ls))
+	for _, l := range ls {
+		fl, ok := l.(filer)
+		if !ok {
+			return files, fmt.Errorf("listener %s cannot be handed over", l.Addr())
+		}
+		f, err := fl.File()
+		if err != nil {
+			return files, fmt.Errorf("listener %s: %w", l.Addr(), err)
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// sameAddr reports whether a, a bound listener address, is what listening
+// on network and addr would produce. Unspecified IPv4 and IPv6 addresses
+// are treated as the same.
+func sameAddr(a net.Addr, network, addr string) bool {
+	if a.Network() != network && !(strings.HasPrefix(network, "tcp") && a.Network() == "tcp") {
+		return false
+	}
+	tcp, ok := a.(*net.TCPAddr)
+	if !ok {
+		return a.String() == addr
+	}
+	want, err := net.ResolveTCPAddr(network, addr)
+	if err != nil || want.Port != tcp.Port {
+		return false
+	}
+	if want.IP == nil || want.IP.IsUnspecified() {
+		return tcp.IP == nil || tcp.IP.IsUnspecified()
+	}
+	return want.IP.Equal(tcp.IP)
+}
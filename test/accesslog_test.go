@@ -0,0 +1,126 @@
+package test
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/accesslog"
+	"github.com/yigitkonur/proxy-http-forward/pkg/config"
+)
+
+// readLines returns the lines written to path so far.
+func readLines(t *testing.T, path string) []string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestAccessLogFormats(t *testing.T) {
+	e := &accesslog.Entry{
+		Time:      time.Date(2026, 10, 18, 9, 30, 5, 123e6, time.UTC),
+		Client:    "192.0.2.10",
+		Method:    "GET",
+		URL:       "http://example.com/a b",
+		Proto:     "HTTP/1.1",
+		Status:    200,
+		UserAgent: `curl/8.0 "test"`,
+		MIMEType:  "text/html",
+		User:      "alice",
+		EgressIP:  "203.0.113.17",
+		Upstream:  "example.com:80",
+		BytesSent: 1234,
+		BytesRecv: 10,
+		Duration:  250 * time.Millisecond,
+	}
+	tests := []struct {
+		format string
+		fields []string
+		want   string
+	}{
+		{"squid", nil, "1792315805.123    250 192.0.2.10 TCP_MISS/200 1234 GET http://example.com/a b alice HIER_DIRECT/example.com:80 text/html"},
+		{"squid", []string{"egress_ip", "sni"}, "1792315805.123    250 192.0.2.10 TCP_MISS/200 1234 GET http://example.com/a b alice HIER_DIRECT/example.com:80 text/html egress_ip=203.0.113.17 sni=-"},
+		{"combined", nil, `192.0.2.10 - alice [18/Oct/2026:09:30:05 +0000] "GET http://example.com/a b HTTP/1.1" 200 1234 "-" "curl/8.0 \"test\""`},
+		{"json", []string{"bytes", "durations"}, `{"time":"2026-10-18T09:30:05.123Z","client":"192.0.2.10","method":"GET","url":"http://example.com/a b","status":200,"bytes_sent":1234,"bytes_received":10,"duration":0.25,"upstream_duration":0}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "access.log")
+			l, err := accesslog.New(config.AccessLogConfig{Enabled: true, Format: tt.format, Output: path, Fields: tt.fields})
+			require.NoError(t, err)
+			l.Log(e)
+			assert.Equal(t, []string{tt.want}, readLines(t, path))
+		})
+	}
+
+	// Values that could split a field or a line are quoted.
+	e.User, e.Session = "a b\n1.0", "s\r\n"
+	for format, want := range map[string]string{
+		"squid":    `1792315805.123    250 192.0.2.10 TCP_MISS/200 1234 GET http://example.com/a b "a b\n1.0" HIER_DIRECT/example.com:80 text/html session="s\r\n"`,
+		"combined": `192.0.2.10 - "a b\n1.0" [18/Oct/2026:09:30:05 +0000] "GET http://example.com/a b HTTP/1.1" 200 1234 "-" "curl/8.0 \"test\"" session="s\r\n"`,
+	} {
+		path := filepath.Join(t.TempDir(), format+".log")
+		l, err := accesslog.New(config.AccessLogConfig{Enabled: true, Format: format, Output: path, Fields: []string{"session"}})
+		require.NoError(t, err)
+		l.Log(e)
+		assert.Equal(t, []string{want}, readLines(t, path), format)
+	}
+}
+
+func TestAccessLogRequests(t *testing.T) {
+	url := startUpstreamFunc(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBodyString("hello")
+	})
+	target := startRawUpstream(t, func(c net.Conn) {
+		c.Read(make([]byte, 1024))
+	})
+	path := filepath.Join(t.TempDir(), "access.log")
+	addr, _ := startProxyHandler(t, config.Config{
+		Logging: config.LoggingConfig{Access: config.AccessLogConfig{Enabled: true, Format: "json", Output: path}},
+		Routes:  []config.RouteConfig{{Name: "local", Match: []string{"127.0.0.1"}}},
+	})
+
+	proxyGet(t, addr, "GET", url)
+	conn, _ := proxyConnect(t, addr, target)
+	tls.Client(conn, &tls.Config{ServerName: "backend.example.com"}).Handshake()
+	conn.Close()
+
+	var entries []map[string]interface{}
+	require.Eventually(t, func() bool {
+		lines := readLines(t, path)
+		if len(lines) < 2 {
+			return false
+		}
+		entries = nil
+		for _, l := range lines {
+			var m map[string]interface{}
+			require.NoError(t, json.Unmarshal([]byte(l), &m))
+			entries = append(entries, m)
+		}
+		return true
+	}, 2*time.Second, 10*time.Millisecond)
+
+	get := entries[0]
+	assert.Equal(t, "GET", get["method"])
+	assert.Equal(t, url, get["url"])
+	assert.Equal(t, float64(200), get["status"])
+	assert.Equal(t, float64(5), get["bytes_sent"])
+	assert.Equal(t, "local", get["route"])
+
+	tunnel := entries[1]
+	assert.Equal(t, "CONNECT", tunnel["method"])
+	assert.Equal(t, target, tunnel["upstream"])
+	assert.Equal(t, "backend.example.com", tunnel["sni"])
+	assert.Equal(t, "server_eof", tunnel["close_reason"])
+	assert.NotZero(t, tunnel["bytes_received"])
+}
@@ -0,0 +1,54 @@
+package test
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/auth"
+	"github.com/yigitkonur/proxy-http-forward/pkg/config"
+)
+
+func proxyAuthHeader(user, pass string) *fasthttp.RequestHeader {
+	var h fasthttp.RequestHeader
+	h.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user+":"+pass)))
+	return &h
+}
+
+func TestAuthenticate(t *testing.T) {
+	a := auth.New(config.AuthConfig{
+		Enabled:       true,
+		Realm:         "proxy",
+		SessionMarker: "-session-",
+		Users:         []config.UserConfig{{Username: "alice", Password: "secret"}},
+	})
+
+	id, ok := a.Authenticate(proxyAuthHeader("alice-session-abc123", "secret"))
+	assert.True(t, ok)
+	assert.Equal(t, auth.Identity{User: "alice", Session: "abc123", Verified: true}, id)
+
+	_, ok = a.Authenticate(proxyAuthHeader("alice", "wrong"))
+	assert.False(t, ok)
+
+	_, ok = a.Authenticate(proxyAuthHeader("mallory", "secret"))
+	assert.False(t, ok)
+
+	_, ok = a.Authenticate(&fasthttp.RequestHeader{})
+	assert.False(t, ok)
+
+	assert.Equal(t, `Basic realm="proxy"`, a.Challenge())
+}
+
+func TestAuthenticateDisabled(t *testing.T) {
+	a := auth.New(config.AuthConfig{SessionMarker: "-session-"})
+
+	id, ok := a.Authenticate(proxyAuthHeader("bob-session-x1", "anything"))
+	assert.True(t, ok)
+	assert.Equal(t, auth.Identity{User: "bob", Session: "x1"}, id)
+
+	id, ok = a.Authenticate(&fasthttp.RequestHeader{})
+	assert.True(t, ok)
+	assert.Equal(t, auth.Identity{}, id)
+}
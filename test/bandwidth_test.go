@@ -0,0 +1,111 @@
+package test
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/bandwidth"
+	"github.com/yigitkonur/proxy-http-forward/pkg/config"
+)
+
+func TestBandwidthShaper(t *testing.T) {
+	s := bandwidth.New(config.BandwidthConfig{
+		PerUser:       config.BandwidthLimit{Download: 20000},
+		PerConnection: config.BandwidthLimit{Download: 100000},
+	}, getTestMetrics())
+
+	// The first second's worth passes at once, then the user's rate holds
+	// both of the user's connections back.
+	a, b := s.Conn("alice"), s.Conn("alice")
+	defer a.Close()
+	defer b.Close()
+	assert.True(t, a.Limited(bandwidth.Download))
+	assert.False(t, a.Limited(bandwidth.Upload))
+
+	start := time.Now()
+	a.Wait(bandwidth.Download, 20000)
+	assert.Less(t, time.Since(start), 50*time.Millisecond)
+	b.Wait(bandwidth.Download, 4000)
+	assert.InDelta(t, 200*time.Millisecond, time.Since(start), float64(60*time.Millisecond))
+
+	// Another user has a bucket of their own.
+	c := s.Conn("bob")
+	defer c.Close()
+	start = time.Now()
+	_, err := io.Copy(io.Discard, c.Reader(bandwidth.Download, bytes.NewReader(make([]byte, 24000))))
+	require.NoError(t, err)
+	assert.InDelta(t, 200*time.Millisecond, time.Since(start), float64(60*time.Millisecond))
+}
+
+func TestBandwidthTunnel(t *testing.T) {
+	payload := make([]byte, 30000)
+	target := startRawUpstream(t, func(c net.Conn) {
+		c.Write(payload)
+	})
+	addr, _ := startProxyHandler(t, config.Config{Proxy: config.ProxyConfig{
+		Bandwidth: config.BandwidthConfig{PerConnection: config.BandwidthLimit{Download: 20000}},
+	}})
+
+	conn, br := proxyConnect(t, addr, target)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	n, err := io.Copy(io.Discard, br)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(payload)), n)
+	assert.InDelta(t, 500*time.Millisecond, time.Since(start), float64(150*time.Millisecond))
+}
+
+func TestBandwidthHTTPBody(t *testing.T) {
+	url := startUpstreamFunc(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBody(make([]byte, 30000))
+	})
+	addr, _ := startProxyHandler(t, config.Config{Proxy: config.ProxyConfig{
+		Bandwidth: config.BandwidthConfig{Global: config.BandwidthLimit{Download: 20000}},
+	}})
+
+	start := time.Now()
+	resp := proxyGet(t, addr, "GET", url)
+	assert.Equal(t, fasthttp.StatusOK, resp.StatusCode())
+	assert.Len(t, resp.Body(), 30000)
+	assert.InDelta(t, 500*time.Millisecond, time.Since(start), float64(150*time.Millisecond))
+}
+
+func TestBandwidthHTTPUpload(t *testing.T) {
+	url := startUpstreamFunc(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBodyString(strconv.Itoa(len(ctx.PostBody())))
+	})
+	post := func(addr string) *fasthttp.Response {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		fmt.Fprintf(conn, "POST %s HTTP/1.1\r\nHost: upstream\r\nContent-Length: 30000\r\n\r\n", url)
+		conn.Write(make([]byte, 30000))
+		resp := &fasthttp.Response{}
+		require.NoError(t, resp.Read(bufio.NewReader(conn)))
+		return resp
+	}
+	limit := config.BandwidthConfig{PerConnection: config.BandwidthLimit{Upload: 20000}}
+
+	addr, _ := startProxyHandler(t, config.Config{Proxy: config.ProxyConfig{Bandwidth: limit}})
+	start := time.Now()
+	resp := post(addr)
+	assert.Equal(t, "30000", string(resp.Body()))
+	assert.InDelta(t, 500*time.Millisecond, time.Since(start), float64(150*time.Millisecond))
+
+	// The body is shaped as it is sent, so the request timeout covers it.
+	addr, _ = startProxyHandler(t, config.Config{Proxy: config.ProxyConfig{
+		Bandwidth: limit,
+		Timeouts:  config.TimeoutConfig{Request: 200 * time.Millisecond},
+	}})
+	assert.Equal(t, fasthttp.StatusGatewayTimeout, post(addr).StatusCode())
+}
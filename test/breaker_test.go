@@ -0,0 +1,100 @@
+package test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/breaker"
+	"github.com/yigitkonur/proxy-http-forward/pkg/config"
+)
+
+func TestBreakerConsecutiveFailures(t *testing.T) {
+	s := breaker.New(config.BreakerConfig{
+		Enabled:             true,
+		ConsecutiveFailures: 3,
+		OpenDuration:        50 * time.Millisecond,
+		HalfOpenRequests:    1,
+	}, getTestMetrics())
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, s.Allow("a:80"))
+		s.Record("a:80", true)
+	}
+	assert.Equal(t, breaker.Open, s.State("a:80"))
+	assert.ErrorIs(t, s.Allow("a:80"), breaker.ErrOpen)
+
+	// Other destinations are unaffected.
+	assert.NoError(t, s.Allow("b:80"))
+	s.Record("b:80", false)
+
+	// After open_duration a single probe is let through.
+	time.Sleep(60 * time.Millisecond)
+	require.NoError(t, s.Allow("a:80"))
+	assert.Equal(t, breaker.HalfOpen, s.State("a:80"))
+	assert.ErrorIs(t, s.Allow("a:80"), breaker.ErrOpen)
+
+	// A failed probe reopens it, a successful one closes it.
+	s.Record("a:80", true)
+	assert.Equal(t, breaker.Open, s.State("a:80"))
+	time.Sleep(60 * time.Millisecond)
+	require.NoError(t, s.Allow("a:80"))
+	s.Record("a:80", false)
+	assert.Equal(t, breaker.Closed, s.State("a:80"))
+}
+
+func TestBreakerFailureRate(t *testing.T) {
+	s := breaker.New(config.BreakerConfig{
+		Enabled:          true,
+		FailureRate:      0.5,
+		MinRequests:      4,
+		Window:           time.Minute,
+		OpenDuration:     time.Minute,
+		HalfOpenRequests: 1,
+	}, getTestMetrics())
+
+	// Alternating outcomes never fail twice in a row, but half fail.
+	for i := 0; i < 3; i++ {
+		require.NoError(t, s.Allow("a:80"))
+		s.Record("a:80", i%2 == 0)
+	}
+	assert.Equal(t, breaker.Closed, s.State("a:80"), "below min_requests")
+
+	require.NoError(t, s.Allow("a:80"))
+	s.Record("a:80", true)
+	assert.Equal(t, breaker.Open, s.State("a:80"))
+}
+
+func TestBreakerDisabled(t *testing.T) {
+	s := breaker.New(config.BreakerConfig{}, getTestMetrics())
+	assert.Nil(t, s)
+	assert.NoError(t, s.Allow("a:80"))
+	s.Record("a:80", true)
+	assert.Equal(t, breaker.Closed, s.State("a:80"))
+}
+
+func TestHandlerBreakerFailsFast(t *testing.T) {
+	// A port with nothing listening refuses connections.
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	url := "http://" + ln.Addr().String() + "/"
+	ln.Close()
+
+	addr := startProxy(t, config.Config{Proxy: config.ProxyConfig{
+		Retry: config.RetryConfig{MaxAttempts: 1},
+		CircuitBreaker: config.BreakerConfig{
+			Enabled:             true,
+			ConsecutiveFailures: 2,
+			OpenDuration:        time.Minute,
+			HalfOpenRequests:    1,
+		},
+	}})
+
+	assert.Equal(t, fasthttp.StatusBadGateway, proxyGet(t, addr, "GET", url).StatusCode())
+	assert.Equal(t, fasthttp.StatusBadGateway, proxyGet(t, addr, "GET", url).StatusCode())
+	assert.Equal(t, fasthttp.StatusServiceUnavailable, proxyGet(t, addr, "GET", url).StatusCode())
+}
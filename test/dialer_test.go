@@ -0,0 +1,100 @@
+package test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/config"
+	"github.com/yigitkonur/proxy-http-forward/pkg/dialer"
+	"github.com/yigitkonur/proxy-http-forward/pkg/resolver"
+	"github.com/yigitkonur/proxy-http-forward/pkg/route"
+)
+
+func TestDialerHappyEyeballs(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	// The IPv6 address is in the discard-only prefix and never answers.
+	var queries int32
+	srv := newDoHServer(t, map[string][]string{"dual.test.": {"100::1", "127.0.0.1"}}, &queries)
+	r := resolver.New(config.DNSConfig{
+		Upstreams: []config.DNSUpstreamConfig{{Type: "doh", Address: srv.URL}},
+	})
+
+	t.Run("falls back to ipv4", func(t *testing.T) {
+		d := dialer.New(config.ProxyConfig{
+			DialTimeout:        5 * time.Second,
+			AddressFamily:      dialer.PreferIPv6,
+			HappyEyeballsDelay: 50 * time.Millisecond,
+		}, route.New(nil), r, getTestMetrics())
+
+		start := time.Now()
+		conn, err := d.Dial(net.JoinHostPort("dual.test", port))
+		require.NoError(t, err)
+		defer conn.Close()
+		assert.Equal(t, "127.0.0.1", conn.RemoteAddr().(*net.TCPAddr).IP.String())
+		assert.Less(t, time.Since(start), time.Second)
+	})
+
+	t.Run("ipv6 only", func(t *testing.T) {
+		d := dialer.New(config.ProxyConfig{
+			DialTimeout:   500 * time.Millisecond,
+			AddressFamily: dialer.IPv6Only,
+		}, route.New(nil), r, getTestMetrics())
+
+		_, err := d.Dial(net.JoinHostPort("dual.test", port))
+		assert.Error(t, err)
+	})
+	t.Run("late ipv4 answer", func(t *testing.T) {
+		// Answers are held back once the AAAA record is cached, so the
+		// A record arrives after the attempt delay has passed.
+		var delay atomic.Int64
+		target, _ := url.Parse(srv.URL)
+		upstream := httputil.NewSingleHostReverseProxy(target)
+		slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(time.Duration(delay.Load()))
+			upstream.ServeHTTP(w, r)
+		}))
+		defer slow.Close()
+		r := resolver.New(config.DNSConfig{
+			Upstreams: []config.DNSUpstreamConfig{{Type: "doh", Address: slow.URL}},
+		})
+		_, err := r.LookupIP(context.Background(), "ip6", "dual.test")
+		require.NoError(t, err)
+		delay.Store(int64(300 * time.Millisecond))
+
+		d := dialer.New(config.ProxyConfig{
+			DialTimeout:        5 * time.Second,
+			AddressFamily:      dialer.PreferIPv6,
+			HappyEyeballsDelay: 50 * time.Millisecond,
+		}, route.New(nil), r, getTestMetrics())
+
+		start := time.Now()
+		conn, err := d.Dial(net.JoinHostPort("dual.test", port))
+		require.NoError(t, err)
+		defer conn.Close()
+		assert.Equal(t, "127.0.0.1", conn.RemoteAddr().(*net.TCPAddr).IP.String())
+		assert.Less(t, time.Since(start), 2*time.Second)
+	})
+}
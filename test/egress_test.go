@@ -0,0 +1,129 @@
+package test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/auth"
+	"github.com/yigitkonur/proxy-http-forward/pkg/config"
+	"github.com/yigitkonur/proxy-http-forward/pkg/dialer"
+	"github.com/yigitkonur/proxy-http-forward/pkg/egress"
+	"github.com/yigitkonur/proxy-http-forward/pkg/resolver"
+	"github.com/yigitkonur/proxy-http-forward/pkg/route"
+)
+
+func TestEgressStrategies(t *testing.T) {
+	addrs := []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "2001:db8::1"}
+
+	t.Run("fixed", func(t *testing.T) {
+		p := egress.NewPool(config.EgressPoolConfig{Name: "p", Addresses: addrs, Strategy: egress.Fixed})
+		for i := 0; i < 3; i++ {
+			src := p.Select("10.0.0.1", "")
+			assert.Equal(t, "192.0.2.1", src.IPv4.String())
+			assert.Equal(t, "2001:db8::1", src.IPv6.String())
+		}
+	})
+
+	t.Run("round robin", func(t *testing.T) {
+		p := egress.NewPool(config.EgressPoolConfig{Name: "p", Addresses: addrs, Strategy: egress.RoundRobin})
+		var got []string
+		for i := 0; i < 4; i++ {
+			got = append(got, p.Select("10.0.0.1", "").IPv4.String())
+		}
+		assert.Equal(t, []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.1"}, got)
+	})
+
+	t.Run("hash by client and user", func(t *testing.T) {
+		byClient := egress.NewPool(config.EgressPoolConfig{Name: "c", Addresses: addrs, Strategy: egress.HashClient})
+		assert.Equal(t, byClient.Select("10.0.0.7", "a"), byClient.Select("10.0.0.7", "b"))
+
+		byUser := egress.NewPool(config.EgressPoolConfig{Name: "u", Addresses: addrs, Strategy: egress.HashUser})
+		assert.Equal(t, byUser.Select("10.0.0.1", "alice"), byUser.Select("10.0.0.2", "alice"))
+	})
+
+	t.Run("named pools", func(t *testing.T) {
+		s := egress.New(config.EgressConfig{Pools: []config.EgressPoolConfig{
+			{Name: "general", Addresses: []string{"192.0.2.1"}},
+			{Name: "partners", Addresses: []string{"192.0.2.14"}},
+		}}, getTestMetrics())
+		assert.Equal(t, "192.0.2.1", s.Select("", "10.0.0.1", auth.Identity{}).IPv4.String())
+		assert.Equal(t, "192.0.2.14", s.Select("partners", "10.0.0.1", auth.Identity{}).IPv4.String())
+		assert.Equal(t, "192.0.2.1", s.Select("gone", "10.0.0.1", auth.Identity{}).IPv4.String())
+	})
+
+	t.Run("no pools", func(t *testing.T) {
+		s := egress.New(config.EgressConfig{}, getTestMetrics())
+		assert.True(t, s.Select("", "10.0.0.1", auth.Identity{}).IsZero())
+	})
+}
+
+func TestDialerBindsEgressSource(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	accepted := make(chan net.Addr, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- conn.RemoteAddr()
+		conn.Close()
+	}()
+
+	d := dialer.New(config.ProxyConfig{DialTimeout: time.Second}, route.New(nil), resolver.New(config.DNSConfig{}), getTestMetrics())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	src := dialer.Source{IPv4: net.ParseIP("127.0.0.2")}
+	conn, err := d.DialFrom(ctx, "tcp", ln.Addr().String(), src)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	remote := <-accepted
+	assert.Equal(t, "127.0.0.2", remote.(*net.TCPAddr).IP.String())
+
+	// A source with no IPv4 address cannot reach an IPv4 destination.
+	_, err = d.DialFrom(ctx, "tcp", ln.Addr().String(), dialer.Source{IPv6: net.ParseIP("::1")})
+	assert.Error(t, err)
+}
+
+func TestEgressStickySessions(t *testing.T) {
+	s := egress.New(config.EgressConfig{
+		Pools: []config.EgressPoolConfig{{
+			Name:      "p",
+			Addresses: []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"},
+			Strategy:  egress.RoundRobin,
+		}},
+		SessionTTL:  50 * time.Millisecond,
+		MaxSessions: 1,
+	}, getTestMetrics())
+
+	a := auth.Identity{User: "alice", Session: "abc123", Verified: true}
+	first := s.Select("", "10.0.0.1", a)
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, first, s.Select("", "10.0.0.2", a))
+	}
+
+	// Without a session, round robin continues to rotate.
+	plain := auth.Identity{User: "alice"}
+	assert.NotEqual(t, s.Select("", "10.0.0.1", plain), s.Select("", "10.0.0.1", plain))
+
+	// Sessions of unauthenticated users, and new ones once the table is
+	// full, are not pinned.
+	claimed := auth.Identity{User: "mallory", Session: "x"}
+	assert.NotEqual(t, s.Select("", "10.0.0.1", claimed), s.Select("", "10.0.0.1", claimed))
+	other := auth.Identity{User: "bob", Session: "x", Verified: true}
+	assert.NotEqual(t, s.Select("", "10.0.0.1", other), s.Select("", "10.0.0.1", other))
+
+	// An expired session picks new addresses (the next in rotation).
+	time.Sleep(60 * time.Millisecond)
+	next := s.Select("", "10.0.0.1", plain)
+	assert.NotEqual(t, next, s.Select("", "10.0.0.1", a))
+}
@@ -0,0 +1,142 @@
+package test
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/accesslog"
+	"github.com/yigitkonur/proxy-http-forward/pkg/auth"
+	"github.com/yigitkonur/proxy-http-forward/pkg/config"
+	"github.com/yigitkonur/proxy-http-forward/pkg/dialer"
+	"github.com/yigitkonur/proxy-http-forward/pkg/egress"
+	"github.com/yigitkonur/proxy-http-forward/pkg/handler"
+	"github.com/yigitkonur/proxy-http-forward/pkg/pool"
+	"github.com/yigitkonur/proxy-http-forward/pkg/quota"
+	"github.com/yigitkonur/proxy-http-forward/pkg/resolver"
+	"github.com/yigitkonur/proxy-http-forward/pkg/route"
+)
+
+// startProxy serves a Handler built from cfg on loopback and returns its
+// address.
+func startProxy(t *testing.T, cfg config.Config) string {
+	t.Helper()
+	addr, _ := startProxyHandler(t, cfg)
+	return addr
+}
+
+// startProxyHandler is startProxy that also returns the Handler.
+func startProxyHandler(t *testing.T, cfg config.Config) (string, *handler.Handler) {
+	t.Helper()
+	if cfg.Proxy.DialTimeout == 0 {
+		cfg.Proxy.DialTimeout = time.Second
+	}
+	if cfg.Proxy.ResponseTimeout == 0 {
+		cfg.Proxy.ResponseTimeout = 5 * time.Second
+	}
+
+	m := getTestMetrics()
+	rt := route.New(cfg.Routes)
+	d := dialer.New(cfg.Proxy, rt, resolver.New(cfg.DNS), m)
+	p := pool.New(cfg.Proxy, d, rt)
+	q, err := quota.Open(cfg.Quotas, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	al, err := accesslog.New(cfg.Logging.Access)
+	require.NoError(t, err)
+	h := handler.New(p, d, rt, auth.New(cfg.Auth), egress.New(cfg.Egress, m), q, m, zap.NewNop().Sugar(), al, cfg.Proxy)
+
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := &fasthttp.Server{Handler: h.HandleRequest}
+	go srv.Serve(ln)
+	t.Cleanup(func() {
+		srv.Shutdown()
+		p.Close()
+		q.Close()
+	})
+
+	return ln.Addr().String(), h
+}
+
+// proxyGet sends an absolute-URI request through the proxy at addr.
+func proxyGet(t *testing.T, addr, method, url string) *fasthttp.Response {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// fasthttp.Request writes origin-form URIs, so the request line is
+	// written by hand.
+	var uri fasthttp.URI
+	require.NoError(t, uri.Parse(nil, []byte(url)))
+	_, err = fmt.Fprintf(conn, "%s %s HTTP/1.1\r\nHost: %s\r\nContent-Length: 0\r\n\r\n", method, url, uri.Host())
+	require.NoError(t, err)
+
+	resp := &fasthttp.Response{}
+	require.NoError(t, resp.Read(bufio.NewReader(conn)))
+	return resp
+}
+
+func TestHandlerRetriesStatus(t *testing.T) {
+	var calls int32
+	url := startUpstreamFunc(t, func(ctx *fasthttp.RequestCtx) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			ctx.SetStatusCode(fasthttp.StatusServiceUnavailable)
+			return
+		}
+		ctx.SetBodyString("ok")
+	})
+
+	addr := startProxy(t, config.Config{Proxy: config.ProxyConfig{
+		Retry: config.RetryConfig{MaxAttempts: 3, Backoff: time.Millisecond, RetryStatuses: []int{503}},
+	}})
+
+	resp := proxyGet(t, addr, "GET", url)
+	assert.Equal(t, fasthttp.StatusOK, resp.StatusCode())
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	// POST is not idempotent and is not retried by default.
+	atomic.StoreInt32(&calls, 0)
+	resp = proxyGet(t, addr, "POST", url)
+	assert.Equal(t, fasthttp.StatusServiceUnavailable, resp.StatusCode())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestHandlerRetriesReset(t *testing.T) {
+	// The first connection is closed without a response, as a stale
+	// keep-alive connection would be.
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	var accepted int32
+	srv := &fasthttp.Server{Handler: func(ctx *fasthttp.RequestCtx) { ctx.SetBodyString("ok") }}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if atomic.AddInt32(&accepted, 1) == 1 {
+				conn.Close()
+				continue
+			}
+			go srv.ServeConn(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+
+	addr := startProxy(t, config.Config{Proxy: config.ProxyConfig{
+		Retry: config.RetryConfig{MaxAttempts: 2, Backoff: time.Millisecond, RetryOn: []string{"reset"}},
+	}})
+
+	resp := proxyGet(t, addr, "GET", "http://"+ln.Addr().String()+"/")
+	assert.Equal(t, fasthttp.StatusOK, resp.StatusCode())
+	assert.Equal(t, int32(2), atomic.LoadInt32(&accepted))
+}
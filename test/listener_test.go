@@ -0,0 +1,142 @@
+package test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/auth"
+	"github.com/yigitkonur/proxy-http-forward/pkg/config"
+)
+
+// serveListener serves handler on ln until the test ends and returns its
+// address.
+func serveListener(t *testing.T, ln net.Listener, handler fasthttp.RequestHandler) string {
+	t.Helper()
+	srv := &fasthttp.Server{Handler: handler}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Shutdown() })
+	return ln.Addr().String()
+}
+
+func TestListenerAuthOverride(t *testing.T) {
+	url := startUpstreamFunc(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBodyString("ok")
+	})
+
+	addr, h := startProxyHandler(t, config.Config{Auth: config.AuthConfig{
+		Enabled: true,
+		Users:   []config.UserConfig{{Username: "alice", Password: "secret"}},
+	}})
+	resp := proxyGet(t, addr, "GET", url)
+	assert.Equal(t, fasthttp.StatusProxyAuthRequired, resp.StatusCode())
+
+	// An internal listener without auth shares the same handler.
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	internal := serveListener(t, ln, h.Listener(auth.New(config.AuthConfig{}), nil).HandleRequest)
+	resp = proxyGet(t, internal, "GET", url)
+	assert.Equal(t, fasthttp.StatusOK, resp.StatusCode())
+}
+
+func TestListenerTimeoutOverride(t *testing.T) {
+	url := startUpstreamFunc(t, func(ctx *fasthttp.RequestCtx) {
+		time.Sleep(200 * time.Millisecond)
+		ctx.SetBodyString("ok")
+	})
+
+	addr, h := startProxyHandler(t, config.Config{})
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	strict := serveListener(t, ln, h.Listener(nil, &config.TimeoutConfig{Request: 50 * time.Millisecond}).HandleRequest)
+
+	assert.Equal(t, fasthttp.StatusGatewayTimeout, proxyGet(t, strict, "GET", url).StatusCode())
+	assert.Equal(t, fasthttp.StatusOK, proxyGet(t, addr, "GET", url).StatusCode())
+}
+
+func TestHTTPSListener(t *testing.T) {
+	url := startUpstreamFunc(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBodyString("ok")
+	})
+	certFile, keyFile := writeCert(t, t.TempDir(), "proxy")
+
+	lc := config.ListenerTLSConfig{CertFile: certFile, KeyFile: keyFile, MinVersion: "1.2"}
+	serverTLS, err := lc.Build()
+	require.NoError(t, err)
+
+	_, h := startProxyHandler(t, config.Config{})
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := serveListener(t, tls.NewListener(ln, serverTLS), h.Listener(nil, nil).HandleRequest)
+
+	pem, err := os.ReadFile(certFile)
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	require.True(t, roots.AppendCertsFromPEM(pem))
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	var uri fasthttp.URI
+	require.NoError(t, uri.Parse(nil, []byte(url)))
+	_, err = fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\n\r\n", url, uri.Host())
+	require.NoError(t, err)
+
+	var resp fasthttp.Response
+	require.NoError(t, resp.Read(bufio.NewReader(conn)))
+	assert.Equal(t, fasthttp.StatusOK, resp.StatusCode())
+	assert.Equal(t, "ok", string(resp.Body()))
+}
+
+func TestListenerConfig(t *testing.T) {
+	cfg := config.Config{
+		Server: config.ServerConfig{Address: ":8080"},
+		Proxy:  config.ProxyConfig{DialTimeout: time.Second},
+		Auth:   config.AuthConfig{Realm: "proxy"},
+	}
+	assert.Equal(t, []config.ListenerConfig{{Name: ":8080", Address: ":8080", Protocol: "http"}}, cfg.Listeners())
+
+	cfg.Server.Listeners = []config.ListenerConfig{
+		{Address: ":3128", Auth: &config.AuthConfig{}},
+		{Name: "external", Address: ":8443", Protocol: "http"},
+		{Address: ":1080", Protocol: "socks5", ACL: config.ACLConfig{Allow: []string{"10.0.0.0/8", "192.0.2.1"}}},
+	}
+	require.NoError(t, cfg.Validate())
+	listeners := cfg.Listeners()
+	assert.Equal(t, ":3128", listeners[0].Name)
+	assert.Equal(t, "http", listeners[0].Protocol)
+	assert.Equal(t, "proxy", listeners[0].Auth.Realm)
+
+	tests := []struct {
+		name string
+		l    config.ListenerConfig
+	}{
+		{"duplicate address", config.ListenerConfig{Address: ":3128"}},
+		{"https without certificate", config.ListenerConfig{Address: ":9443", Protocol: "https"}},
+		{"proxy protocol without trusted sources", config.ListenerConfig{Address: ":9001", ProxyProtocol: config.ProxyProtocolConfig{Enabled: true}}},
+		{"unknown protocol", config.ListenerConfig{Address: ":2121", Protocol: "ftp"}},
+		{"invalid acl", config.ListenerConfig{Address: ":9002", ACL: config.ACLConfig{Deny: []string{"10.0.0.0/33"}}}},
+		{"acl on unix socket", config.ListenerConfig{Address: "unix:/tmp/proxy.sock", ACL: config.ACLConfig{Allow: []string{"10.0.0.0/8"}}}},
+		{"transparent with auth", config.ListenerConfig{Address: ":3129", Protocol: "transparent", Auth: &config.AuthConfig{
+			Enabled: true,
+			Users:   []config.UserConfig{{Username: "alice", Password: "secret"}},
+		}}},
+		{"auth without users", config.ListenerConfig{Address: ":9000", Auth: &config.AuthConfig{Enabled: true}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bad := cfg
+			bad.Server.Listeners = append([]config.ListenerConfig{{Address: ":3128"}}, tt.l)
+			assert.Error(t, bad.Validate())
+		})
+	}
+}
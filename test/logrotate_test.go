@@ -0,0 +1,81 @@
+package test
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/config"
+	"github.com/yigitkonur/proxy-http-forward/pkg/log"
+)
+
+func TestLogFileRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.log")
+	f, err := log.OpenFile(path, config.RotationConfig{MaxSize: 20, MaxBackups: 2, Compress: true})
+	require.NoError(t, err)
+	defer f.Close()
+
+	// Each line after the first takes the file over max_size.
+	for _, line := range []string{"first line\n", "second line\n", "third line\n", "fourth line\n"} {
+		_, err := f.Write([]byte(line))
+		require.NoError(t, err)
+		time.Sleep(5 * time.Millisecond)
+	}
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "fourth line\n", string(data))
+
+	// Backups are gzipped and only the newest two are kept.
+	var backups []string
+	require.Eventually(t, func() bool {
+		backups, _ = filepath.Glob(path + ".*.gz")
+		all, _ := filepath.Glob(path + ".*")
+		return len(backups) == 2 && len(all) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	zf, err := os.Open(backups[1])
+	require.NoError(t, err)
+	defer zf.Close()
+	zr, err := gzip.NewReader(zf)
+	require.NoError(t, err)
+	data, err = io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, "third line\n", string(data))
+}
+
+func TestLogFileReopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	f, err := log.OpenFile(path, config.RotationConfig{})
+	require.NoError(t, err)
+	defer f.Close()
+
+	_, err = f.Write([]byte("before\n"))
+	require.NoError(t, err)
+
+	// As logrotate does: move the file away, then signal a reopen.
+	moved := filepath.Join(dir, "access.log.1")
+	require.NoError(t, os.Rename(path, moved))
+	_, err = f.Write([]byte("still old\n"))
+	require.NoError(t, err)
+	require.NoError(t, log.Reopen(f))
+	_, err = f.Write([]byte("after\n"))
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"before", "still old"}, readLines(t, moved))
+	assert.Equal(t, []string{"after"}, readLines(t, path))
+
+	// A failed reopen keeps writing to the file already open.
+	require.NoError(t, os.Rename(path, moved))
+	require.NoError(t, os.Mkdir(path, 0755))
+	assert.Error(t, log.Reopen(f))
+	_, err = f.Write([]byte("kept\n"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"after", "kept"}, readLines(t, moved))
+}
@@ -0,0 +1,128 @@
+package test
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/config"
+	"github.com/yigitkonur/proxy-http-forward/pkg/overload"
+)
+
+// shedReason returns the reason err shed a request, or "" if it did not.
+func shedReason(err error) string {
+	if oe, ok := err.(*overload.Error); ok {
+		return oe.Reason
+	}
+	return ""
+}
+
+func TestOverloadQueue(t *testing.T) {
+	l := overload.New(config.ConcurrencyConfig{
+		MaxRequests:  2,
+		QueueSize:    1,
+		QueueTimeout: 100 * time.Millisecond,
+	}, getTestMetrics())
+
+	a, err := l.Acquire(overload.Request)
+	require.NoError(t, err)
+	_, err = l.Acquire(overload.Request)
+	require.NoError(t, err)
+
+	// The third waits for a slot; a fourth finds the queue full.
+	got := make(chan error, 1)
+	go func() {
+		_, err := l.Acquire(overload.Request)
+		got <- err
+	}()
+	depth := getTestMetrics().QueueDepth.WithLabelValues("http")
+	require.Eventually(t, func() bool { return testutil.ToFloat64(depth) == 1 }, time.Second, 5*time.Millisecond)
+	_, err = l.Acquire(overload.Request)
+	assert.Equal(t, overload.ReasonQueueFull, shedReason(err))
+	a.Release()
+	a.Release() // a second release is ignored
+	require.NoError(t, <-got)
+
+	// With no slot coming free, the wait runs out.
+	start := time.Now()
+	_, err = l.Acquire(overload.Request)
+	assert.Equal(t, overload.ReasonQueueTimeout, shedReason(err))
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+
+	// Tunnels have a cap of their own, unlimited here.
+	_, err = l.Acquire(overload.Tunnel)
+	assert.NoError(t, err)
+}
+
+func TestOverloadAdaptive(t *testing.T) {
+	l := overload.New(config.ConcurrencyConfig{
+		MaxRequests:  4,
+		QueueSize:    10,
+		QueueTimeout: time.Second,
+		Adaptive:     config.AdaptiveConfig{Enabled: true, TargetLatency: 5 * time.Millisecond, MinRequests: 1},
+	}, getTestMetrics())
+
+	// Holding a slot for long is not latency in itself.
+	s, err := l.Acquire(overload.Request)
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+	s.Release()
+
+	slots := make([]*overload.Slot, 4)
+	for i := range slots {
+		slots[i], err = l.Acquire(overload.Request)
+		require.NoError(t, err)
+	}
+
+	// A slow upstream attempt lowers the cap from 4 to 3, and while
+	// latency stays high, requests over it are shed instead of queued.
+	slots[0].Observe(20 * time.Millisecond)
+	for _, s := range slots {
+		s.Release()
+	}
+	for i := 0; i < 3; i++ {
+		_, err := l.Acquire(overload.Request)
+		require.NoError(t, err)
+	}
+	_, err = l.Acquire(overload.Request)
+	assert.Equal(t, overload.ReasonLatency, shedReason(err))
+}
+
+func TestOverloadedTunnel(t *testing.T) {
+	target := startRawUpstream(t, func(c net.Conn) {
+		c.Read(make([]byte, 1))
+	})
+	addr, _ := startProxyHandler(t, config.Config{Proxy: config.ProxyConfig{
+		Concurrency: config.ConcurrencyConfig{MaxTunnels: 1, RetryAfter: 2 * time.Second},
+	}})
+
+	connect := func() *fasthttp.Response {
+		conn, err := net.Dial("tcp4", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+		require.NoError(t, err)
+		resp := &fasthttp.Response{}
+		resp.SkipBody = true
+		require.NoError(t, resp.Read(bufio.NewReader(conn)))
+		return resp
+	}
+
+	conn, _ := proxyConnect(t, addr, target)
+	resp := connect()
+	assert.Equal(t, fasthttp.StatusServiceUnavailable, resp.StatusCode())
+	assert.Equal(t, "2", string(resp.Header.Peek("Retry-After")))
+
+	// Closing the tunnel frees its slot.
+	conn.Close()
+	require.Eventually(t, func() bool {
+		return connect().StatusCode() == fasthttp.StatusOK
+	}, time.Second, 10*time.Millisecond)
+}
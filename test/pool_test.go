@@ -0,0 +1,193 @@
+package test
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/config"
+	"github.com/yigitkonur/proxy-http-forward/pkg/dialer"
+	"github.com/yigitkonur/proxy-http-forward/pkg/metrics"
+	"github.com/yigitkonur/proxy-http-forward/pkg/pool"
+	"github.com/yigitkonur/proxy-http-forward/pkg/resolver"
+	"github.com/yigitkonur/proxy-http-forward/pkg/route"
+)
+
+// startUpstream starts a keep-alive HTTP server on loopback that holds
+// each request for delay and returns its base URL.
+func startUpstream(tb testing.TB, delay time.Duration) string {
+	tb.Helper()
+	return startUpstreamFunc(tb, func(ctx *fasthttp.RequestCtx) {
+		if delay > 0 {
+			time.Sleep(delay)
+		}
+		ctx.SetBodyString("ok")
+	})
+}
+
+// startUpstreamFunc starts an HTTP server on loopback serving handler and
+// returns its base URL.
+func startUpstreamFunc(tb testing.TB, handler fasthttp.RequestHandler) string {
+	tb.Helper()
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(tb, err)
+
+	srv := &fasthttp.Server{Handler: handler}
+	go srv.Serve(ln)
+	tb.Cleanup(func() { srv.Shutdown() })
+
+	return "http://" + ln.Addr().String() + "/"
+}
+
+func newTestPool(cfg config.ProxyConfig) *pool.Pool {
+	if cfg.DialTimeout == 0 {
+		cfg.DialTimeout = time.Second
+	}
+	d := dialer.New(cfg, route.New(nil), resolver.New(config.DNSConfig{}), getTestMetrics())
+	return pool.New(cfg, d, route.New(nil))
+}
+
+// get issues a GET for url through p.
+func get(p *pool.Pool, url string) error {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+	req.SetRequestURI(url)
+	return p.DoTimeout(req, resp, 5*time.Second)
+}
+
+func TestPoolReusesConnections(t *testing.T) {
+	url := startUpstream(t, 0)
+	p := newTestPool(config.ProxyConfig{MaxConnsPerHost: 4})
+	defer p.Close()
+
+	for i := 0; i < 50; i++ {
+		require.NoError(t, get(p, url))
+	}
+
+	stats := p.Stats()
+	assert.Equal(t, 1, stats.Hosts)
+	assert.Equal(t, uint64(50), stats.Requests)
+	assert.Equal(t, uint64(1), stats.Dials)
+	assert.InDelta(t, 0.98, stats.ReuseRatio(), 0.001)
+}
+
+func TestPoolGlobalConnLimit(t *testing.T) {
+	a := startUpstream(t, 100*time.Millisecond)
+	b := startUpstream(t, 100*time.Millisecond)
+	p := newTestPool(config.ProxyConfig{MaxConns: 2, MaxConnsPerHost: 2})
+	defer p.Close()
+
+	// Four concurrent requests over two hosts cannot all get a connection.
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for _, url := range []string{a, a, b, b} {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			errs <- get(p, url)
+		}(url)
+	}
+	wg.Wait()
+	close(errs)
+
+	var limited int
+	for err := range errs {
+		if err != nil {
+			assert.ErrorIs(t, err, pool.ErrTooManyConns)
+			limited++
+		}
+	}
+	assert.Greater(t, limited, 0)
+	assert.LessOrEqual(t, p.Stats().OpenConns, 2)
+}
+
+func BenchmarkPoolReuse(b *testing.B) {
+	url := startUpstream(b, 0)
+	p := newTestPool(config.ProxyConfig{MaxConnsPerHost: 64})
+	defer p.Close()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := get(p, url); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+	b.StopTimer()
+
+	stats := p.Stats()
+	b.ReportMetric(stats.ReuseRatio(), "reuse")
+	b.ReportMetric(float64(stats.Dials), "dials")
+}
+
+func BenchmarkPoolReuseManyHosts(b *testing.B) {
+	urls := make([]string, 8)
+	for i := range urls {
+		urls[i] = startUpstream(b, 0)
+	}
+	p := newTestPool(config.ProxyConfig{MaxConnsPerHost: 16, MaxConns: 128})
+	defer p.Close()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			if err := get(p, urls[i%len(urls)]); err != nil {
+				b.Error(err)
+				return
+			}
+			i++
+		}
+	})
+	b.StopTimer()
+
+	stats := p.Stats()
+	b.ReportMetric(stats.ReuseRatio(), "reuse")
+	b.ReportMetric(float64(stats.Dials), "dials")
+}
+
+func TestPoolHostStats(t *testing.T) {
+	a := startUpstream(t, 0)
+	b := startUpstream(t, 0)
+	p := newTestPool(config.ProxyConfig{MaxConnsPerHost: 4})
+	defer p.Close()
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, get(p, a))
+	}
+	require.NoError(t, get(p, b))
+
+	stats := metrics.TopHosts(p.HostStats(), 0)
+	require.Len(t, stats, 2)
+	assert.Equal(t, uint64(10), stats[0].Requests)
+	assert.Equal(t, 1, stats[0].Open)
+	assert.Equal(t, 1, stats[0].Idle)
+	assert.Equal(t, 0, stats[0].Pending)
+	assert.InDelta(t, 0.9, stats[0].ReuseRatio(), 0.001)
+}
+
+func TestTopHosts(t *testing.T) {
+	stats := []metrics.HostStat{
+		{Host: "a:80", Open: 1, Requests: 5},
+		{Host: "b:80", Open: 7, Requests: 1},
+		{Host: "c:80", Open: 3, Pending: 2},
+		{Host: "d:80", Open: 2, Requests: 9, Dials: 2},
+	}
+
+	top := metrics.TopHosts(stats, 2)
+	require.Len(t, top, 3)
+	assert.Equal(t, "b:80", top[0].Host)
+	assert.Equal(t, "c:80", top[1].Host)
+	assert.Equal(t, metrics.HostStat{Host: metrics.OtherHost, Open: 3, Requests: 14, Dials: 2}, top[2])
+
+	assert.Len(t, metrics.TopHosts(stats, 10), 4)
+}
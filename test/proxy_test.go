@@ -9,10 +9,15 @@ import (
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
 
+	"github.com/yigitkonur/proxy-http-forward/pkg/auth"
 	"github.com/yigitkonur/proxy-http-forward/pkg/config"
+	"github.com/yigitkonur/proxy-http-forward/pkg/dialer"
+	"github.com/yigitkonur/proxy-http-forward/pkg/egress"
 	"github.com/yigitkonur/proxy-http-forward/pkg/handler"
 	"github.com/yigitkonur/proxy-http-forward/pkg/metrics"
 	"github.com/yigitkonur/proxy-http-forward/pkg/pool"
+	"github.com/yigitkonur/proxy-http-forward/pkg/resolver"
+	"github.com/yigitkonur/proxy-http-forward/pkg/route"
 )
 
 // Shared metrics instance to avoid duplicate registration
@@ -57,13 +62,14 @@ func TestPoolCreation(t *testing.T) {
 		MaxIdleConns:    100,
 	}
 
-	p := pool.New(cfg)
+	p := pool.New(cfg, dialer.New(cfg, route.New(nil), resolver.New(config.DNSConfig{}), getTestMetrics()), route.New(nil))
 	require.NotNil(t, p)
+	defer p.Close()
 
-	// Get and put a client
-	client := p.Get()
-	assert.NotNil(t, client)
-	p.Put(client)
+	// A new pool holds no hosts or connections
+	stats := p.Stats()
+	assert.Equal(t, 0, stats.Hosts)
+	assert.Equal(t, 0, stats.OpenConns)
 }
 
 func TestMetrics(t *testing.T) {
@@ -86,11 +92,12 @@ func TestHandlerCreation(t *testing.T) {
 		MaxIdleConns:    100,
 	}
 
-	p := pool.New(cfg)
+	d := dialer.New(cfg, route.New(nil), resolver.New(config.DNSConfig{}), getTestMetrics())
+	p := pool.New(cfg, d, route.New(nil))
 	m := getTestMetrics() // Reuse shared metrics
 	logger, _ := zap.NewDevelopment()
 
-	h := handler.New(p, m, logger.Sugar(), cfg)
+	h := handler.New(p, d, route.New(nil), auth.New(config.AuthConfig{}), egress.New(config.EgressConfig{}, m), nil, m, logger.Sugar(), nil, cfg)
 	require.NotNil(t, h)
 }
 
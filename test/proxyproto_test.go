@@ -0,0 +1,235 @@
+package test
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/config"
+	"github.com/yigitkonur/proxy-http-forward/pkg/proxyproto"
+)
+
+// v2Header builds a PROXY protocol v2 header for TCP over IPv4.
+func v2Header(src, dst string, sport, dport uint16) []byte {
+	var b bytes.Buffer
+	b.WriteString("\r\n\r\n\x00\r\nQUIT\n")
+	b.Write([]byte{0x21, 0x11, 0, 12})
+	b.Write(net.ParseIP(src).To4())
+	b.Write(net.ParseIP(dst).To4())
+	binary.Write(&b, binary.BigEndian, sport)
+	binary.Write(&b, binary.BigEndian, dport)
+	return b.Bytes()
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		version int
+		src     string
+		wantErr bool
+	}{
+		{"v1 tcp4", "PROXY TCP4 203.0.113.7 10.0.0.1 51000 3128\r\n", 1, "203.0.113.7:51000", false},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::7 2001:db8::1 51000 3128\r\n", 1, "[2001:db8::7]:51000", false},
+		{"v1 unknown", "PROXY UNKNOWN\r\n", 1, "", false},
+		{"v2 tcp4", string(v2Header("198.51.100.9", "10.0.0.1", 40000, 3128)), 2, "198.51.100.9:40000", false},
+		{"v2 local", "\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00", 2, "", false},
+		{"v1 family mismatch", "PROXY TCP4 2001:db8::7 10.0.0.1 51000 3128\r\n", 0, "", true},
+		{"v1 missing CRLF", "PROXY TCP4 203.0.113.7 10.0.0.1 51000 3128\n", 0, "", true},
+		{"plain http", "GET http://example.com/ HTTP/1.1\r\n", 0, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.input + "rest"))
+			h, err := proxyproto.ReadHeader(r)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.version, h.Version)
+			if tt.src == "" {
+				assert.Nil(t, h.Source)
+			} else {
+				assert.Equal(t, tt.src, h.Source.String())
+			}
+
+			// Data after the header is left for the application.
+			rest, _ := io.ReadAll(r)
+			assert.Equal(t, "rest", string(rest))
+		})
+	}
+}
+
+// startProxyProtocolProxy serves a proxy behind a PROXY protocol
+// listener trusting trusted, and reports header failures on rejected.
+func startProxyProtocolProxy(t *testing.T, trusted string, rejected chan<- error) string {
+	t.Helper()
+	pp := config.ProxyProtocolConfig{TrustedSources: []string{trusted}}
+	nets, err := pp.Trusted()
+	require.NoError(t, err)
+
+	_, h := startProxyHandler(t, config.Config{})
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	return serveListener(t, proxyproto.NewListener(ln, nets, time.Second, func(_ net.Addr, err error) {
+		rejected <- err
+	}), h.HandleRequest)
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	url := startUpstreamFunc(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.Write(ctx.Request.Header.Peek("X-Forwarded-For"))
+	})
+	request := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: upstream\r\n\r\n", url)
+
+	send := func(t *testing.T, addr, data string) *fasthttp.Response {
+		conn, err := net.Dial("tcp4", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = io.WriteString(conn, data)
+		require.NoError(t, err)
+		var resp fasthttp.Response
+		require.NoError(t, resp.Read(bufio.NewReader(conn)))
+		return &resp
+	}
+
+	t.Run("trusted source", func(t *testing.T) {
+		addr := startProxyProtocolProxy(t, "127.0.0.0/8", make(chan error, 1))
+		resp := send(t, addr, "PROXY TCP4 203.0.113.7 10.0.0.1 51000 3128\r\n"+request)
+		assert.Equal(t, "203.0.113.7", string(resp.Body()))
+
+		resp = send(t, addr, string(v2Header("198.51.100.9", "10.0.0.1", 40000, 3128))+request)
+		assert.Equal(t, "198.51.100.9", string(resp.Body()))
+	})
+
+	t.Run("untrusted source", func(t *testing.T) {
+		addr := startProxyProtocolProxy(t, "10.0.0.0/8", make(chan error, 1))
+		resp := send(t, addr, request)
+		assert.Equal(t, "127.0.0.1", string(resp.Body()))
+	})
+
+	t.Run("missing header", func(t *testing.T) {
+		rejected := make(chan error, 1)
+		addr := startProxyProtocolProxy(t, "127.0.0.1", rejected)
+		conn, err := net.Dial("tcp4", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = io.WriteString(conn, request)
+		require.NoError(t, err)
+
+		assert.ErrorIs(t, <-rejected, proxyproto.ErrNoHeader)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, io.EOF, "connection should be closed")
+	})
+
+	t.Run("silent peer does not block others", func(t *testing.T) {
+		addr := startProxyProtocolProxy(t, "127.0.0.0/8", make(chan error, 1))
+		silent, err := net.Dial("tcp4", addr)
+		require.NoError(t, err)
+		defer silent.Close()
+
+		start := time.Now()
+		resp := send(t, addr, "PROXY TCP4 203.0.113.8 10.0.0.1 51000 3128\r\n"+request)
+		assert.Equal(t, "203.0.113.8", string(resp.Body()))
+		assert.Less(t, time.Since(start), 500*time.Millisecond)
+	})
+}
+
+func TestWriteProxyHeaderV2(t *testing.T) {
+	h := &proxyproto.Header{
+		Source:      &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51000},
+		Destination: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443},
+		TLVs:        []proxyproto.TLV{{Type: proxyproto.TypeAuthority, Value: []byte("example.com")}},
+	}
+	b, err := h.AppendV2(nil)
+	require.NoError(t, err)
+
+	got, err := proxyproto.ReadHeader(bufio.NewReader(bytes.NewReader(b)))
+	require.NoError(t, err)
+	assert.Equal(t, 2, got.Version)
+	assert.Equal(t, "203.0.113.7:51000", got.Source.String())
+	assert.Equal(t, "[2001:db8::1]:443", got.Destination.String())
+	authority, ok := got.TLV(proxyproto.TypeAuthority)
+	assert.True(t, ok)
+	assert.Equal(t, "example.com", string(authority))
+}
+
+func TestSendProxyProtocol(t *testing.T) {
+	type received struct {
+		header *proxyproto.Header
+		first  byte
+	}
+	got := make(chan received, 1)
+	target := startRawUpstream(t, func(c net.Conn) {
+		r := bufio.NewReader(c)
+		h, err := proxyproto.ReadHeader(r)
+		if err != nil {
+			got <- received{}
+			return
+		}
+		first, _ := r.ReadByte()
+		got <- received{h, first}
+	})
+
+	connect := func(t *testing.T, sniWait time.Duration) net.Conn {
+		addr, _ := startProxyHandler(t, config.Config{
+			Auth: config.AuthConfig{Enabled: true, Users: []config.UserConfig{{Username: "alice", Password: "secret"}}},
+			Routes: []config.RouteConfig{{
+				Match:             []string{"127.0.0.1"},
+				SendProxyProtocol: &config.SendProxyProtocolConfig{Enabled: true, SNIWait: sniWait},
+			}},
+		})
+		conn, err := net.Dial("tcp4", addr)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		creds := base64.StdEncoding.EncodeToString([]byte("alice:secret"))
+		_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\nProxy-Authorization: Basic %s\r\n\r\n", target, target, creds)
+		require.NoError(t, err)
+		var resp fasthttp.Response
+		resp.SkipBody = true
+		require.NoError(t, resp.Read(bufio.NewReader(conn)))
+		require.Equal(t, fasthttp.StatusOK, resp.StatusCode())
+		return conn
+	}
+
+	t.Run("server name from ClientHello", func(t *testing.T) {
+		conn := connect(t, time.Second)
+		go tls.Client(conn, &tls.Config{ServerName: "backend.example.com"}).Handshake()
+
+		r := <-got
+		require.NotNil(t, r.header)
+		assert.Equal(t, conn.LocalAddr().String(), r.header.Source.String())
+		assert.Equal(t, target, r.header.Destination.String())
+		sni, _ := r.header.TLV(proxyproto.TypeAuthority)
+		assert.Equal(t, "backend.example.com", string(sni))
+		user, _ := r.header.TLV(proxyproto.TypeUser)
+		assert.Equal(t, "alice", string(user))
+		assert.Equal(t, byte(0x16), r.first, "the ClientHello should follow the header")
+	})
+
+	t.Run("without waiting for the client", func(t *testing.T) {
+		conn := connect(t, 0)
+		_, err := conn.Write([]byte("x"))
+		require.NoError(t, err)
+
+		r := <-got
+		require.NotNil(t, r.header)
+		_, ok := r.header.TLV(proxyproto.TypeAuthority)
+		assert.False(t, ok, "an IP destination has no server name")
+		assert.Equal(t, byte('x'), r.first)
+	})
+}
@@ -0,0 +1,205 @@
+package test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/config"
+	"github.com/yigitkonur/proxy-http-forward/pkg/quota"
+)
+
+func TestQuotaTracker(t *testing.T) {
+	cfg := config.QuotaConfig{
+		Enabled:       true,
+		File:          filepath.Join(t.TempDir(), "usage.log"),
+		FlushInterval: time.Hour,
+		Daily:         config.QuotaLimit{Requests: 2},
+		Monthly:       config.QuotaLimit{Bytes: 1000},
+		Groups:        []config.QuotaGroupConfig{{Name: "batch", Users: []string{"carol"}}},
+	}
+	q, err := quota.Open(cfg, zap.NewNop().Sugar())
+	require.NoError(t, err)
+
+	// Two requests a day, then a wait until midnight UTC.
+	for i := 0; i < 2; i++ {
+		_, err := q.Check("alice")
+		require.NoError(t, err)
+		q.AddRequest("alice")
+	}
+	reset, err := q.Check("alice")
+	assert.ErrorIs(t, err, quota.ErrExceeded)
+	assert.True(t, reset > 0 && reset <= 24*time.Hour, "reset in %v", reset)
+
+	// Bytes count towards the month; carol's group has no limits.
+	assert.NoError(t, q.Add("bob", 600))
+	assert.ErrorIs(t, q.Add("bob", 600), quota.ErrExceeded)
+	_, err = q.Check("bob")
+	assert.ErrorIs(t, err, quota.ErrExceeded)
+	assert.NoError(t, q.Add("carol", 5000))
+	require.NoError(t, q.Close())
+
+	// Usage survives a restart, and a line cut short by a crash is skipped.
+	f, err := os.OpenFile(cfg.File, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"user":"alice","period":"20`)
+	require.NoError(t, err)
+	f.Close()
+
+	q, err = quota.Open(cfg, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	defer q.Close()
+	today, month := q.Usage("alice")
+	assert.Equal(t, quota.Usage{Requests: 2}, today)
+	assert.Equal(t, quota.Usage{Requests: 2}, month)
+	_, err = q.Check("alice")
+	assert.ErrorIs(t, err, quota.ErrExceeded)
+
+	// Opening compacted the log to one line per user and period.
+	data, err := os.ReadFile(cfg.File)
+	require.NoError(t, err)
+	assert.Equal(t, 6, strings.Count(string(data), "\n"))
+
+	// Raised limits apply at once.
+	cfg.Daily.Requests = 10
+	q.Update(cfg)
+	_, err = q.Check("alice")
+	assert.NoError(t, err)
+}
+
+func TestQuotaReport(t *testing.T) {
+	recs := []quota.Record{
+		{User: "alice", Period: "2026-10", Bytes: 1500, Requests: 3},
+		{User: "alice", Period: "2026-10-18", Bytes: 500, Requests: 1},
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, quota.WriteReport(&buf, recs, "csv"))
+	assert.Equal(t, "user,period,bytes,requests\nalice,2026-10,1500,3\nalice,2026-10-18,500,1\n", buf.String())
+
+	buf.Reset()
+	require.NoError(t, quota.WriteReport(&buf, recs[:1], "json"))
+	assert.JSONEq(t, `[{"user":"alice","period":"2026-10","bytes":1500,"requests":3}]`, buf.String())
+
+	assert.Error(t, quota.WriteReport(&buf, recs, "xml"))
+}
+
+func TestQuotaTunnel(t *testing.T) {
+	target := startRawUpstream(t, func(c net.Conn) {
+		c.Write(make([]byte, 1<<20))
+	})
+	addr, _ := startProxyHandler(t, config.Config{
+		Auth: config.AuthConfig{Enabled: true, Users: []config.UserConfig{{Username: "alice", Password: "secret"}}},
+		Quotas: config.QuotaConfig{
+			Enabled:       true,
+			File:          filepath.Join(t.TempDir(), "usage.log"),
+			FlushInterval: time.Hour,
+			Daily:         config.QuotaLimit{Bytes: 10000},
+		},
+	})
+
+	connect := func() (*fasthttp.Response, *bufio.Reader) {
+		conn, err := net.Dial("tcp4", addr)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		creds := base64.StdEncoding.EncodeToString([]byte("alice:secret"))
+		_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\nProxy-Authorization: Basic %s\r\n\r\n", target, target, creds)
+		require.NoError(t, err)
+		br := bufio.NewReader(conn)
+		resp := &fasthttp.Response{}
+		resp.SkipBody = true
+		require.NoError(t, resp.Read(br))
+		return resp, br
+	}
+
+	// The tunnel is cut once the quota is used up.
+	resp, br := connect()
+	require.Equal(t, fasthttp.StatusOK, resp.StatusCode())
+	n, _ := io.Copy(io.Discard, br)
+	assert.Less(t, n, int64(1<<20))
+
+	// Later tunnels are refused until the quota resets.
+	resp, _ = connect()
+	assert.Equal(t, fasthttp.StatusTooManyRequests, resp.StatusCode())
+	assert.NotEmpty(t, resp.Header.Peek("Retry-After"))
+}
+
+func TestQuotaUnverifiedUser(t *testing.T) {
+	url := startUpstreamFunc(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBodyString("ok")
+	})
+	addr, _ := startProxyHandler(t, config.Config{
+		Quotas: config.QuotaConfig{
+			Enabled:       true,
+			File:          filepath.Join(t.TempDir(), "usage.log"),
+			FlushInterval: time.Hour,
+			Daily:         config.QuotaLimit{Requests: 1},
+		},
+	})
+
+	// Without auth, the username is only a claim and is not charged.
+	creds := base64.StdEncoding.EncodeToString([]byte("alice:anything"))
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp4", addr)
+		require.NoError(t, err)
+		_, err = fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: upstream\r\nProxy-Authorization: Basic %s\r\n\r\n", url, creds)
+		require.NoError(t, err)
+		resp := &fasthttp.Response{}
+		require.NoError(t, resp.Read(bufio.NewReader(conn)))
+		conn.Close()
+		assert.Equal(t, fasthttp.StatusOK, resp.StatusCode())
+	}
+}
+
+func TestQuotaFailedRequests(t *testing.T) {
+	url := startUpstreamFunc(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBodyString("ok")
+	})
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	closed := "http://" + ln.Addr().String() + "/"
+	ln.Close()
+
+	addr, _ := startProxyHandler(t, config.Config{
+		Auth: config.AuthConfig{Enabled: true, Users: []config.UserConfig{{Username: "alice", Password: "secret"}}},
+		Quotas: config.QuotaConfig{
+			Enabled:       true,
+			File:          filepath.Join(t.TempDir(), "usage.log"),
+			FlushInterval: time.Hour,
+			Daily:         config.QuotaLimit{Requests: 1},
+		},
+	})
+
+	creds := base64.StdEncoding.EncodeToString([]byte("alice:secret"))
+	get := func(target string) int {
+		conn, err := net.Dial("tcp4", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: upstream\r\nProxy-Authorization: Basic %s\r\n\r\n", target, creds)
+		require.NoError(t, err)
+		resp := &fasthttp.Response{}
+		require.NoError(t, resp.Read(bufio.NewReader(conn)))
+		return resp.StatusCode()
+	}
+
+	// Requests that never reach the upstream are not charged.
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, fasthttp.StatusBadGateway, get(closed))
+	}
+	assert.Equal(t, fasthttp.StatusOK, get(url))
+	assert.Equal(t, fasthttp.StatusTooManyRequests, get(url))
+}
@@ -0,0 +1,103 @@
+package test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/config"
+	"github.com/yigitkonur/proxy-http-forward/pkg/ratelimit"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := ratelimit.New(config.RateLimitConfig{Rules: []config.RateLimitRule{
+		{Name: "vip", Key: "user", Users: []string{"bob"}, RequestsPerSecond: 100},
+		{Name: "users", Key: "user", RequestsPerSecond: 1, Burst: 2},
+		{Name: "clients", Key: "client_ip", Clients: []string{"10.0.0.0/8"}, TunnelsPerSecond: 1},
+	}})
+	alice := ratelimit.Client{IP: net.ParseIP("192.0.2.1"), User: "alice"}
+
+	// A burst of two, then one per second.
+	for i := 0; i < 2; i++ {
+		_, _, ok := l.Allow(ratelimit.Request, alice)
+		require.True(t, ok)
+	}
+	rule, wait, ok := l.Allow(ratelimit.Request, alice)
+	assert.False(t, ok)
+	assert.Equal(t, "users", rule)
+	assert.InDelta(t, time.Second, wait, float64(50*time.Millisecond))
+
+	// Tunnels and other users have buckets of their own.
+	_, _, ok = l.Allow(ratelimit.Tunnel, alice)
+	assert.True(t, ok)
+	_, _, ok = l.Allow(ratelimit.Request, ratelimit.Client{IP: alice.IP, User: "carol"})
+	assert.True(t, ok)
+
+	// bob's group comes first, so the catch-all user rule does not apply.
+	bob := ratelimit.Client{IP: alice.IP, User: "bob"}
+	for i := 0; i < 10; i++ {
+		_, _, ok = l.Allow(ratelimit.Request, bob)
+		require.True(t, ok)
+	}
+
+	// Client rules only apply to their networks.
+	internal := ratelimit.Client{IP: net.ParseIP("10.1.2.3")}
+	_, _, ok = l.Allow(ratelimit.Tunnel, internal)
+	assert.True(t, ok)
+	rule, _, ok = l.Allow(ratelimit.Tunnel, internal)
+	assert.False(t, ok)
+	assert.Equal(t, "clients", rule)
+	_, _, ok = l.Allow(ratelimit.Tunnel, ratelimit.Client{IP: net.ParseIP("192.0.2.2")})
+	assert.True(t, ok)
+}
+
+func TestRateLimitedRequest(t *testing.T) {
+	url := startUpstreamFunc(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBodyString("ok")
+	})
+	addr, _ := startProxyHandler(t, config.Config{Proxy: config.ProxyConfig{
+		RateLimits: config.RateLimitConfig{Rules: []config.RateLimitRule{
+			{Key: "destination", RequestsPerSecond: 0.5},
+		}},
+	}})
+
+	assert.Equal(t, fasthttp.StatusOK, proxyGet(t, addr, "GET", url).StatusCode())
+	resp := proxyGet(t, addr, "GET", url)
+	assert.Equal(t, fasthttp.StatusTooManyRequests, resp.StatusCode())
+	assert.Equal(t, "2", string(resp.Header.Peek("Retry-After")))
+}
+
+func TestRateLimitConfig(t *testing.T) {
+	valid := config.RateLimitRule{Key: "client_ip", RequestsPerSecond: 10}
+	tests := []struct {
+		name    string
+		rule    func(r *config.RateLimitRule)
+		wantErr bool
+	}{
+		{"valid", func(r *config.RateLimitRule) {}, false},
+		{"unknown key", func(r *config.RateLimitRule) { r.Key = "session" }, true},
+		{"no rate", func(r *config.RateLimitRule) { r.RequestsPerSecond = 0 }, true},
+		{"negative burst", func(r *config.RateLimitRule) { r.Burst = -1 }, true},
+		{"invalid client", func(r *config.RateLimitRule) { r.Clients = []string{"10.0.0.0/33"} }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Config{
+				Server: config.ServerConfig{Address: ":8080"},
+				Proxy:  config.ProxyConfig{DialTimeout: time.Second},
+			}
+			r := valid
+			tt.rule(&r)
+			cfg.Proxy.RateLimits.Rules = []config.RateLimitRule{r}
+			if tt.wantErr {
+				assert.Error(t, cfg.Validate())
+			} else {
+				assert.NoError(t, cfg.Validate())
+			}
+		})
+	}
+}
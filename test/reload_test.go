@@ -0,0 +1,144 @@
+package test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/auth"
+	"github.com/yigitkonur/proxy-http-forward/pkg/config"
+	"github.com/yigitkonur/proxy-http-forward/pkg/dialer"
+	"github.com/yigitkonur/proxy-http-forward/pkg/pool"
+	"github.com/yigitkonur/proxy-http-forward/pkg/resolver"
+	"github.com/yigitkonur/proxy-http-forward/pkg/route"
+)
+
+func TestConfigDiff(t *testing.T) {
+	a := &config.Config{Server: config.ServerConfig{Address: ":8080"}}
+	b := *a
+	assert.Empty(t, config.Diff(a, &b))
+
+	b.Server.Address = ":8081"
+	b.Proxy.Timeouts.FirstByte = time.Second
+	b.Routes = []config.RouteConfig{{Match: []string{"*"}}}
+	b.File = "other.yaml"
+	assert.Equal(t, []string{"server.address", "proxy.timeouts", "routes"}, config.Diff(a, &b))
+}
+
+func TestConfigValidateLogLevel(t *testing.T) {
+	cfg := config.Config{
+		Server:  config.ServerConfig{Address: ":8080"},
+		Proxy:   config.ProxyConfig{DialTimeout: time.Second},
+		Logging: config.LoggingConfig{Level: "verbose"},
+	}
+	assert.Error(t, cfg.Validate())
+
+	cfg.Logging.Level = "debug"
+	assert.NoError(t, cfg.Validate())
+}
+
+func TestAuthUpdate(t *testing.T) {
+	a := auth.New(config.AuthConfig{
+		Enabled: true,
+		Users:   []config.UserConfig{{Username: "alice", Password: "secret"}},
+	})
+	_, ok := a.Authenticate(proxyAuthHeader("alice", "secret"))
+	assert.True(t, ok)
+
+	a.Update(config.AuthConfig{
+		Enabled: true,
+		Realm:   "new",
+		Users:   []config.UserConfig{{Username: "bob", Password: "hunter2"}},
+	})
+	_, ok = a.Authenticate(proxyAuthHeader("alice", "secret"))
+	assert.False(t, ok)
+	_, ok = a.Authenticate(proxyAuthHeader("bob", "hunter2"))
+	assert.True(t, ok)
+	assert.Equal(t, `Basic realm="new"`, a.Challenge())
+}
+
+func TestPoolReloadRoutes(t *testing.T) {
+	url := startUpstreamFunc(t, func(ctx *fasthttp.RequestCtx) {
+		time.Sleep(200 * time.Millisecond)
+		ctx.SetBodyString("ok")
+	})
+
+	cfg := config.ProxyConfig{DialTimeout: time.Second}
+	rt := route.New([]config.RouteConfig{{
+		Match:    []string{"*"},
+		Timeouts: &config.TimeoutConfig{FirstByte: 50 * time.Millisecond},
+	}})
+	d := dialer.New(cfg, rt, resolver.New(config.DNSConfig{}), getTestMetrics())
+	p := pool.New(cfg, d, rt)
+	defer p.Close()
+
+	var te *pool.TimeoutError
+	err := get(p, url)
+	require.True(t, errors.As(err, &te), "got %v", err)
+	assert.Equal(t, pool.ReasonFirstByteTimeout, te.Reason)
+
+	// Without the route, the next request gets a host without the
+	// first-byte timeout.
+	rt.Update(nil)
+	p.Reload(cfg)
+	assert.NoError(t, get(p, url))
+}
+
+func TestHandlerReloadTimeouts(t *testing.T) {
+	url := startUpstreamFunc(t, func(ctx *fasthttp.RequestCtx) {
+		time.Sleep(200 * time.Millisecond)
+		ctx.SetBodyString("ok")
+	})
+
+	cfg := config.Config{Proxy: config.ProxyConfig{
+		Timeouts: config.TimeoutConfig{Request: 50 * time.Millisecond},
+	}}
+	addr, h := startProxyHandler(t, cfg)
+
+	resp := proxyGet(t, addr, "GET", url)
+	assert.Equal(t, fasthttp.StatusGatewayTimeout, resp.StatusCode())
+
+	cfg.Proxy.Timeouts.Request = 0
+	h.Reload(cfg.Proxy)
+	resp = proxyGet(t, addr, "GET", url)
+	assert.Equal(t, fasthttp.StatusOK, resp.StatusCode())
+
+	cfg.Proxy.ResponseTimeout = 50 * time.Millisecond
+	h.Reload(cfg.Proxy)
+	resp = proxyGet(t, addr, "GET", url)
+	assert.Equal(t, fasthttp.StatusGatewayTimeout, resp.StatusCode())
+}
+
+func TestConfigWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("logging:\n  level: info\n"), 0o644))
+
+	changed := make(chan struct{}, 10)
+	w, err := config.Watch(path, func() { changed <- struct{}{} })
+	require.NoError(t, err)
+	defer w.Close()
+
+	// Unrelated files in the directory are ignored.
+	require.NoError(t, os.WriteFile(filepath.Join(filepath.Dir(path), "other"), nil, 0o644))
+	select {
+	case <-changed:
+		t.Fatal("notified for an unrelated file")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	// Saving by rename, as many editors do, is noticed.
+	tmp := path + ".tmp"
+	require.NoError(t, os.WriteFile(tmp, []byte("logging:\n  level: debug\n"), 0o644))
+	require.NoError(t, os.Rename(tmp, path))
+	select {
+	case <-changed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("change not noticed")
+	}
+}
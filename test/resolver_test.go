@@ -0,0 +1,127 @@
+package test
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/config"
+	"github.com/yigitkonur/proxy-http-forward/pkg/resolver"
+)
+
+// newDoHServer starts an in-process DoH server answering A and AAAA
+// queries from records and counting the queries it receives.
+func newDoHServer(t *testing.T, records map[string][]string, queries *int32) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(queries, 1)
+
+		var raw []byte
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			raw, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		case http.MethodPost:
+			if r.Header.Get("Content-Type") != "application/dns-message" {
+				http.Error(w, "bad content type", http.StatusUnsupportedMediaType)
+				return
+			}
+			raw, err = io.ReadAll(r.Body)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var msg dnsmessage.Message
+		if err := msg.Unpack(raw); err != nil || len(msg.Questions) != 1 {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		q := msg.Questions[0]
+		msg.Header.Response = true
+		for _, s := range records[q.Name.String()] {
+			ip := net.ParseIP(s)
+			hdr := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 300}
+			switch {
+			case q.Type == dnsmessage.TypeA && ip.To4() != nil:
+				var a [4]byte
+				copy(a[:], ip.To4())
+				msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: hdr, Body: &dnsmessage.AResource{A: a}})
+			case q.Type == dnsmessage.TypeAAAA && ip.To4() == nil:
+				var aaaa [16]byte
+				copy(aaaa[:], ip)
+				msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: hdr, Body: &dnsmessage.AAAAResource{AAAA: aaaa}})
+			}
+		}
+		out, _ := msg.Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(out)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestResolverDoH(t *testing.T) {
+	records := map[string][]string{"example.test.": {"192.0.2.10"}}
+
+	for _, method := range []string{"GET", "POST"} {
+		t.Run(method, func(t *testing.T) {
+			var queries int32
+			srv := newDoHServer(t, records, &queries)
+
+			// The URL's own query is kept alongside dns=.
+			r := resolver.New(config.DNSConfig{
+				Upstreams: []config.DNSUpstreamConfig{{Type: "doh", Address: srv.URL + "/dns-query?ct=1", Method: method}},
+				Timeout:   2 * time.Second,
+			})
+
+			ips, err := r.LookupIP(context.Background(), "ip", "example.test")
+			require.NoError(t, err)
+			require.Len(t, ips, 1)
+			assert.Equal(t, "192.0.2.10", ips[0].String())
+
+			// A and AAAA were queried once each; the next lookup is cached.
+			_, err = r.LookupIP(context.Background(), "ip", "example.test")
+			require.NoError(t, err)
+			assert.Equal(t, int32(2), atomic.LoadInt32(&queries))
+		})
+	}
+}
+
+func TestResolverFallback(t *testing.T) {
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer broken.Close()
+
+	var queries int32
+	good := newDoHServer(t, map[string][]string{"fallback.test.": {"192.0.2.20"}}, &queries)
+
+	r := resolver.New(config.DNSConfig{
+		Upstreams: []config.DNSUpstreamConfig{
+			{Type: "doh", Address: broken.URL},
+			{Type: "doh", Address: good.URL},
+		},
+		Timeout: 2 * time.Second,
+	})
+
+	ips, err := r.LookupIP(context.Background(), "ip", "fallback.test")
+	require.NoError(t, err)
+	require.Len(t, ips, 1)
+	assert.Equal(t, "192.0.2.20", ips[0].String())
+	assert.Equal(t, int32(2), atomic.LoadInt32(&queries))
+
+	_, err = r.LookupIP(context.Background(), "ip", "missing.test")
+	assert.Error(t, err)
+}
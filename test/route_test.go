@@ -0,0 +1,57 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/config"
+	"github.com/yigitkonur/proxy-http-forward/pkg/route"
+)
+
+func TestRouteMatch(t *testing.T) {
+	rt := route.New([]config.RouteConfig{
+		{Name: "exact", Match: []string{"api.example.com"}},
+		{Name: "wildcard", Match: []string{"*.example.com"}},
+		{Name: "internal", Match: []string{"10.0.0.0/8", "fd00::/8"}},
+		{Name: "default", Match: []string{"*"}},
+	})
+
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"api.example.com", "exact"},
+		{"API.Example.com.", "exact"},
+		{"www.example.com:443", "wildcard"},
+		{"10.1.2.3", "internal"},
+		{"[fd00::1]:80", "internal"},
+		{"example.org", "default"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			r := rt.Match(tt.host)
+			if assert.NotNil(t, r) {
+				assert.Equal(t, tt.want, r.Name)
+			}
+		})
+	}
+
+	assert.Nil(t, route.New(nil).Match("example.com"))
+}
+
+func TestSocketConfigValidation(t *testing.T) {
+	cfg := config.Config{
+		Server: config.ServerConfig{Address: ":8080"},
+		Proxy:  config.ProxyConfig{DialTimeout: 1},
+		Routes: []config.RouteConfig{{
+			Match:  []string{"*"},
+			Socket: &config.SocketConfig{DSCP: 64},
+		}},
+	}
+	assert.Error(t, cfg.Validate())
+
+	cfg.Routes[0].Match = []string{"10.0.0.0/33"}
+	cfg.Routes[0].Socket = nil
+	assert.Error(t, cfg.Validate())
+}
@@ -0,0 +1,70 @@
+//go:build linux
+
+package test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/config"
+	"github.com/yigitkonur/proxy-http-forward/pkg/dialer"
+	"github.com/yigitkonur/proxy-http-forward/pkg/resolver"
+	"github.com/yigitkonur/proxy-http-forward/pkg/route"
+)
+
+func TestDialerSocketOptions(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	noDelay := false
+	rt := route.New([]config.RouteConfig{{
+		Match: []string{"127.0.0.0/8"},
+		Socket: &config.SocketConfig{
+			DSCP:              46,
+			NoDelay:           &noDelay,
+			KeepAliveIdle:     30 * time.Second,
+			KeepAliveInterval: 5 * time.Second,
+			KeepAliveCount:    3,
+		},
+	}})
+	d := dialer.New(config.ProxyConfig{DialTimeout: time.Second}, rt, resolver.New(config.DNSConfig{}), getTestMetrics())
+
+	conn, err := d.Dial(ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	require.NoError(t, err)
+
+	got := map[string]int{}
+	require.NoError(t, raw.Control(func(fd uintptr) {
+		got["tos"], _ = unix.GetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS)
+		got["nodelay"], _ = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_NODELAY)
+		got["keepalive"], _ = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_KEEPALIVE)
+		got["idle"], _ = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_KEEPIDLE)
+		got["intvl"], _ = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_KEEPINTVL)
+		got["cnt"], _ = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_KEEPCNT)
+	}))
+
+	assert.Equal(t, 46<<2, got["tos"])
+	assert.Equal(t, 0, got["nodelay"])
+	assert.Equal(t, 1, got["keepalive"])
+	assert.Equal(t, 30, got["idle"])
+	assert.Equal(t, 5, got["intvl"])
+	assert.Equal(t, 3, got["cnt"])
+}
@@ -0,0 +1,80 @@
+package test
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/proxy"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/auth"
+	"github.com/yigitkonur/proxy-http-forward/pkg/config"
+	"github.com/yigitkonur/proxy-http-forward/pkg/handler"
+)
+
+// serveSOCKS serves l as a SOCKS5 listener until the test ends and
+// returns its address.
+func serveSOCKS(t *testing.T, l *handler.Listener) string {
+	t.Helper()
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go l.ServeSOCKS(c, time.Second)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestSOCKS5Listener(t *testing.T) {
+	target := startRawUpstream(t, func(c net.Conn) {
+		io.Copy(c, c)
+	})
+	_, h := startProxyHandler(t, config.Config{})
+	addr := serveSOCKS(t, h.Listener(auth.New(config.AuthConfig{
+		Enabled: true,
+		Users:   []config.UserConfig{{Username: "alice", Password: "secret"}},
+	}), nil))
+
+	// A tunnel through an authenticated SOCKS5 CONNECT.
+	d, err := proxy.SOCKS5("tcp", addr, &proxy.Auth{User: "alice", Password: "secret"}, proxy.Direct)
+	require.NoError(t, err)
+	conn, err := d.Dial("tcp", target)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.WriteString(conn, "hello")
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+
+	// Wrong passwords and clients without credentials are refused.
+	d, err = proxy.SOCKS5("tcp", addr, &proxy.Auth{User: "alice", Password: "wrong"}, proxy.Direct)
+	require.NoError(t, err)
+	_, err = d.Dial("tcp", target)
+	assert.Error(t, err)
+	d, err = proxy.SOCKS5("tcp", addr, nil, proxy.Direct)
+	require.NoError(t, err)
+	_, err = d.Dial("tcp", target)
+	assert.Error(t, err)
+
+	// Unreachable destinations get a failure reply.
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	closed := ln.Addr().String()
+	ln.Close()
+	d, err = proxy.SOCKS5("tcp", addr, &proxy.Auth{User: "alice", Password: "secret"}, proxy.Direct)
+	require.NoError(t, err)
+	_, err = d.Dial("tcp", closed)
+	assert.ErrorContains(t, err, "host unreachable")
+}
@@ -0,0 +1,176 @@
+package test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/config"
+)
+
+// startRawUpstream accepts connections on loopback and hands each to serve.
+func startRawUpstream(t *testing.T, serve func(net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serve(conn)
+			}()
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return ln.Addr().String()
+}
+
+// proxyConnect opens a CONNECT tunnel to target through the proxy at addr.
+func proxyConnect(t *testing.T, addr, target string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	require.NoError(t, err)
+
+	br := bufio.NewReader(conn)
+	resp := &fasthttp.Response{}
+	resp.SkipBody = true
+	require.NoError(t, resp.Read(br))
+	require.Equal(t, fasthttp.StatusOK, resp.StatusCode())
+	return conn, br
+}
+
+// noRetry keeps timeout tests to a single attempt.
+var noRetry = config.RetryConfig{MaxAttempts: 1}
+
+func TestFirstByteTimeout(t *testing.T) {
+	url := startUpstreamFunc(t, func(ctx *fasthttp.RequestCtx) {
+		time.Sleep(300 * time.Millisecond)
+	})
+	addr := startProxy(t, config.Config{Proxy: config.ProxyConfig{
+		Retry:    noRetry,
+		Timeouts: config.TimeoutConfig{FirstByte: 50 * time.Millisecond},
+	}})
+
+	resp := proxyGet(t, addr, "GET", url)
+	assert.Equal(t, fasthttp.StatusGatewayTimeout, resp.StatusCode())
+	assert.Contains(t, string(resp.Body()), "first byte timeout")
+}
+
+func TestReadIdleTimeout(t *testing.T) {
+	// Headers and part of the body arrive, then the upstream stalls.
+	target := startRawUpstream(t, func(conn net.Conn) {
+		bufio.NewReader(conn).ReadString('\n')
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nabc")
+		time.Sleep(time.Second)
+	})
+	addr := startProxy(t, config.Config{Proxy: config.ProxyConfig{
+		Retry:    noRetry,
+		Timeouts: config.TimeoutConfig{ReadIdle: 50 * time.Millisecond},
+	}})
+
+	resp := proxyGet(t, addr, "GET", "http://"+target+"/")
+	assert.Equal(t, fasthttp.StatusGatewayTimeout, resp.StatusCode())
+	assert.Contains(t, string(resp.Body()), "read idle timeout")
+}
+
+func TestRequestTimeoutPerRoute(t *testing.T) {
+	url := startUpstreamFunc(t, func(ctx *fasthttp.RequestCtx) {
+		time.Sleep(300 * time.Millisecond)
+	})
+	addr := startProxy(t, config.Config{
+		Proxy: config.ProxyConfig{Retry: noRetry},
+		Routes: []config.RouteConfig{{
+			Match:    []string{"127.0.0.1/32"},
+			Timeouts: &config.TimeoutConfig{Request: 50 * time.Millisecond},
+		}},
+	})
+
+	resp := proxyGet(t, addr, "GET", url)
+	assert.Equal(t, fasthttp.StatusGatewayTimeout, resp.StatusCode())
+	assert.Contains(t, string(resp.Body()), "request timeout")
+}
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	// Accepts the connection but never answers the ClientHello.
+	target := startRawUpstream(t, func(conn net.Conn) {
+		time.Sleep(time.Second)
+	})
+	addr := startProxy(t, config.Config{Proxy: config.ProxyConfig{
+		Retry:    noRetry,
+		Timeouts: config.TimeoutConfig{TLSHandshake: 50 * time.Millisecond},
+	}})
+
+	resp := proxyGet(t, addr, "GET", "https://"+target+"/")
+	assert.Equal(t, fasthttp.StatusGatewayTimeout, resp.StatusCode())
+	assert.Contains(t, string(resp.Body()), "tls handshake timeout")
+}
+
+func TestTunnelIdleTimeout(t *testing.T) {
+	target := startRawUpstream(t, func(conn net.Conn) {
+		io.Copy(conn, conn)
+	})
+	addr := startProxy(t, config.Config{Proxy: config.ProxyConfig{
+		Timeouts: config.TimeoutConfig{TunnelIdle: 100 * time.Millisecond},
+	}})
+
+	conn, br := proxyConnect(t, addr, target)
+
+	// Traffic keeps the tunnel open past the idle timeout.
+	for i := 0; i < 4; i++ {
+		_, err := io.WriteString(conn, "ping\n")
+		require.NoError(t, err)
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "ping\n", line)
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// Silence closes it.
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err := br.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestTunnelLifetime(t *testing.T) {
+	target := startRawUpstream(t, func(conn net.Conn) {
+		io.Copy(conn, conn)
+	})
+	addr := startProxy(t, config.Config{
+		Routes: []config.RouteConfig{{
+			Match:    []string{"127.0.0.1/32"},
+			Timeouts: &config.TimeoutConfig{TunnelLifetime: 150 * time.Millisecond},
+		}},
+	})
+
+	conn, br := proxyConnect(t, addr, target)
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	start := time.Now()
+	for {
+		if _, err := io.WriteString(conn, "ping\n"); err != nil {
+			break
+		}
+		if _, err := br.ReadString('\n'); err != nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	elapsed := time.Since(start)
+	assert.GreaterOrEqual(t, elapsed, 100*time.Millisecond)
+	assert.Less(t, elapsed, time.Second)
+}
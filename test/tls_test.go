@@ -0,0 +1,147 @@
+package test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/config"
+)
+
+// writeCert creates a self-signed certificate valid for 127.0.0.1 and
+// upstream.test and writes it and its key as PEM files in dir.
+func writeCert(t *testing.T, dir, name string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		DNSNames:              []string{"upstream.test"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return certFile, keyFile
+}
+
+// startTLSUpstream serves "ok" over TLS with the given certificate. If
+// clientCA is set, clients must present a certificate it signed. The last
+// SNI seen is stored in sni.
+func startTLSUpstream(t *testing.T, certFile, keyFile, clientCA string, sni *atomic.Value) string {
+	t.Helper()
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	require.NoError(t, err)
+	tlsCfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			if sni != nil {
+				sni.Store(hello.ServerName)
+			}
+			return nil, nil
+		},
+	}
+	if clientCA != "" {
+		pemData, err := os.ReadFile(clientCA)
+		require.NoError(t, err)
+		tlsCfg.ClientCAs = x509.NewCertPool()
+		tlsCfg.ClientCAs.AppendCertsFromPEM(pemData)
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := &fasthttp.Server{Handler: func(ctx *fasthttp.RequestCtx) { ctx.SetBodyString("ok") }}
+	go srv.Serve(tls.NewListener(ln, tlsCfg))
+	t.Cleanup(func() { srv.Shutdown() })
+
+	return "https://" + ln.Addr().String() + "/"
+}
+
+func TestUpstreamTLSCustomCA(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCert(t, dir, "server")
+	url := startTLSUpstream(t, certFile, keyFile, "", nil)
+
+	// The self-signed certificate is not in the system roots.
+	addr := startProxy(t, config.Config{})
+	assert.Equal(t, fasthttp.StatusBadGateway, proxyGet(t, addr, "GET", url).StatusCode())
+
+	addr = startProxy(t, config.Config{Proxy: config.ProxyConfig{
+		TLS: config.TLSConfig{CAFile: certFile, MinVersion: "1.2"},
+	}})
+	assert.Equal(t, fasthttp.StatusOK, proxyGet(t, addr, "GET", url).StatusCode())
+}
+
+func TestUpstreamTLSPerRoute(t *testing.T) {
+	dir := t.TempDir()
+	serverCert, serverKey := writeCert(t, dir, "server")
+	clientCert, clientKey := writeCert(t, dir, "client")
+	var sni atomic.Value
+	url := startTLSUpstream(t, serverCert, serverKey, clientCert, &sni)
+
+	// The route adds a client certificate and an SNI override on top of
+	// the global CA bundle.
+	addr := startProxy(t, config.Config{
+		Proxy: config.ProxyConfig{TLS: config.TLSConfig{CAFile: serverCert}},
+		Routes: []config.RouteConfig{{
+			Name:  "mtls",
+			Match: []string{"127.0.0.1/32"},
+			TLS:   &config.TLSConfig{CertFile: clientCert, KeyFile: clientKey, ServerName: "upstream.test"},
+		}},
+	})
+	assert.Equal(t, fasthttp.StatusOK, proxyGet(t, addr, "GET", url).StatusCode())
+	assert.Equal(t, "upstream.test", sni.Load())
+}
+
+func TestUpstreamTLSValidation(t *testing.T) {
+	base := config.Config{
+		Server: config.ServerConfig{Address: ":8080"},
+		Proxy:  config.ProxyConfig{DialTimeout: 1},
+	}
+
+	cfg := base
+	cfg.Proxy.TLS.MinVersion = "1.4"
+	assert.Error(t, cfg.Validate())
+
+	cfg = base
+	cfg.Proxy.TLS.CertFile = "client.crt"
+	assert.Error(t, cfg.Validate(), "cert_file without key_file")
+
+	cfg = base
+	cfg.Proxy.TLS.CAFile = filepath.Join(t.TempDir(), "missing.pem")
+	assert.Error(t, cfg.Validate())
+
+	cfg = base
+	cfg.Routes = []config.RouteConfig{{Match: []string{"*"}, TLS: &config.TLSConfig{InsecureSkipVerify: true}}}
+	assert.NoError(t, cfg.Validate())
+}
@@ -0,0 +1,115 @@
+package test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/config"
+)
+
+// tunnelCloses returns the close counter for reason.
+func tunnelCloses(reason string) float64 {
+	return testutil.ToFloat64(getTestMetrics().TunnelCloses.WithLabelValues(reason))
+}
+
+func TestTunnelHalfClose(t *testing.T) {
+	// Reads the whole request, then answers and closes, like a
+	// request/response protocol that uses EOF as the end marker.
+	target := startRawUpstream(t, func(conn net.Conn) {
+		data, _ := io.ReadAll(conn)
+		conn.Write(append([]byte("got "), data...))
+	})
+	addr := startProxy(t, config.Config{})
+	before := tunnelCloses("client_eof")
+
+	conn, br := proxyConnect(t, addr, target)
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	_, err := io.WriteString(conn, "hello")
+	require.NoError(t, err)
+	require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+
+	reply, err := io.ReadAll(br)
+	require.NoError(t, err)
+	assert.Equal(t, "got hello", string(reply))
+
+	assert.Eventually(t, func() bool { return tunnelCloses("client_eof") == before+1 },
+		time.Second, 10*time.Millisecond)
+}
+
+func TestTunnelCloseReasons(t *testing.T) {
+	target := startRawUpstream(t, func(conn net.Conn) {
+		io.Copy(conn, conn)
+	})
+	addr := startProxy(t, config.Config{Proxy: config.ProxyConfig{
+		Timeouts: config.TimeoutConfig{TunnelIdle: 50 * time.Millisecond},
+	}})
+
+	idle := tunnelCloses("idle")
+	proxyConnect(t, addr, target)
+	assert.Eventually(t, func() bool { return tunnelCloses("idle") == idle+1 },
+		time.Second, 10*time.Millisecond)
+
+	addr, h := startProxyHandler(t, config.Config{})
+	shutdown := tunnelCloses("shutdown")
+	open := testutil.ToFloat64(getTestMetrics().TunnelConnections)
+	conn, br := proxyConnect(t, addr, target)
+	_, err := io.WriteString(conn, "x")
+	require.NoError(t, err)
+	_, err = br.ReadByte()
+	require.NoError(t, err)
+
+	// The tunnel counts as open for as long as it runs.
+	assert.Equal(t, open+1, testutil.ToFloat64(getTestMetrics().TunnelConnections))
+	h.CloseTunnels()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = br.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Eventually(t, func() bool { return tunnelCloses("shutdown") == shutdown+1 },
+		time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool { return testutil.ToFloat64(getTestMetrics().TunnelConnections) == open },
+		time.Second, 10*time.Millisecond)
+}
+
+func TestDrainTunnels(t *testing.T) {
+	target := startRawUpstream(t, func(conn net.Conn) {
+		io.Copy(conn, conn)
+	})
+	addr, h := startProxyHandler(t, config.Config{})
+
+	finishing, _ := proxyConnect(t, addr, target)
+	proxyConnect(t, addr, target) // stays open
+
+	type result struct{ drained, closed int }
+	results := make(chan result, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		defer cancel()
+		drained, closed := h.DrainTunnels(ctx)
+		results <- result{drained, closed}
+	}()
+
+	// New tunnels are refused while draining.
+	assert.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return false
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+		resp := &fasthttp.Response{}
+		return resp.Read(bufio.NewReader(conn)) == nil && resp.StatusCode() == fasthttp.StatusServiceUnavailable
+	}, time.Second, 10*time.Millisecond)
+
+	finishing.Close()
+	assert.Equal(t, result{drained: 1, closed: 1}, <-results)
+}
@@ -0,0 +1,61 @@
+//go:build linux
+
+package test
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/config"
+	"github.com/yigitkonur/proxy-http-forward/pkg/unixsock"
+)
+
+func TestUnixListenerPeerCred(t *testing.T) {
+	url := startUpstreamFunc(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBodyString("ok")
+	})
+	_, h := startProxyHandler(t, config.Config{})
+
+	for _, path := range []string{
+		filepath.Join(t.TempDir(), "proxy.sock"),
+		"@proxy-test-" + strconv.Itoa(os.Getpid()),
+	} {
+		t.Run(path, func(t *testing.T) {
+			ln, err := net.Listen("unix", path)
+			require.NoError(t, err)
+
+			creds := make(chan *unixsock.Cred, 1)
+			proxy := h.Listener(nil, nil)
+			serveListener(t, unixsock.WithCred(ln), func(ctx *fasthttp.RequestCtx) {
+				creds <- unixsock.CredOf(ctx.Conn())
+				proxy.HandleRequest(ctx)
+			})
+
+			conn, err := net.DialTimeout("unix", path, time.Second)
+			require.NoError(t, err)
+			defer conn.Close()
+			_, err = fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: upstream\r\n\r\n", url)
+			require.NoError(t, err)
+
+			var resp fasthttp.Response
+			require.NoError(t, resp.Read(bufio.NewReader(conn)))
+			assert.Equal(t, fasthttp.StatusOK, resp.StatusCode())
+
+			cred := <-creds
+			require.NotNil(t, cred)
+			assert.Equal(t, int32(os.Getpid()), cred.PID)
+			assert.Equal(t, uint32(os.Getuid()), cred.UID)
+			assert.Equal(t, uint32(os.Getgid()), cred.GID)
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package test
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/config"
+	"github.com/yigitkonur/proxy-http-forward/pkg/unixsock"
+)
+
+func TestRemoveStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+
+	// A socket file left behind by a process that exited uncleanly.
+	ln, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	require.FileExists(t, path)
+
+	require.NoError(t, unixsock.RemoveStale(path))
+	assert.NoFileExists(t, path)
+	require.NoError(t, unixsock.RemoveStale(path), "missing files are fine")
+
+	// A live socket is left alone.
+	ln, err = net.Listen("unix", path)
+	require.NoError(t, err)
+	defer ln.Close()
+	require.NoError(t, unixsock.RemoveStale(path))
+	assert.FileExists(t, path)
+
+	// So is anything that is not a socket.
+	regular := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(regular, nil, 0o600))
+	assert.Error(t, unixsock.RemoveStale(regular))
+	assert.FileExists(t, regular)
+}
+
+func TestConfigureSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	ln, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	defer ln.Close()
+
+	require.NoError(t, unixsock.Configure(path, "0600", "", ""))
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+
+	// Numeric IDs need no lookup; chown to ourselves always succeeds.
+	uid, gid := os.Getuid(), os.Getgid()
+	require.NoError(t, unixsock.Configure(path, "", strconv.Itoa(uid), strconv.Itoa(gid)))
+	assert.Error(t, unixsock.Configure(path, "0999", "", ""))
+}
+
+func TestUnixListenerConfig(t *testing.T) {
+	base := config.Config{
+		Server: config.ServerConfig{Address: ":8080"},
+		Proxy:  config.ProxyConfig{DialTimeout: time.Second},
+	}
+
+	l := config.ListenerConfig{Address: "unix:/run/proxy.sock"}
+	network, addr := l.Network()
+	assert.Equal(t, "unix", network)
+	assert.Equal(t, "/run/proxy.sock", addr)
+	network, addr = config.ListenerConfig{Address: ":3128"}.Network()
+	assert.Equal(t, "tcp", network)
+	assert.Equal(t, ":3128", addr)
+
+	tests := []struct {
+		name    string
+		l       config.ListenerConfig
+		wantErr bool
+	}{
+		{"socket file", config.ListenerConfig{Address: "unix:/run/proxy.sock", SocketMode: "0660", SocketGroup: "proxy"}, false},
+		{"empty path", config.ListenerConfig{Address: "unix:"}, true},
+		{"bad mode", config.ListenerConfig{Address: "unix:/run/proxy.sock", SocketMode: "rw"}, true},
+		{"mode on tcp", config.ListenerConfig{Address: ":3128", SocketMode: "0660"}, true},
+		{"mode on abstract", config.ListenerConfig{Address: "unix:@proxy", SocketMode: "0660"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := base
+			cfg.Server.Listeners = []config.ListenerConfig{tt.l}
+			if tt.wantErr {
+				assert.Error(t, cfg.Validate())
+			} else {
+				assert.NoError(t, cfg.Validate())
+			}
+		})
+	}
+}
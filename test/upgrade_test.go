@@ -0,0 +1,92 @@
+package test
+
+import (
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/yigitkonur/proxy-http-forward/pkg/upgrade"
+)
+
+// TestMain lets this test binary act as the new process started by
+// Upgrade, which re-executes it with the same arguments.
+func TestMain(m *testing.M) {
+	switch {
+	case os.Getenv("TEST_UPGRADE_CHILD_ADDR") != "":
+		upgradeChild(os.Getenv("TEST_UPGRADE_CHILD_ADDR"))
+	case os.Getenv("TEST_UPGRADE_CHILD_FAIL") != "":
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+// upgradeChild takes over the listener, answers one connection and exits.
+func upgradeChild(addr string) {
+	up, err := upgrade.New()
+	if err != nil {
+		os.Exit(2)
+	}
+	ln, err := up.Listen("tcp4", addr)
+	if err != nil || !up.Inherited() {
+		os.Exit(3)
+	}
+	if err := up.Ready(); err != nil {
+		os.Exit(4)
+	}
+
+	ln.(*net.TCPListener).SetDeadline(time.Now().Add(5 * time.Second))
+	conn, err := ln.Accept()
+	if err != nil {
+		os.Exit(5)
+	}
+	io.WriteString(conn, "child")
+	conn.Close()
+	os.Exit(0)
+}
+
+func TestUpgradeHandsOverListener(t *testing.T) {
+	up, err := upgrade.New()
+	require.NoError(t, err)
+	ln, err := up.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, up.Ready())
+	assert.False(t, up.Inherited())
+
+	// The child re-runs this test binary with the same arguments.
+	t.Setenv("TEST_UPGRADE_CHILD_ADDR", ln.Addr().String())
+	pid, err := up.Upgrade(10 * time.Second)
+	require.NoError(t, err)
+	assert.NotZero(t, pid)
+
+	// Once the parent stops accepting, the child serves the same socket.
+	ln.Close()
+	conn, err := net.Dial("tcp4", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reply, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "child", string(reply))
+}
+
+func TestUpgradeFailureKeepsServing(t *testing.T) {
+	up, err := upgrade.New()
+	require.NoError(t, err)
+	ln, err := up.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	t.Setenv("TEST_UPGRADE_CHILD_FAIL", "1")
+	_, err = up.Upgrade(10 * time.Second)
+	assert.Error(t, err)
+
+	// The listener is still ours.
+	conn, err := net.Dial("tcp4", ln.Addr().String())
+	require.NoError(t, err)
+	conn.Close()
+}